@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+// aggregateReport is a DMARC aggregate report (RFC 7489 appendix C)
+// The structure follows the XML, unlike go-dmarc-report every auth result of a record is kept.
+type aggregateReport struct {
+	XMLName         xml.Name          `xml:"feedback"`
+	Version         string            `xml:"version"`
+	Metadata        aggregateMetadata `xml:"report_metadata"`
+	PolicyPublished aggregatePolicy   `xml:"policy_published"`
+	Records         []aggregateRecord `xml:"record"`
+}
+
+// aggregateMetadata represents feedback>report_metadata
+type aggregateMetadata struct {
+	OrgName          string             `xml:"org_name"`
+	Email            string             `xml:"email"`
+	ExtraContactInfo string             `xml:"extra_contact_info"`
+	ReportID         string             `xml:"report_id"`
+	DateRange        aggregateDateRange `xml:"date_range"`
+	Errors           []string           `xml:"error"`
+}
+
+// aggregateDateRange represents feedback>report_metadata>date_range, in seconds since the epoch
+type aggregateDateRange struct {
+	Begin unixTime `xml:"begin"`
+	End   unixTime `xml:"end"`
+}
+
+// unixTime is a time that is a unix timestamp in the XML
+type unixTime struct {
+	time.Time
+}
+
+func (t *unixTime) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var v int64
+	err := d.DecodeElement(&v, &start)
+	t.Time = time.Unix(v, 0)
+	return err
+}
+
+// aggregatePolicy represents feedback>policy_published
+type aggregatePolicy struct {
+	Domain     string `xml:"domain"`
+	ADKIM      string `xml:"adkim"`
+	ASPF       string `xml:"aspf"`
+	Policy     string `xml:"p"`
+	SPolicy    string `xml:"sp"`
+	Percentage *int   `xml:"pct"`
+	FO         string `xml:"fo"`
+	NP         string `xml:"np"`      // DMARCbis, the policy for non-existent subdomains
+	PSD        string `xml:"psd"`     // DMARCbis, whether the domain is a public suffix domain
+	Testing    string `xml:"testing"` // DMARCbis, replaces pct
+}
+
+// aggregateRecord represents feedback>record
+type aggregateRecord struct {
+	Row         aggregateRow         `xml:"row"`
+	Identifiers aggregateIdentifiers `xml:"identifiers"`
+	AuthResults aggregateAuthResults `xml:"auth_results"`
+}
+
+// aggregateRow represents feedback>record>row
+type aggregateRow struct {
+	SourceIP        string                   `xml:"source_ip"`
+	Count           int                      `xml:"count"`
+	PolicyEvaluated aggregatePolicyEvaluated `xml:"policy_evaluated"`
+}
+
+// aggregatePolicyEvaluated represents feedback>record>row>policy_evaluated
+type aggregatePolicyEvaluated struct {
+	Disposition string                 `xml:"disposition"`
+	DKIM        string                 `xml:"dkim"`
+	SPF         string                 `xml:"spf"`
+	Reasons     []policyOverrideReason `xml:"reason"`
+}
+
+// policyOverrideReason represents feedback>record>row>policy_evaluated>reason, why the receiver
+// applied a different policy than published (forwarded, mailing_list, local_policy, ...)
+type policyOverrideReason struct {
+	Type    string `xml:"type"`
+	Comment string `xml:"comment"`
+}
+
+// aggregateIdentifiers represents feedback>record>identifiers
+type aggregateIdentifiers struct {
+	HeaderFrom   string `xml:"header_from"`
+	EnvelopeTo   string `xml:"envelope_to"`
+	EnvelopeFrom string `xml:"envelope_from"`
+}
+
+// aggregateAuthResults represents feedback>record>auth_results, with a result for every
+// DKIM signature and SPF check
+type aggregateAuthResults struct {
+	DKIM []dkimAuthResult `xml:"dkim"`
+	SPF  []spfAuthResult  `xml:"spf"`
+}
+
+// dkimAuthResult represents feedback>record>auth_results>dkim
+type dkimAuthResult struct {
+	Domain      string `xml:"domain"`
+	Selector    string `xml:"selector"`
+	Result      string `xml:"result"`
+	HumanResult string `xml:"human_result"`
+}
+
+// spfAuthResult represents feedback>record>auth_results>spf
+type spfAuthResult struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope"`
+	Result string `xml:"result"`
+}
+
+// firstDKIM returns the first DKIM result, which goes in the record table
+func (a aggregateAuthResults) firstDKIM() dkimAuthResult {
+	if len(a.DKIM) == 0 {
+		return dkimAuthResult{}
+	}
+	return a.DKIM[0]
+}
+
+// firstSPF returns the first SPF result, which goes in the record table
+func (a aggregateAuthResults) firstSPF() spfAuthResult {
+	if len(a.SPF) == 0 {
+		return spfAuthResult{}
+	}
+	return a.SPF[0]
+}
+
+// decodeAggregate decodes the XML of an aggregate report
+// Reports that declare another encoding than UTF-8 are converted. XML nested deeper than the
+// configured limit is refused before it is decoded.
+func decodeAggregate(data []byte) (*aggregateReport, error) {
+	if err := checkXMLDepth(data, Configuration.limits().MaxXMLDepth); err != nil {
+		return nil, err
+	}
+	agg := &aggregateReport{}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = charsetReader
+	return agg, decoder.Decode(agg)
+}
+
+// checkXMLDepth returns an error if elements are nested deeper than maxDepth
+// Syntax errors are left for the decoder to report.
+func checkXMLDepth(data []byte, maxDepth int) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.CharsetReader = charsetReader
+	depth := 0
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return nil
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth > maxDepth {
+				return fmt.Errorf("XML nested deeper than %d levels", maxDepth)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	archiveKindAggregate = "aggregate"
+	archiveKindTLS       = "tlsrpt"
+)
+
+// archivedReport is a report as it was received, from the report_archive table
+type archivedReport struct {
+	SHA256  string
+	Kind    string
+	Content []byte
+	Headers []byte
+	Account string
+	Folder  string
+
+	DKIMResult string
+	DKIMDomain string
+}
+
+// rawSHA256 returns the hash the decompressed report is archived under, empty if there is none
+func (r *fetchedReport) rawSHA256() string {
+	if r.Raw == nil {
+		return ""
+	}
+	hash := sha256.Sum256(r.Raw)
+	return hex.EncodeToString(hash[:])
+}
+
+// reingestArchive decodes every archived report again and replaces what is stored for it
+// This is for after a fix in decoding or storing, the mailboxes are not touched.
+func reingestArchive() (syncStats, error) {
+	stats := syncStats{}
+	hashes, err := getArchiveHashes()
+	if err != nil {
+		return stats, fmt.Errorf("error getting archived reports: %w", err)
+	}
+	slog.Info("re-ingesting archive", "reports", len(hashes))
+	timer := time.Now()
+	batchSize := fetchBatchSize()
+	for start := 0; start < len(hashes); start += batchSize {
+		end := min(start+batchSize, len(hashes))
+		archived, err := getArchivedReports(hashes[start:end])
+		if err != nil {
+			return stats, fmt.Errorf("error reading archived reports: %w", err)
+		}
+		reports := make([]*fetchedReport, 0, len(archived))
+		for _, a := range archived {
+			rep, err := decodeArchivedReport(a)
+			if err != nil {
+				slog.Warn("archived report could not be decoded", "sha256", a.SHA256, "error", err)
+				stats.Errors++
+				continue
+			}
+			rep.Replace = true
+			reports = append(reports, rep)
+		}
+		reports, failed, err := storeDecoded(reports, nil)
+		if err != nil {
+			return stats, err
+		}
+		stats.Reports += len(reports)
+		stats.Errors += len(failed)
+		slog.Debug("re-ingest progress", "done", end, "total", len(hashes), "duration", time.Since(timer))
+	}
+	slog.Info("finished re-ingest", "reports", stats.Reports, "errors", stats.Errors, "duration", time.Since(timer))
+	return stats, nil
+}
+
+// decodeArchivedReport decodes an archived report the same way as when it was received
+func decodeArchivedReport(a archivedReport) (*fetchedReport, error) {
+	rep := &fetchedReport{
+		Raw:     a.Content,
+		Headers: a.Headers,
+		Account: a.Account,
+		Folder:  a.Folder,
+	}
+	if a.DKIMResult != "" {
+		rep.DKIM = &dkimVerification{Result: a.DKIMResult, Domain: a.DKIMDomain}
+	}
+	var err error
+	switch a.Kind {
+	case archiveKindAggregate:
+		rep.Aggregate, err = decodeAggregate(a.Content)
+	case archiveKindTLS:
+		rep.TLS, err = decodeTLSReport(a.Content)
+	default:
+		err = fmt.Errorf("unknown archive kind '%s'", a.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
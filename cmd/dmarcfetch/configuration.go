@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
@@ -13,20 +15,442 @@ type ConfigDatabase struct {
 	LogFormat   string `yaml:"logformat" env:"DMARCANALYZE_LOG_FORMAT" `
 	LogProgress int    `yaml:"logprogress" env:"DMARCANALYZE_LOG_PROGRESS"`
 	Sleep       int    `yaml:"sleep" env:"DMARCANALYZE_SLEEP"`
+	Mode        string `yaml:"mode" env:"DMARCANALYZE_MODE"`
+	IdleRefresh int    `yaml:"idlerefresh" env:"DMARCANALYZE_IDLE_REFRESH"`
 
-	IMAP struct {
-		Address  string `yaml:"address" env:"DMARCANALYZE_IMAP_SERVER_ADDRESS" `
-		Port     string `yaml:"port" env:"DMARCANALYZE_IMAP_SERVER_PORT" `
-		Username string `yaml:"username" env:"DMARCANALYZE_IMAP_USERNAME"`
-		Password string `yaml:"password" env:"DMARCANALYZE_IMAP_PASSWORD"`
-	} `yaml:"imap"`
+	FetchBatchSize int `yaml:"fetchbatchsize" env:"DMARCANALYZE_FETCH_BATCH_SIZE"`
+	DecodeWorkers  int `yaml:"decodeworkers" env:"DMARCANALYZE_DECODE_WORKERS"`
+
+	QuarantineDir string `yaml:"quarantinedir" env:"DMARCANALYZE_QUARANTINE_DIR"`
+
+	// DKIM verifies that report messages come from the organization they claim to
+	DKIM ConfigDKIM `yaml:"dkim" env-prefix:"DMARCANALYZE_DKIM_"`
+
+	// Limits protect against oversized attachments and decompression bombs
+	Limits ConfigLimits `yaml:"limits" env-prefix:"DMARCANALYZE_LIMITS_"`
+
+	// IMAP is the single account that can be configured through environment variables
+	IMAP ConfigIMAPAccount `yaml:"imap" env-prefix:"DMARCANALYZE_IMAP_"`
+	// Accounts are any additional IMAP accounts to fetch from in the same run
+	Accounts []ConfigIMAPAccount `yaml:"accounts"`
+	// POP3 are the POP3 accounts to fetch reports from
+	POP3 []ConfigPOP3Account `yaml:"pop3"`
+	// Files are local directories, Maildirs and mbox files to read reports from
+	Files []ConfigFileSource `yaml:"files"`
+	// Receiver accepts report mail over SMTP or LMTP
+	Receiver ConfigReceiver `yaml:"receiver" env-prefix:"DMARCANALYZE_RECEIVER_"`
 
 	Database struct {
 		Driver           string `yaml:"driver" env:"DMARCANALYZE_DATABASE_DRIVER" `
 		ConnectionString string `yaml:"connectionstring" env:"DMARCANALYZE_DATABASE_CONNECTIONSTRING"`
+		Upsert           bool   `yaml:"upsert" env:"DMARCANALYZE_DATABASE_UPSERT"`
+		Migrate          string `yaml:"migrate" env:"DMARCANALYZE_DATABASE_MIGRATE"` // auto (default) or manual
+		MaxOpenConns     int    `yaml:"maxopenconns" env:"DMARCANALYZE_DATABASE_MAXOPENCONNS"`
+		MaxIdleConns     int    `yaml:"maxidleconns" env:"DMARCANALYZE_DATABASE_MAXIDLECONNS"`
+		ConnMaxLifetime  int    `yaml:"connmaxlifetime" env:"DMARCANALYZE_DATABASE_CONNMAXLIFETIME"` // In seconds
+		ConnectAttempts  int    `yaml:"connectattempts" env:"DMARCANALYZE_DATABASE_CONNECTATTEMPTS"`
 	} `yaml:"database"`
 }
 
+// ConfigIMAPAccount holds the connection, folder and search settings of one IMAP account
+// The env tags are prefixed by the env-prefix of the field that uses this type
+type ConfigIMAPAccount struct {
+	Name          string   `yaml:"name" env:"NAME"`
+	Address       string   `yaml:"address" env:"SERVER_ADDRESS" `
+	Port          string   `yaml:"port" env:"SERVER_PORT" `
+	Username      string   `yaml:"username" env:"USERNAME"`
+	Password      string   `yaml:"password" env:"PASSWORD"`
+	Folders       []string `yaml:"folders" env:"FOLDERS"`
+	FolderPattern string   `yaml:"folderpattern" env:"FOLDER_PATTERN"`
+
+	TLS ConfigTLS `yaml:"tls" env-prefix:"TLS_"`
+
+	Auth struct {
+		Method string       `yaml:"method" env:"METHOD"`
+		OAuth2 ConfigOAuth2 `yaml:"oauth2" env-prefix:"OAUTH2_"`
+	} `yaml:"auth" env-prefix:"AUTH_"`
+
+	Actions struct {
+		Success       ConfigAction `yaml:"success" env-prefix:"SUCCESS_"`
+		Failure       ConfigAction `yaml:"failure" env-prefix:"FAILURE_"`
+		RetentionDays int          `yaml:"retentiondays" env:"RETENTION_DAYS"`
+	} `yaml:"actions" env-prefix:"ACTIONS_"`
+
+	Search struct {
+		Subject string `yaml:"subject" env:"SEARCH_SUBJECT"`
+		From    string `yaml:"from" env:"SEARCH_FROM"`
+		Unseen  bool   `yaml:"unseen" env:"SEARCH_UNSEEN"`
+	} `yaml:"search"`
+}
+
+// ConfigPOP3Account holds the connection settings of one POP3 account
+type ConfigPOP3Account struct {
+	Name     string    `yaml:"name"`
+	Address  string    `yaml:"address"`
+	Port     string    `yaml:"port"`
+	Username string    `yaml:"username"`
+	Password string    `yaml:"password"`
+	TLS      ConfigTLS `yaml:"tls"`
+	Delete   bool      `yaml:"delete"`
+}
+
+// ConfigFileSource is a local directory, Maildir or mbox file to read reports from
+type ConfigFileSource struct {
+	Name          string `yaml:"name"`
+	Type          string `yaml:"type"`
+	Path          string `yaml:"path"`
+	Watch         bool   `yaml:"watch"`
+	WatchInterval int    `yaml:"watchinterval"`
+}
+
+// ConfigReceiver holds the settings of the SMTP/LMTP listener
+type ConfigReceiver struct {
+	Listen          string   `yaml:"listen" env:"LISTEN"`
+	Protocol        string   `yaml:"protocol" env:"PROTOCOL"`
+	Name            string   `yaml:"name" env:"NAME"`
+	Domain          string   `yaml:"domain" env:"DOMAIN"`
+	MaxMessageBytes int      `yaml:"maxmessagebytes" env:"MAX_MESSAGE_BYTES"`
+	MaxRecipients   int      `yaml:"maxrecipients" env:"MAX_RECIPIENTS"`
+	Recipients      []string `yaml:"recipients" env:"RECIPIENTS"`
+
+	TLS struct {
+		Cert    string `yaml:"cert" env:"CERT"`
+		Key     string `yaml:"key" env:"KEY"`
+		Require bool   `yaml:"require" env:"REQUIRE"`
+	} `yaml:"tls" env-prefix:"TLS_"`
+}
+
+// ConfigDKIM holds whether and how the DKIM signatures of report messages are verified
+type ConfigDKIM struct {
+	Verify   bool   `yaml:"verify" env:"VERIFY"`
+	Policy   string `yaml:"policy" env:"POLICY"`
+	Resolver string `yaml:"resolver" env:"RESOLVER"`
+	Timeout  int    `yaml:"timeout" env:"TIMEOUT"`
+}
+
+// ConfigLimits holds the caps on report attachments, anything over them is rejected as a decode error
+type ConfigLimits struct {
+	MaxCompressedBytes   int64 `yaml:"maxcompressedbytes" env:"MAX_COMPRESSED_BYTES"`
+	MaxDecompressedBytes int64 `yaml:"maxdecompressedbytes" env:"MAX_DECOMPRESSED_BYTES"`
+	MaxRatio             int64 `yaml:"maxratio" env:"MAX_RATIO"`
+	MaxZipEntries        int   `yaml:"maxzipentries" env:"MAX_ZIP_ENTRIES"`
+	MaxXMLDepth          int   `yaml:"maxxmldepth" env:"MAX_XML_DEPTH"`
+}
+
+// ConfigTLS holds how a connection to a mail server is secured
+type ConfigTLS struct {
+	Mode        string `yaml:"mode" env:"MODE"`
+	ServerName  string `yaml:"servername" env:"SERVER_NAME"`
+	CAFile      string `yaml:"cafile" env:"CA_FILE"`
+	Fingerprint string `yaml:"fingerprint" env:"FINGERPRINT"`
+	ClientCert  string `yaml:"clientcert" env:"CLIENT_CERT"`
+	ClientKey   string `yaml:"clientkey" env:"CLIENT_KEY"`
+}
+
+// ConfigAction holds what to do with a report message after it has been processed
+type ConfigAction struct {
+	Move     string   `yaml:"move" env:"MOVE"`
+	Seen     bool     `yaml:"seen" env:"SEEN"`
+	Keywords []string `yaml:"keywords" env:"KEYWORDS"`
+}
+
+func (a ConfigAction) enabled() bool {
+	return a.Move != "" || a.Seen || len(a.Keywords) > 0
+}
+
+// ConfigOAuth2 holds where the access tokens for XOAUTH2 and OAUTHBEARER come from
+type ConfigOAuth2 struct {
+	Source           string `yaml:"source" env:"SOURCE"`
+	TokenURL         string `yaml:"tokenurl" env:"TOKEN_URL"`
+	ClientID         string `yaml:"clientid" env:"CLIENT_ID"`
+	ClientSecret     string `yaml:"clientsecret" env:"CLIENT_SECRET"`
+	Scope            string `yaml:"scope" env:"SCOPE"`
+	RefreshTokenFile string `yaml:"refreshtokenfile" env:"REFRESH_TOKEN_FILE"`
+	Command          string `yaml:"command" env:"COMMAND"`
+}
+
+// redactedSecret is logged instead of a password, client secret or connection string
+const redactedSecret = "REDACTED"
+
+// redact hides a secret in the log, an empty one stays empty so a missing setting can still be seen
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedSecret
+}
+
+// The handlers only resolve the LogValue of the value that is logged, not of the fields inside it.
+// The redacted copies therefore redact the secrets of the nested settings too, and LogValue logs them
+// as a type without methods so they are not resolved again.
+
+func (c ConfigOAuth2) redacted() ConfigOAuth2 {
+	c.ClientSecret = redact(c.ClientSecret)
+	return c
+}
+
+func (c ConfigOAuth2) LogValue() slog.Value {
+	type plain ConfigOAuth2
+	return slog.AnyValue(plain(c.redacted()))
+}
+
+func (a ConfigIMAPAccount) redacted() ConfigIMAPAccount {
+	a.Password = redact(a.Password)
+	a.Auth.OAuth2 = a.Auth.OAuth2.redacted()
+	return a
+}
+
+func (a ConfigIMAPAccount) LogValue() slog.Value {
+	type plain ConfigIMAPAccount
+	return slog.AnyValue(plain(a.redacted()))
+}
+
+func (a ConfigPOP3Account) redacted() ConfigPOP3Account {
+	a.Password = redact(a.Password)
+	return a
+}
+
+func (a ConfigPOP3Account) LogValue() slog.Value {
+	type plain ConfigPOP3Account
+	return slog.AnyValue(plain(a.redacted()))
+}
+
+// redacted returns a copy of the configuration without the secrets of the accounts and the database
+// The connection string of SQLite is only a file name, those of the servers may hold a password.
+func (c ConfigDatabase) redacted() ConfigDatabase {
+	c.IMAP = c.IMAP.redacted()
+	accounts := make([]ConfigIMAPAccount, len(c.Accounts))
+	for i, account := range c.Accounts {
+		accounts[i] = account.redacted()
+	}
+	c.Accounts = accounts
+	pop3 := make([]ConfigPOP3Account, len(c.POP3))
+	for i, account := range c.POP3 {
+		pop3[i] = account.redacted()
+	}
+	c.POP3 = pop3
+	if c.Database.Driver != "sqlite" {
+		c.Database.ConnectionString = redact(c.Database.ConnectionString)
+	}
+	return c
+}
+
+func (c ConfigDatabase) LogValue() slog.Value {
+	type plain ConfigDatabase
+	return slog.AnyValue(plain(c.redacted()))
+}
+
+const (
+	tlsModeImplicit = "implicit"
+	tlsModeStartTLS = "starttls"
+	tlsModeNone     = "none"
+)
+
+// actionsEnabled returns true if any of the post-processing actions change the messages in the folder
+func (a *ConfigIMAPAccount) actionsEnabled() bool {
+	return a.Actions.Success.enabled() || a.Actions.Failure.enabled() || a.Actions.RetentionDays > 0
+}
+
+const (
+	defaultIMAPFolder        = "Agents.Dmarc" // The folder dmarcfetch read before folders could be configured
+	defaultIMAPSearchSubject = "Report Domain: "
+)
+
+// imapAccounts returns all configured IMAP accounts with defaults filled in
+// The environment configurable account is only included if it has a server address
+func (c *ConfigDatabase) imapAccounts() []ConfigIMAPAccount {
+	accounts := make([]ConfigIMAPAccount, 0, len(c.Accounts)+1)
+	if c.IMAP.Address != "" {
+		accounts = append(accounts, c.IMAP)
+	}
+	accounts = append(accounts, c.Accounts...)
+	for idx := range accounts {
+		account := &accounts[idx]
+		if account.TLS.Mode == "" {
+			account.TLS.Mode = tlsModeImplicit
+		}
+		if account.Auth.Method == "" {
+			account.Auth.Method = authMethodPassword
+		}
+		if account.Port == "" {
+			account.Port = "993"
+			if account.TLS.Mode != tlsModeImplicit {
+				account.Port = "143"
+			}
+		}
+		if account.Name == "" {
+			account.Name = account.Username + "@" + account.Address
+		}
+		if len(account.Folders) == 0 && account.FolderPattern == "" {
+			account.Folders = []string{defaultIMAPFolder}
+		}
+		switch account.Search.Subject {
+		case "":
+			account.Search.Subject = defaultIMAPSearchSubject
+		case "*": // Do not filter on subject at all
+			account.Search.Subject = ""
+		}
+	}
+	return accounts
+}
+
+// pop3Accounts returns all configured POP3 accounts with defaults filled in
+func (c *ConfigDatabase) pop3Accounts() []ConfigPOP3Account {
+	accounts := make([]ConfigPOP3Account, 0, len(c.POP3))
+	for _, account := range c.POP3 {
+		if account.TLS.Mode == "" {
+			account.TLS.Mode = tlsModeImplicit
+		}
+		if account.Port == "" {
+			account.Port = "995"
+			if account.TLS.Mode != tlsModeImplicit {
+				account.Port = "110"
+			}
+		}
+		if account.Name == "" {
+			account.Name = account.Username + "@" + account.Address
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+// fileSources returns all configured file sources with defaults filled in
+func (c *ConfigDatabase) fileSources() []ConfigFileSource {
+	sources := make([]ConfigFileSource, 0, len(c.Files))
+	for _, source := range c.Files {
+		if source.Type == "" {
+			source.Type = fileSourceDir
+		}
+		if source.Name == "" {
+			source.Name = source.Path
+		}
+		if source.WatchInterval <= 0 {
+			source.WatchInterval = defaultWatchInterval
+		}
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// receiver returns the receiver settings with defaults filled in
+func (c *ConfigDatabase) receiver() (ConfigReceiver, error) {
+	receiver := c.Receiver
+	if receiver.Protocol == "" {
+		receiver.Protocol = receiverProtocolSMTP
+	}
+	if receiver.Protocol != receiverProtocolSMTP && receiver.Protocol != receiverProtocolLMTP {
+		return receiver, fmt.Errorf("unknown receiver protocol '%s'", receiver.Protocol)
+	}
+	if receiver.Name == "" {
+		receiver.Name = defaultReceiverName
+	}
+	if receiver.MaxMessageBytes <= 0 {
+		receiver.MaxMessageBytes = defaultReceiverMaxMessageBytes
+	}
+	if receiver.MaxRecipients <= 0 {
+		receiver.MaxRecipients = defaultReceiverMaxRecipients
+	}
+	if receiver.TLS.Require && receiver.TLS.Cert == "" {
+		return receiver, fmt.Errorf("receiver requires TLS but has no certificate")
+	}
+	// Without an allow-list the receiver would be an open sink for anyone who can reach it
+	if len(receiver.Recipients) == 0 {
+		return receiver, fmt.Errorf("receiver has no recipients to accept, set receiver.recipients")
+	}
+	return receiver, nil
+}
+
+// dkim returns the DKIM settings with defaults filled in
+func (c *ConfigDatabase) dkim() (ConfigDKIM, error) {
+	dkim := c.DKIM
+	if dkim.Policy == "" {
+		dkim.Policy = dkimPolicyFlag
+	}
+	if dkim.Policy != dkimPolicyFlag && dkim.Policy != dkimPolicyDrop {
+		return dkim, fmt.Errorf("unknown dkim policy '%s'", dkim.Policy)
+	}
+	if dkim.Timeout <= 0 {
+		dkim.Timeout = defaultDKIMTimeout
+	}
+	return dkim, nil
+}
+
+// autoMigrate returns true if the database schema is to be migrated at startup
+func (c *ConfigDatabase) autoMigrate() (bool, error) {
+	switch c.Database.Migrate {
+	case migrateAuto, "":
+		return true, nil
+	case migrateManual:
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown database migrate setting '%s'", c.Database.Migrate)
+}
+
+// databasePool returns the database pool settings with defaults filled in
+// SQLite allows one writer at a time, so its pool has a single connection unless configured otherwise.
+func (c *ConfigDatabase) databasePool() databasePoolSettings {
+	pool := databasePoolSettings{
+		MaxOpenConns:    c.Database.MaxOpenConns,
+		MaxIdleConns:    c.Database.MaxIdleConns,
+		ConnMaxLifetime: time.Duration(c.Database.ConnMaxLifetime) * time.Second,
+		ConnectAttempts: c.Database.ConnectAttempts,
+	}
+	if pool.MaxOpenConns <= 0 {
+		pool.MaxOpenConns = defaultMaxOpenConns
+		if c.Database.Driver == "sqlite" {
+			pool.MaxOpenConns = 1
+		}
+	}
+	if pool.MaxIdleConns <= 0 {
+		pool.MaxIdleConns = min(defaultMaxIdleConns, pool.MaxOpenConns)
+	}
+	if pool.ConnMaxLifetime <= 0 {
+		pool.ConnMaxLifetime = defaultConnMaxLifetime
+	}
+	if pool.ConnectAttempts <= 0 {
+		pool.ConnectAttempts = defaultConnectAttempts
+	}
+	return pool
+}
+
+// limits returns the attachment limits with defaults filled in
+func (c *ConfigDatabase) limits() ConfigLimits {
+	limits := c.Limits
+	if limits.MaxCompressedBytes <= 0 {
+		limits.MaxCompressedBytes = defaultMaxCompressedBytes
+	}
+	if limits.MaxDecompressedBytes <= 0 {
+		limits.MaxDecompressedBytes = defaultMaxDecompressedBytes
+	}
+	if limits.MaxRatio <= 0 {
+		limits.MaxRatio = defaultMaxRatio
+	}
+	if limits.MaxZipEntries <= 0 {
+		limits.MaxZipEntries = defaultMaxZipEntries
+	}
+	if limits.MaxXMLDepth <= 0 {
+		limits.MaxXMLDepth = defaultMaxXMLDepth
+	}
+	return limits
+}
+
+// maxMessageBytes returns the size of the largest message that is read
+// It leaves room for an attachment of MaxCompressedBytes in base64, which adds a third, and for
+// the headers and other parts of the message.
+func (l ConfigLimits) maxMessageBytes() int64 {
+	return l.MaxCompressedBytes * 3 / 2
+}
+
+// maxFileBytes returns the size of the largest local file that is read
+// A report file is an attachment by itself, any other file is a message.
+func (l ConfigLimits) maxFileBytes(name string) int64 {
+	if _, ok := reportFileType(name); ok {
+		return l.MaxCompressedBytes
+	}
+	return l.maxMessageBytes()
+}
+
 type OffHandler struct {
 	level   slog.Leveler
 	handler slog.Handler
@@ -2,51 +2,243 @@ package main
 
 import (
 	"database/sql"
-	"fmt"
-	"log"
+	"errors"
 	"log/slog"
 	"strings"
+	"sync"
 	"time"
-
-	// Database drivers
-	_ "github.com/go-sql-driver/mysql" // mysql
-	_ "github.com/jackc/pgx/v5"        // postgres
-	report "github.com/oliverpool/go-dmarc-report"
-	_ "modernc.org/sqlite" // sqlite3
 )
 
 type database struct {
 	backendDB *sql.DB
-	driver    string
+	dialect   *dialect
 
 	preparedStatements map[string]*sql.Stmt
 }
 
 var (
 	preparedStatements = map[string]string{
-		// CREATE TABLE system
-		"create table system": `
-		CREATE TABLE IF NOT EXISTS system (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		last_run INTEGER(8)
+		// SELECT FROM mailbox_state
+		"select mailbox_state": `
+		SELECT account, folder, uid_validity, last_uid, highest_modseq FROM mailbox_state;
+		`,
+		// SELECT FROM imported_files
+		"select imported_files": `
+		SELECT path, size, modified FROM imported_files WHERE source = $1;
+		`,
+		// SELECT FROM pop3_uidl
+		"select pop3_uidl": `
+		SELECT uidl, COALESCE(failed, 0) FROM pop3_uidl WHERE account = $1;
+		`,
+		// SELECT FROM imap_stored
+		"select imap_stored": `
+		SELECT uid FROM imap_stored WHERE account = $1 AND folder = $2 AND uid_validity = $3;
+		`,
+		// DELETE FROM imap_stored
+		"delete from imap_stored": `
+		DELETE FROM imap_stored WHERE account = $1 AND folder = $2 AND uid_validity = $3 AND uid = $4;
+		`,
+		// DELETE FROM imap_stored the messages of an earlier UIDVALIDITY, their UIDs mean nothing anymore
+		"delete from imap_stored uid_validity": `
+		DELETE FROM imap_stored WHERE account = $1 AND folder = $2 AND uid_validity <> $3;
+		`,
+		// INSERT INTO forensic_report
+		"insert into forensic_report": `
+		INSERT INTO forensic_report (
+			report_hash,
+			reporter,
+			feedback_type,
+			user_agent,
+			version,
+			arrival_date,
+			reporting_mta,
+			source_ip,
+			incidents,
+			reported_domain,
+			reported_uri,
+			auth_failure,
+			delivery_result,
+			authentication_results,
+			original_envelope_id,
+			original_mail_from,
+			original_rcpt_to,
+			dkim_domain,
+			dkim_identity,
+			dkim_selector,
+			spf_dns,
+			identity_alignment,
+			account,
+			folder
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8,
+			$9,
+			$10,
+			$11,
+			$12,
+			$13,
+			$14,
+			$15,
+			$16,
+			$17,
+			$18,
+			$19,
+			$20,
+			$21,
+			$22,
+			$23,
+			$24
 		);
 		`,
-		// CREATE TABLE metadata
-		"create table metadata": `
-		CREATE TABLE IF NOT EXISTS metadata (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		organization TEXT,
-		email TEXT,
-		extra_contact_info TEXT,
-		report_id TEXT UNIQUE NOT NULL,
-		begin_date INTEGER(8),
-		end_date INTEGER(8)
+		// DELETE FROM forensic_report
+		"delete from forensic_report": `
+		DELETE FROM forensic_report WHERE report_hash = $1;
+		`,
+		// INSERT INTO forensic_header
+		"insert into forensic_header": `
+		INSERT INTO forensic_header (
+			report_hash,
+			position,
+			name,
+			value
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4
+		);
+		`,
+		// DELETE FROM forensic_header
+		"delete from forensic_header": `
+		DELETE FROM forensic_header WHERE report_hash = $1;
+		`,
+		// INSERT INTO tlsrpt_report
+		"insert into tlsrpt_report": `
+		INSERT INTO tlsrpt_report (
+			organization,
+			contact_info,
+			report_id,
+			begin_date,
+			end_date,
+			account,
+			folder,
+			raw_sha256
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8
+		);
+		`,
+		// DELETE FROM tlsrpt_report
+		"delete from tlsrpt_report": `
+		DELETE FROM tlsrpt_report WHERE id = $1;
+		`,
+		// SELECT id FROM tlsrpt_report
+		"select tlsrpt_report id": `
+		SELECT id FROM tlsrpt_report WHERE organization = $1 AND report_id = $2 AND begin_date = $3;
+		`,
+		// INSERT INTO tlsrpt_policy
+		"insert into tlsrpt_policy": `
+		INSERT INTO tlsrpt_policy (
+			tlsrpt_report_id,
+			position,
+			policy_type,
+			policy_domain,
+			policy_string,
+			mx_host,
+			successful_session_count,
+			failure_session_count
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8
+		);
+		`,
+		// DELETE FROM tlsrpt_policy
+		"delete from tlsrpt_policy": `
+		DELETE FROM tlsrpt_policy WHERE tlsrpt_report_id = $1;
+		`,
+		// INSERT INTO tlsrpt_failure
+		"insert into tlsrpt_failure": `
+		INSERT INTO tlsrpt_failure (
+			tlsrpt_report_id,
+			policy_position,
+			result_type,
+			sending_mta_ip,
+			receiving_mx_hostname,
+			receiving_mx_helo,
+			receiving_ip,
+			failed_session_count,
+			additional_information,
+			failure_reason_code
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8,
+			$9,
+			$10
+		);
+		`,
+		// DELETE FROM tlsrpt_failure
+		"delete from tlsrpt_failure": `
+		DELETE FROM tlsrpt_failure WHERE tlsrpt_report_id = $1;
+		`,
+		// SELECT sha256 FROM report_archive
+		"select report_archive hashes": `
+		SELECT sha256 FROM report_archive ORDER BY id;
+		`,
+		// SELECT FROM report_archive
+		"select report_archive": `
+		SELECT kind, content, headers, account, folder, COALESCE(dkim_result, ''), COALESCE(dkim_domain, '') FROM report_archive WHERE sha256 = $1;
+		`,
+		// INSERT INTO ingest_errors
+		"insert into ingest_errors": `
+		INSERT INTO ingest_errors (
+			account,
+			folder,
+			uid,
+			message_id,
+			subject,
+			reporter,
+			error,
+			raw_ref,
+			raw_sha256,
+			raw_size,
+			created
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8,
+			$9,
+			$10,
+			$11
 		);
-		CREATE UNIQUE INDEX IF NOT EXISTS metadata_report_id ON metadata (report_id);
-		CREATE INDEX IF NOT EXISTS metadata_organization ON metadata (organization);
-		CREATE INDEX IF NOT EXISTS metadata_email ON metadata (email);
-		CREATE INDEX IF NOT EXISTS metadata_begin_date ON metadata (begin_date);
-		CREATE INDEX IF NOT EXISTS metadata_end_date ON metadata (end_date);
 		`,
 		// INSERT INTO metadata
 		"insert into metadata": `
@@ -56,38 +248,37 @@ var (
 			extra_contact_info,
 			report_id,
 			begin_date,
-			end_date
+			end_date,
+			account,
+			folder,
+			raw_sha256,
+			version,
+			errors,
+			dkim_result,
+			dkim_domain
 		) VALUES (
 			$1,
 			$2,
 			$3,
 			$4,
 			$5,
-			$6
+			$6,
+			$7,
+			$8,
+			$9,
+			$10,
+			$11,
+			$12,
+			$13
 		);
 		`,
-		// CREATE TABLE policy_published
-		"create table policy_published": `
-		CREATE TABLE IF NOT EXISTS policy_published (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		domain TEXT,
-		adkim TEXT,
-		aspf TEXT,
-		policy TEXT,
-		spolicy TEXT,
-		percentage INTEGER(1),
-		report_id TEXT,
-		FOREIGN KEY (report_id)	REFERENCES metadata (report_id) 
-		   ON UPDATE CASCADE
-		   ON DELETE CASCADE
-		);
-		CREATE INDEX IF NOT EXISTS policy_published_domain ON policy_published (domain);
-		CREATE INDEX IF NOT EXISTS policy_published_adkim ON policy_published (adkim);
-		CREATE INDEX IF NOT EXISTS policy_published_aspf ON policy_published (aspf);
-		CREATE INDEX IF NOT EXISTS policy_published_policy ON policy_published (policy);
-		CREATE INDEX IF NOT EXISTS policy_published_spolicy ON policy_published (spolicy);
-		CREATE INDEX IF NOT EXISTS policy_published_percentage ON policy_published (percentage);
-		CREATE INDEX IF NOT EXISTS policy_published_report_id ON policy_published (report_id);
+		// SELECT id FROM metadata, a report is identified by its reporter, report ID and begin date
+		"select metadata id": `
+		SELECT id FROM metadata WHERE organization = $1 AND email = $2 AND report_id = $3 AND begin_date = $4;
+		`,
+		// DELETE FROM metadata
+		"delete from metadata": `
+		DELETE FROM metadata WHERE id = $1;
 		`,
 		// INSERT INTO policy_published
 		"insert into policy_published": `
@@ -98,7 +289,11 @@ var (
 			policy,
 			spolicy,
 			percentage,
-			report_id
+			metadata_id,
+			fo,
+			np,
+			psd,
+			testing
 		) VALUES (
 			$1,
 			$2,
@@ -106,43 +301,16 @@ var (
 			$4,
 			$5,
 			$6,
-			$7
+			$7,
+			$8,
+			$9,
+			$10,
+			$11
 		);
 		`,
-		// CREATE TABLE record
-		"create table record": `
-		CREATE TABLE IF NOT EXISTS record (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		source_ip TEXT,
-		count int(8),
-		disposition TEXT,
-		dkim TEXT,
-		spf TEXT,
-		header_from TEXT,
-		dkim_auth_result_domain TEXT,
-		dkim_auth_result_result TEXT,
-		dkim_auth_result_selector TEXT,	
-		spf_auth_result_domain TEXT,
-		spf_auth_result_result TEXT,
-		spf_auth_result_scope TEXT,
-		report_id TEXT,
-		FOREIGN KEY (report_id)	REFERENCES metadata (report_id) 
-	   		ON UPDATE CASCADE
-	   		ON DELETE CASCADE
-		);
-		CREATE INDEX IF NOT EXISTS record_source_ip ON record (source_ip);
-		CREATE INDEX IF NOT EXISTS record_count ON record (count);
-		CREATE INDEX IF NOT EXISTS record_disposition ON record (disposition);
-		CREATE INDEX IF NOT EXISTS record_dkim ON record (dkim);
-		CREATE INDEX IF NOT EXISTS record_spf ON record (spf);
-		CREATE INDEX IF NOT EXISTS record_header_from ON record (header_from);
-		CREATE INDEX IF NOT EXISTS record_dkim_auth_result_domain ON record (dkim_auth_result_domain);
-		CREATE INDEX IF NOT EXISTS record_dkim_auth_result_result ON record (dkim_auth_result_result);
-		CREATE INDEX IF NOT EXISTS record_dkim_auth_result_selector ON record (dkim_auth_result_selector);
-		CREATE INDEX IF NOT EXISTS record_spf_auth_result_domain ON record (spf_auth_result_domain);
-		CREATE INDEX IF NOT EXISTS record_spf_auth_result_result ON record (spf_auth_result_result);
-		CREATE INDEX IF NOT EXISTS record_spf_auth_result_scope ON record (spf_auth_result_scope);
-		CREATE INDEX IF NOT EXISTS record_report_id ON record (report_id);
+		// DELETE FROM policy_published
+		"delete from policy_published": `
+		DELETE FROM policy_published WHERE metadata_id = $1;
 		`,
 		// INSERT INTO record
 		"insert into record": `
@@ -159,7 +327,10 @@ var (
 			spf_auth_result_domain,
 			spf_auth_result_result,
 			spf_auth_result_scope,
-			report_id
+			metadata_id,
+			position,
+			envelope_to,
+			envelope_from
 		) VALUES (
 			$1,
 			$2,
@@ -173,32 +344,129 @@ var (
 			$10,
 			$11,
 			$12,
-			$13
+			$13,
+			$14,
+			$15,
+			$16
 		);
 		`,
+		// DELETE FROM record
+		"delete from record": `
+		DELETE FROM record WHERE metadata_id = $1;
+		`,
+		// INSERT INTO policy_override_reason
+		"insert into policy_override_reason": `
+		INSERT INTO policy_override_reason (
+			metadata_id,
+			record_position,
+			position,
+			type,
+			comment
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5
+		);
+		`,
+		// DELETE FROM policy_override_reason
+		"delete from policy_override_reason": `
+		DELETE FROM policy_override_reason WHERE metadata_id = $1;
+		`,
+		// INSERT INTO dkim_auth_result
+		"insert into dkim_auth_result": `
+		INSERT INTO dkim_auth_result (
+			metadata_id,
+			record_position,
+			position,
+			domain,
+			selector,
+			result,
+			human_result
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7
+		);
+		`,
+		// DELETE FROM dkim_auth_result
+		"delete from dkim_auth_result": `
+		DELETE FROM dkim_auth_result WHERE metadata_id = $1;
+		`,
+		// INSERT INTO spf_auth_result
+		"insert into spf_auth_result": `
+		INSERT INTO spf_auth_result (
+			metadata_id,
+			record_position,
+			position,
+			domain,
+			scope,
+			result
+		) VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6
+		);
+		`,
+		// DELETE FROM spf_auth_result
+		"delete from spf_auth_result": `
+		DELETE FROM spf_auth_result WHERE metadata_id = $1;
+		`,
 	}
-)
 
-const (
-	maxParams = 14 // Maximum number of parameters in a prepared statement, used to replace $1, $2, etc. with ? (for sqlite and mysql)
+	// upsertStatements are prepared next to preparedStatements, their SQL depends on the dialect
+	upsertStatements = map[string]upsertStatement{
+		// INSERT INTO mailbox_state or UPDATE
+		"upsert mailbox_state": {
+			Table:   "mailbox_state",
+			Columns: []string{"uid_validity", "last_uid", "highest_modseq", "account", "folder"},
+			Keys:    []string{"account", "folder"},
+		},
+		// INSERT INTO imported_files or UPDATE
+		"upsert imported_files": {
+			Table:   "imported_files",
+			Columns: []string{"size", "modified", "imported", "source", "path"},
+			Keys:    []string{"source", "path"},
+		},
+		// INSERT INTO pop3_uidl or UPDATE
+		"upsert pop3_uidl": {
+			Table:   "pop3_uidl",
+			Columns: []string{"failed", "created", "account", "uidl"},
+			Keys:    []string{"account", "uidl"},
+		},
+		// INSERT INTO imap_stored unless already there
+		"upsert imap_stored": {
+			Table:   "imap_stored",
+			Columns: []string{"account", "folder", "uid_validity", "uid", "created"},
+			Keys:    []string{"account", "folder", "uid_validity", "uid"},
+			Ignore:  true,
+		},
+		// INSERT INTO report_archive unless already archived, identical reports are archived once
+		"upsert report_archive": {
+			Table:   "report_archive",
+			Columns: []string{"sha256", "kind", "content", "headers", "account", "folder", "created", "dkim_result", "dkim_domain"},
+			Keys:    []string{"sha256"},
+			Ignore:  true,
+		},
+	}
 )
 
 /*
 insert full record variables ) as transaction
 */
 func (db *database) Open(driver, connectionstring string) error {
-	var err error
-	db.backendDB, err = sql.Open(driver, connectionstring)
+	err := db.connect(driver, connectionstring)
 	if err != nil {
-		slog.Error("error opening database", "error", err)
 		return err
 	}
-	err = db.backendDB.Ping()
-	if err != nil {
-		slog.Error("error connecting to database", "error", err)
-		return err
-	}
-	db.driver = driver
 
 	db.preparedStatements = make(map[string]*sql.Stmt)
 	err = db.initStatements()
@@ -206,32 +474,47 @@ func (db *database) Open(driver, connectionstring string) error {
 		slog.Error("error initializing statements", "error", err)
 		return err
 	}
+	return nil
+}
 
-	err = db.initTables()
+// connect opens the database without preparing the statements, the schema may not be there yet
+func (db *database) connect(driver, connectionstring string) error {
+	var err error
+	db.dialect, err = dialectFor(driver)
 	if err != nil {
-		slog.Error("error initializing tables", "error", err)
+		slog.Error("error opening database", "error", err)
+		return err
+	}
+	db.backendDB, err = sql.Open(db.dialect.Driver, connectionstring)
+	if err != nil {
+		slog.Error("error opening database", "error", err)
+		return err
+	}
+	err = db.backendDB.Ping()
+	if err != nil {
+		slog.Error("error connecting to database", "error", err)
 		return err
 	}
 	return nil
 }
 
 func (db *database) initStatements() error {
+	queries := make(map[string]string)
 	for name, query := range preparedStatements {
-		// Need to modify query placeholders
-		switch db.driver {
-		case "sqlite", "mysql":
-			for cnt := 0; cnt <= maxParams; cnt++ {
-				query = strings.ReplaceAll(query, fmt.Sprintf("$%dd", cnt), "?")
-			}
-		case "postgres": //do nothing
-		default:
-			slog.Error("prepared statements not implemented for driver", "driver", db.driver)
-			return fmt.Errorf("prepared statements not implemented for driver %s", db.driver)
+		queries[name] = query
+	}
+	for name, upsert := range upsertStatements {
+		queries[name] = db.dialect.upsert(upsert)
+	}
+	for name, query := range queries {
+		query, err := db.dialect.rebind(query)
+		if err != nil {
+			slog.Error("error preparing statement", "statement", name, "error", err)
+			return err
 		}
-
 		stmt, err := db.backendDB.Prepare(query)
 		if err != nil {
-			slog.Error("error preparing statement", "error", err)
+			slog.Error("error preparing statement", "statement", name, "error", err)
 			return err
 		}
 		db.preparedStatements[name] = stmt
@@ -243,12 +526,284 @@ func (db *database) Close() error {
 	return db.backendDB.Close()
 }
 
-func (db *database) initTables() error {
-	for pstmt, stmt := range db.preparedStatements {
-		if strings.HasPrefix(pstmt, "create table") {
-			_, err := stmt.Exec()
+// Default database pool settings, see databasePool
+const (
+	defaultMaxOpenConns    = 10
+	defaultMaxIdleConns    = 2
+	defaultConnMaxLifetime = 5 * time.Minute
+	defaultConnectAttempts = 5
+	maxConnectDelay        = 30 * time.Second
+)
+
+// databasePoolSettings are the limits of the database pool
+type databasePoolSettings struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnectAttempts int // How often opening the database is tried before giving up
+}
+
+// The database pool shared by everything in the process, see openDatabase
+var (
+	sharedDB     *database
+	sharedDBLock sync.Mutex
+)
+
+// openDatabase returns the database pool of the process, which is opened on first use
+// Once open, the pool replaces broken connections by itself and re-prepares the statements on them.
+func openDatabase() (*database, error) {
+	sharedDBLock.Lock()
+	defer sharedDBLock.Unlock()
+	if sharedDB != nil {
+		return sharedDB, nil
+	}
+	pool := Configuration.databasePool()
+	var db *database
+	err := retryConnect(func() error {
+		db = &database{}
+		err := db.Open(Configuration.Database.Driver, Configuration.Database.ConnectionString)
+		if err != nil && db.backendDB != nil {
+			db.backendDB.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.backendDB.SetMaxOpenConns(pool.MaxOpenConns)
+	db.backendDB.SetMaxIdleConns(pool.MaxIdleConns)
+	db.backendDB.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	sharedDB = db
+	return db, nil
+}
+
+// retryConnect calls connect until it succeeds, with a doubling delay while the database cannot be reached
+// The error of the last attempt is returned when the configured number of attempts is used up.
+func retryConnect(connect func() error) error {
+	attempts := Configuration.databasePool().ConnectAttempts
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil || attempt >= attempts {
+			return err
+		}
+		slog.Warn("database not available, retrying", "attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay = min(delay*2, maxConnectDelay)
+	}
+}
+
+// closeDatabase closes the database pool of the process at shutdown
+// Statements that are running are waited for, a transaction that is still open is rolled back.
+func closeDatabase() {
+	sharedDBLock.Lock()
+	defer sharedDBLock.Unlock()
+	if sharedDB == nil {
+		return
+	}
+	if err := sharedDB.Close(); err != nil {
+		slog.Error("error closing database", "error", err)
+	}
+	sharedDB = nil
+}
+
+// errReportExists is returned when a report is already stored and is not replaced
+var errReportExists = errors.New("report already exists")
+
+// inTransaction runs store in a transaction, which is committed if store succeeds
+// Nothing of a report is left behind when storing it fails halfway.
+func (db *database) inTransaction(store func(tx *sql.Tx) error) error {
+	tx, err := db.backendDB.Begin()
+	if err != nil {
+		slog.Error("error starting transaction", "error", err)
+		return err
+	}
+	if err := store(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			slog.Error("error rolling back transaction", "error", rollbackErr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("error committing transaction", "error", err)
+		return err
+	}
+	return nil
+}
+
+// exec runs a prepared statement within a transaction
+func (db *database) exec(tx *sql.Tx, name string, args ...any) (sql.Result, error) {
+	return tx.Stmt(db.preparedStatements[name]).Exec(args...)
+}
+
+// replaceReport returns true if a stored report with the same id is to be replaced rather than kept
+func (r *fetchedReport) replaceReport() bool {
+	return r.Replace || Configuration.Database.Upsert
+}
+
+// storeReports stores aggregate reports, each in a transaction of its own
+// Reports that are already stored are skipped, or replaced when upserting. See storeEach for what is returned.
+func storeReports(reps []*fetchedReport) ([]*fetchedReport, []*ingestError, error) {
+	db, err := openDatabase()
+	if err != nil {
+		slog.Error("error opening database", "error", err)
+		return nil, nil, err
+	}
+	return db.storeEach(reps, db.storeReport)
+}
+
+// storeEach stores every report in a transaction of its own with store
+// A report the database refuses is rolled back and returned as an ingest error, so it does not hold up
+// the other reports. The reports that are stored (or were already there) are returned as well. Only
+// when the database itself cannot be reached is an error returned, then nothing can be stored.
+func (db *database) storeEach(reps []*fetchedReport, store func(tx *sql.Tx, rep *fetchedReport) error) ([]*fetchedReport, []*ingestError, error) {
+	stored := make([]*fetchedReport, 0, len(reps))
+	failed := make([]*ingestError, 0)
+	for _, rep := range reps {
+		slog.Debug("storing report", "report", rep.id())
+		err := db.inTransaction(func(tx *sql.Tx) error {
+			return store(tx, rep)
+		})
+		switch {
+		case err == nil:
+			stored = append(stored, rep)
+		case errors.Is(err, errReportExists):
+			slog.Debug("report already exists", "report", rep.id())
+			stored = append(stored, rep)
+		default:
+			if pingErr := db.backendDB.Ping(); pingErr != nil {
+				return nil, nil, err
+			}
+			slog.Warn("report could not be stored", "report", rep.id(), "account", rep.Account, "folder", rep.Folder, "error", err)
+			failed = append(failed, newStoreError(rep, err))
+		}
+	}
+	return stored, failed, nil
+}
+
+// storeReport stores an aggregate report with its policy, records and their details
+func (db *database) storeReport(tx *sql.Tx, rep *fetchedReport) error {
+	report := rep.Aggregate
+	if rep.replaceReport() {
+		if err := db.deleteReport(tx, rep); err != nil {
+			return err
+		}
+	}
+	dkimResult, dkimDomain := rep.dkimColumns()
+	// Add metadata
+	_, err := db.exec(tx, "insert into metadata",
+		report.Metadata.OrgName,
+		report.Metadata.Email,
+		report.Metadata.ExtraContactInfo,
+		report.Metadata.ReportID,
+		report.Metadata.DateRange.Begin.Unix(),
+		report.Metadata.DateRange.End.Unix(),
+		rep.Account,
+		rep.Folder,
+		rep.rawSHA256(),
+		report.Version,
+		strings.Join(report.Metadata.Errors, "\n"),
+		dkimResult,
+		dkimDomain,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return errReportExists
+		}
+		slog.Error("error inserting metadata", "error", err)
+		return err
+	}
+	// The other tables refer to the id of the metadata
+	metadataID, err := db.metadataID(tx, report)
+	if err != nil {
+		return err
+	}
+	if err := db.archiveReport(tx, rep, archiveKindAggregate); err != nil {
+		return err
+	}
+	// Add policy_published
+	_, err = db.exec(tx, "insert into policy_published",
+		report.PolicyPublished.Domain,
+		report.PolicyPublished.ADKIM,
+		report.PolicyPublished.ASPF,
+		report.PolicyPublished.Policy,
+		report.PolicyPublished.SPolicy,
+		report.PolicyPublished.Percentage,
+		metadataID,
+		report.PolicyPublished.FO,
+		report.PolicyPublished.NP,
+		report.PolicyPublished.PSD,
+		report.PolicyPublished.Testing,
+	)
+	if err != nil {
+		slog.Error("error inserting policy_published", "error", err)
+		return err
+	}
+	// Add records, the first DKIM and SPF result go in the record itself and all of them in the auth result tables
+	for recordPosition, record := range report.Records {
+		dkim := record.AuthResults.firstDKIM()
+		spf := record.AuthResults.firstSPF()
+		_, err = db.exec(tx, "insert into record",
+			record.Row.SourceIP,
+			record.Row.Count,
+			record.Row.PolicyEvaluated.Disposition,
+			record.Row.PolicyEvaluated.DKIM,
+			record.Row.PolicyEvaluated.SPF,
+			record.Identifiers.HeaderFrom,
+			dkim.Domain,
+			dkim.Result,
+			dkim.Selector,
+			spf.Domain,
+			spf.Result,
+			spf.Scope,
+			metadataID,
+			recordPosition,
+			record.Identifiers.EnvelopeTo,
+			record.Identifiers.EnvelopeFrom,
+		)
+		if err != nil {
+			slog.Error("error inserting record", "error", err)
+			return err
+		}
+		for position, reason := range record.Row.PolicyEvaluated.Reasons {
+			_, err = db.exec(tx, "insert into policy_override_reason",
+				metadataID,
+				recordPosition,
+				position,
+				reason.Type,
+				reason.Comment,
+			)
 			if err != nil {
-				slog.Error("error creating table", "statement", pstmt, "error", err)
+				slog.Error("error inserting policy_override_reason", "error", err)
+				return err
+			}
+		}
+		for position, dkim := range record.AuthResults.DKIM {
+			_, err = db.exec(tx, "insert into dkim_auth_result",
+				metadataID,
+				recordPosition,
+				position,
+				dkim.Domain,
+				dkim.Selector,
+				dkim.Result,
+				dkim.HumanResult,
+			)
+			if err != nil {
+				slog.Error("error inserting dkim_auth_result", "error", err)
+				return err
+			}
+		}
+		for position, spf := range record.AuthResults.SPF {
+			_, err = db.exec(tx, "insert into spf_auth_result",
+				metadataID,
+				recordPosition,
+				position,
+				spf.Domain,
+				spf.Scope,
+				spf.Result,
+			)
+			if err != nil {
+				slog.Error("error inserting spf_auth_result", "error", err)
 				return err
 			}
 		}
@@ -256,120 +811,545 @@ func (db *database) initTables() error {
 	return nil
 }
 
-func storeReports(reps []*report.Aggregate) error {
-	db := database{}
-	err := db.Open(Configuration.Database.Driver, Configuration.Database.ConnectionString)
+// metadataID returns the id of the metadata of a stored aggregate report
+func (db *database) metadataID(tx *sql.Tx, report *aggregateReport) (int64, error) {
+	var id int64
+	err := tx.Stmt(db.preparedStatements["select metadata id"]).QueryRow(
+		report.Metadata.OrgName,
+		report.Metadata.Email,
+		report.Metadata.ReportID,
+		report.Metadata.DateRange.Begin.Unix(),
+	).Scan(&id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Error("error querying metadata", "error", err)
+	}
+	return id, err
+}
+
+// storeForensicReports stores failure reports and the headers of the messages they are about
+// Reports that are already stored are skipped, or replaced when upserting. See storeEach for what is returned.
+func storeForensicReports(reps []*fetchedReport) ([]*fetchedReport, []*ingestError, error) {
+	db, err := openDatabase()
 	if err != nil {
 		slog.Error("error opening database", "error", err)
+		return nil, nil, err
+	}
+	return db.storeEach(reps, db.storeForensicReport)
+}
+
+// storeForensicReport stores a failure report and the headers of the message it is about
+func (db *database) storeForensicReport(tx *sql.Tx, rep *fetchedReport) error {
+	forensic := rep.Forensic
+	if rep.replaceReport() {
+		if err := db.deleteReport(tx, rep); err != nil {
+			return err
+		}
+	}
+	_, err := db.exec(tx, "insert into forensic_report",
+		forensic.Hash,
+		forensic.Reporter,
+		forensic.FeedbackType,
+		forensic.UserAgent,
+		forensic.Version,
+		forensic.ArrivalDate.Unix(),
+		forensic.ReportingMTA,
+		forensic.SourceIP,
+		forensic.Incidents,
+		forensic.ReportedDomain,
+		forensic.ReportedURI,
+		forensic.AuthFailure,
+		forensic.DeliveryResult,
+		forensic.AuthenticationResults,
+		forensic.OriginalEnvelopeID,
+		forensic.OriginalMailFrom,
+		forensic.OriginalRcptTo,
+		forensic.DKIMDomain,
+		forensic.DKIMIdentity,
+		forensic.DKIMSelector,
+		forensic.SPFDNS,
+		forensic.IdentityAlignment,
+		rep.Account,
+		rep.Folder,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return errReportExists
+		}
+		slog.Error("error inserting forensic_report", "error", err)
 		return err
 	}
-	defer db.Close()
-	total := len(reps)
-reportLoop:
-	for id, report := range reps {
-		if Configuration.LogProgress > 0 && (id+1)%Configuration.LogProgress == 0 {
-			slog.Info("Storing reports:", "current", id+1, "total", total) //id+1 because id starts at 0
-		}
-		slog.Debug("storing report", "report", report.Metadata.ReportID)
-		// Add metadata
-		_, err := db.preparedStatements["insert into metadata"].Exec(
-			report.Metadata.OrgName,
-			report.Metadata.Email,
-			report.Metadata.ExtraContactInfo,
-			report.Metadata.ReportID,
-			report.Metadata.DateRange.Begin.Unix(),
-			report.Metadata.DateRange.End.Unix(),
+	for position, header := range forensic.OriginalHeaders {
+		_, err = db.exec(tx, "insert into forensic_header",
+			forensic.Hash,
+			position,
+			header.Name,
+			header.Value,
 		)
 		if err != nil {
-			switch {
-			// NB: need to update for other database drivers
-			case strings.Contains(err.Error(), "UNIQUE constraint failed: metadata.report_id"):
-				slog.Debug("report already exists", "report", report.Metadata.ReportID)
-				continue reportLoop
-			default:
-				slog.Error("error inserting metadata", "error", err)
-				return err
-			}
+			slog.Error("error inserting forensic_header", "error", err)
+			return err
 		}
-		// Add policy_published
-		_, err = db.preparedStatements["insert into policy_published"].Exec(
-			report.PolicyPublished.Domain,
-			report.PolicyPublished.ADKIM,
-			report.PolicyPublished.ASPF,
-			report.PolicyPublished.Policy,
-			report.PolicyPublished.SPolicy,
-			report.PolicyPublished.Percentage,
-			report.Metadata.ReportID,
+	}
+	return nil
+}
+
+// storeTLSReports stores TLS reports with their policies and failure details
+// Reports that are already stored are skipped, or replaced when upserting. See storeEach for what is returned.
+func storeTLSReports(reps []*fetchedReport) ([]*fetchedReport, []*ingestError, error) {
+	db, err := openDatabase()
+	if err != nil {
+		slog.Error("error opening database", "error", err)
+		return nil, nil, err
+	}
+	return db.storeEach(reps, db.storeTLSReport)
+}
+
+// storeTLSReport stores a TLS report with its policies and failure details
+func (db *database) storeTLSReport(tx *sql.Tx, rep *fetchedReport) error {
+	tls := rep.TLS
+	if rep.replaceReport() {
+		if err := db.deleteReport(tx, rep); err != nil {
+			return err
+		}
+	}
+	_, err := db.exec(tx, "insert into tlsrpt_report",
+		tls.OrganizationName,
+		tls.ContactInfo,
+		tls.ReportID,
+		tls.DateRange.Start.Unix(),
+		tls.DateRange.End.Unix(),
+		rep.Account,
+		rep.Folder,
+		rep.rawSHA256(),
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return errReportExists
+		}
+		slog.Error("error inserting tlsrpt_report", "error", err)
+		return err
+	}
+	if err := db.archiveReport(tx, rep, archiveKindTLS); err != nil {
+		return err
+	}
+	// The other tables refer to the id of the report
+	reportID, err := db.tlsReportID(tx, tls)
+	if err != nil {
+		return err
+	}
+	for position, policy := range tls.Policies {
+		_, err = db.exec(tx, "insert into tlsrpt_policy",
+			reportID,
+			position,
+			policy.Policy.Type,
+			policy.Policy.Domain,
+			strings.Join(policy.Policy.String, "\n"),
+			strings.Join(policy.Policy.MXHost, ", "),
+			policy.Summary.Successful,
+			policy.Summary.Failed,
 		)
 		if err != nil {
-			slog.Error("error inserting policy_published", "error", err)
+			slog.Error("error inserting tlsrpt_policy", "error", err)
 			return err
 		}
-		// Add records
-		for _, record := range report.Records {
-			_, err = db.preparedStatements["insert into record"].Exec(
-				record.Row.SourceIP,
-				record.Row.Count,
-				record.Row.PolicyEvaluated.Disposition,
-				record.Row.PolicyEvaluated.DKIM,
-				record.Row.PolicyEvaluated.SPF,
-				record.Identifiers.HeaderFrom,
-				record.AuthResults.DKIM.Domain,
-				record.AuthResults.DKIM.Result,
-				record.AuthResults.DKIM.Selector,
-				record.AuthResults.SPF.Domain,
-				record.AuthResults.SPF.Result,
-				record.AuthResults.SPF.Scope,
-				report.Metadata.ReportID,
+		for _, failure := range policy.FailureDetails {
+			_, err = db.exec(tx, "insert into tlsrpt_failure",
+				reportID,
+				position,
+				failure.ResultType,
+				failure.SendingMTAIP,
+				failure.ReceivingMXHostname,
+				failure.ReceivingMXHelo,
+				failure.ReceivingIP,
+				failure.FailedSessionCount,
+				failure.AdditionalInformation,
+				failure.FailureReasonCode,
 			)
 			if err != nil {
-				slog.Error("error inserting record", "error", err)
+				slog.Error("error inserting tlsrpt_failure", "error", err)
 				return err
 			}
 		}
 	}
+	return nil
+}
+
+// tlsReportID returns the id of a stored TLS report, found by its organization, report ID and begin date
+func (db *database) tlsReportID(tx *sql.Tx, report *tlsReport) (int64, error) {
+	var id int64
+	err := tx.Stmt(db.preparedStatements["select tlsrpt_report id"]).QueryRow(
+		report.OrganizationName,
+		report.ReportID,
+		report.DateRange.Start.Unix(),
+	).Scan(&id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Error("error querying tlsrpt_report", "error", err)
+	}
+	return id, err
+}
 
+// archiveReport keeps the decompressed report and the headers of its message
+// Identical reports are archived once.
+func (db *database) archiveReport(tx *sql.Tx, rep *fetchedReport, kind string) error {
+	if rep.Raw == nil {
+		return nil
+	}
+	dkimResult, dkimDomain := rep.dkimColumns()
+	_, err := db.exec(tx, "upsert report_archive",
+		rep.rawSHA256(),
+		kind,
+		rep.Raw,
+		rep.Headers,
+		rep.Account,
+		rep.Folder,
+		time.Now().Unix(),
+		dkimResult,
+		dkimDomain,
+	)
+	if err != nil {
+		slog.Error("error inserting report_archive", "error", err)
+		return err
+	}
 	return nil
 }
 
-func getLastRun() (time.Time, error) {
-	db := database{}
-	err := db.Open(Configuration.Database.Driver, Configuration.Database.ConnectionString)
+// getArchiveHashes returns the hashes of all archived reports, oldest first
+func getArchiveHashes() ([]string, error) {
+	db, err := openDatabase()
 	if err != nil {
-		return time.Now(), err
+		slog.Error("error opening database", "error", err)
+		return nil, err
 	}
-	defer db.Close()
-	rows, err := db.backendDB.Query("SELECT last_run FROM system")
+	rows, err := db.preparedStatements["select report_archive hashes"].Query()
 	if err != nil {
-		return time.Now(), err
+		slog.Error("error querying report_archive", "error", err)
+		return nil, err
 	}
 	defer rows.Close()
-	last_run := int64(0)
+	hashes := make([]string, 0)
 	for rows.Next() {
-		if err := rows.Scan(&last_run); err != nil {
-			log.Fatal(err)
+		hash := ""
+		if err := rows.Scan(&hash); err != nil {
+			slog.Error("error scanning report_archive", "error", err)
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// getArchivedReports returns the archived reports with the given hashes
+func getArchivedReports(hashes []string) ([]archivedReport, error) {
+	db, err := openDatabase()
+	if err != nil {
+		slog.Error("error opening database", "error", err)
+		return nil, err
+	}
+	archived := make([]archivedReport, 0, len(hashes))
+	for _, hash := range hashes {
+		a := archivedReport{SHA256: hash}
+		err := db.preparedStatements["select report_archive"].QueryRow(hash).Scan(&a.Kind, &a.Content, &a.Headers, &a.Account, &a.Folder, &a.DKIMResult, &a.DKIMDomain)
+		if err != nil {
+			slog.Error("error querying report_archive", "error", err)
+			return nil, err
+		}
+		archived = append(archived, a)
+	}
+	return archived, nil
+}
+
+// deleteReport removes the stored rows of a report, so it can be stored again
+// The archived original is kept.
+func (db *database) deleteReport(tx *sql.Tx, rep *fetchedReport) error {
+	var tables []string
+	var key any // The value the rows of the report are found by
+	switch {
+	case rep.Aggregate != nil:
+		tables = []string{"policy_override_reason", "dkim_auth_result", "spf_auth_result", "record", "policy_published", "metadata"}
+		metadataID, err := db.metadataID(tx, rep.Aggregate)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key = metadataID
+	case rep.TLS != nil:
+		tables = []string{"tlsrpt_failure", "tlsrpt_policy", "tlsrpt_report"}
+		reportID, err := db.tlsReportID(tx, rep.TLS)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
 		}
+		if err != nil {
+			return err
+		}
+		key = reportID
+	case rep.Forensic != nil:
+		tables = []string{"forensic_header", "forensic_report"}
+		key = rep.Forensic.Hash
+	}
+	for _, table := range tables {
+		if _, err := db.exec(tx, "delete from "+table, key); err != nil {
+			slog.Error("error deleting from "+table, "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// storeIngestErrors records the messages that could not be decoded
+func storeIngestErrors(ies []*ingestError) error {
+	db, err := openDatabase()
+	if err != nil {
+		slog.Error("error opening database", "error", err)
+		return err
+	}
+	for _, ie := range ies {
+		_, err := db.preparedStatements["insert into ingest_errors"].Exec(
+			ie.Account,
+			ie.Folder,
+			ie.UID,
+			ie.MessageID,
+			ie.Subject,
+			ie.Reporter,
+			ie.Err.Error(),
+			ie.RawRef,
+			ie.RawSHA256,
+			ie.RawSize,
+			ie.Time.Unix(),
+		)
+		if err != nil {
+			slog.Error("error inserting ingest error", "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// mailboxKey identifies an IMAP folder
+type mailboxKey struct {
+	Account string
+	Folder  string
+}
+
+// mailboxState is the sync checkpoint of an IMAP folder: every message up to and including
+// LastUID has been processed, as long as the UIDVALIDITY of the folder has not changed
+type mailboxState struct {
+	Account       string
+	Folder        string
+	UIDValidity   uint32
+	LastUID       uint32
+	HighestModSeq uint64 // Only set when the server supports CONDSTORE
+}
+
+func getMailboxStates() (map[mailboxKey]mailboxState, error) {
+	db, err := openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.preparedStatements["select mailbox_state"].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	states := make(map[mailboxKey]mailboxState)
+	for rows.Next() {
+		state := mailboxState{}
+		highestModSeq := int64(0)
+		if err := rows.Scan(&state.Account, &state.Folder, &state.UIDValidity, &state.LastUID, &highestModSeq); err != nil {
+			return nil, err
+		}
+		state.HighestModSeq = uint64(highestModSeq)
+		states[mailboxKey{Account: state.Account, Folder: state.Folder}] = state
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// setMailboxStates saves the checkpoints of the given folders
+// This must only be called after the reports fetched up to these checkpoints are stored
+func setMailboxStates(states []mailboxState) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		slog.Debug("saving mailbox state", "account", state.Account, "folder", state.Folder, "uidvalidity", state.UIDValidity, "lastuid", state.LastUID)
+		params := []any{state.UIDValidity, state.LastUID, int64(state.HighestModSeq), state.Account, state.Folder}
+		_, err := db.preparedStatements["upsert mailbox_state"].Exec(params...)
+		if err != nil {
+			slog.Error("error storing mailbox_state", "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// importedFile is a local file that has been processed by a file source
+// The file is processed again when its size or modification time changes.
+type importedFile struct {
+	Source   string
+	Path     string
+	Size     int64
+	Modified int64 // Unix nanoseconds
+}
+
+// getImportedFiles returns the files a file source has processed, by path
+func getImportedFiles(source string) (map[string]importedFile, error) {
+	db, err := openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.preparedStatements["select imported_files"].Query(source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := make(map[string]importedFile)
+	for rows.Next() {
+		file := importedFile{Source: source}
+		if err := rows.Scan(&file.Path, &file.Size, &file.Modified); err != nil {
+			return nil, err
+		}
+		files[file.Path] = file
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// setImportedFiles records that the given files have been processed
+// This must only be called after the reports in these files are stored
+func setImportedFiles(files []importedFile) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, file := range files {
+		params := []any{file.Size, file.Modified, now, file.Source, file.Path}
+		_, err := db.preparedStatements["upsert imported_files"].Exec(params...)
+		if err != nil {
+			slog.Error("error storing imported_files", "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// getStoredUIDs returns the messages of an IMAP folder whose report is stored, as recorded by addStoredUIDs
+func getStoredUIDs(state mailboxState) ([]uint32, error) {
+	db, err := openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.preparedStatements["select imap_stored"].Query(state.Account, state.Folder, state.UIDValidity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	uids := make([]uint32, 0)
+	for rows.Next() {
+		uid := uint32(0)
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
 	}
 	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	if last_run == 0 {
-		return time.Now().AddDate(-100, 0, -1), nil
+	return uids, nil
+}
+
+// addStoredUIDs records that the reports of the given messages of an IMAP folder are stored
+// This must only be called after the reports in these messages are stored
+func addStoredUIDs(state mailboxState, uids []uint32) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
 	}
-	return time.Unix(last_run, 0), nil
+	now := time.Now().Unix()
+	for _, uid := range uids {
+		_, err = db.preparedStatements["upsert imap_stored"].Exec(state.Account, state.Folder, state.UIDValidity, uid, now)
+		if err != nil {
+			slog.Error("error inserting imap_stored", "error", err)
+			return err
+		}
+	}
+	return nil
 }
 
-func setLastRun(last_run time.Time) error {
-	db := database{}
-	err := db.Open(Configuration.Database.Driver, Configuration.Database.ConnectionString)
+// removeStoredUIDs forgets the given messages of an IMAP folder once they are deleted, together with
+// every message recorded under an earlier UIDVALIDITY of the folder
+func removeStoredUIDs(state mailboxState, uids []uint32) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	_, err = db.preparedStatements["delete from imap_stored uid_validity"].Exec(state.Account, state.Folder, state.UIDValidity)
 	if err != nil {
+		slog.Error("error deleting from imap_stored", "error", err)
 		return err
 	}
-	defer db.Close()
-	// FIXME: Variables for postgress
-	_, err = db.backendDB.Exec("INSERT INTO system (last_run) VALUES (?)", last_run.Unix())
+	for _, uid := range uids {
+		_, err = db.preparedStatements["delete from imap_stored"].Exec(state.Account, state.Folder, state.UIDValidity, uid)
+		if err != nil {
+			slog.Error("error deleting from imap_stored", "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// getPOP3UIDLs returns the unique ids of the messages of a POP3 account that have been processed
+// The value is true for the messages that failed, they are retrieved again on the next run.
+func getPOP3UIDLs(account string) (map[string]bool, error) {
+	db, err := openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.preparedStatements["select pop3_uidl"].Query(account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	uidls := make(map[string]bool)
+	for rows.Next() {
+		uidl := ""
+		failed := 0
+		if err := rows.Scan(&uidl, &failed); err != nil {
+			return nil, err
+		}
+		uidls[uidl] = failed != 0
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return uidls, nil
+}
+
+// addPOP3UIDLs records that the given messages of a POP3 account have been processed, or failed
+// This must only be called after the reports or ingest errors of these messages are stored
+func addPOP3UIDLs(account string, uidls []string, failed bool) error {
+	db, err := openDatabase()
 	if err != nil {
 		return err
 	}
+	now := time.Now().Unix()
+	flag := 0
+	if failed {
+		flag = 1
+	}
+	for _, uidl := range uidls {
+		_, err = db.preparedStatements["upsert pop3_uidl"].Exec(flag, now, account, uidl)
+		if err != nil {
+			slog.Error("error inserting pop3_uidl", "error", err)
+			return err
+		}
+	}
 	return nil
 }
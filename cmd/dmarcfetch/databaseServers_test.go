@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// testServers are the database servers the tests run against besides SQLite, by driver
+// The connection string is read from the environment variable, without it the tests are skipped.
+// scripts/dbstandins serves both without a container.
+var testServers = map[string]string{
+	"mysql":    "DMARCANALYZE_TEST_MYSQL",
+	"postgres": "DMARCANALYZE_TEST_POSTGRES",
+}
+
+// emptyServerDatabase returns the connection string of the test server of driver, after dropping its tables
+func emptyServerDatabase(t *testing.T, driver string) string {
+	t.Helper()
+	connectionString := os.Getenv(testServers[driver])
+	if connectionString == "" {
+		t.Skipf("%s not set, no %s server to test against", testServers[driver], driver)
+	}
+	d, err := dialectFor(driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open(d.Driver, connectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// A single connection, FOREIGN_KEY_CHECKS is set per session
+	db.SetMaxOpenConns(1)
+	query, drop := "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()", "DROP TABLE IF EXISTS %s CASCADE"
+	if driver == "mysql" {
+		query, drop = "SELECT table_name FROM information_schema.tables WHERE table_schema = database()", "DROP TABLE IF EXISTS `%s`"
+		if _, err := db.Exec("SET FOREIGN_KEY_CHECKS = 0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("listing tables: %v", err)
+	}
+	tables := make([]string, 0)
+	for rows.Next() {
+		table := ""
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	for _, table := range tables {
+		if _, err := db.Exec(fmt.Sprintf(drop, table)); err != nil {
+			t.Fatalf("dropping %s: %v", table, err)
+		}
+	}
+	return connectionString
+}
+
+func TestMySQLServer(t *testing.T) {
+	useDatabase(t, "mysql", emptyServerDatabase(t, "mysql"))
+	dropRenamedForeignKeyIndexes(t)
+	testDialectAgainstServer(t)
+}
+
+// dropRenamedForeignKeyIndexes works around go-mysql-server, which keeps the old table name in the
+// indexes of a renamed table
+// The indexes it made for the foreign keys of the tables migration 3 renamed are dropped, the ones
+// created after the rename serve the foreign keys instead. On MySQL itself those serve the foreign keys
+// as well, so the drop is harmless there, and its error is ignored where there is no such index.
+func dropRenamedForeignKeyIndexes(t *testing.T) {
+	t.Helper()
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"policy_published", "record", "policy_override_reason", "dkim_auth_result", "spf_auth_result"} {
+		db.backendDB.Exec("DROP INDEX metadata_id ON " + table)
+	}
+}
+
+func TestPostgresServer(t *testing.T) {
+	useDatabase(t, "postgres", emptyServerDatabase(t, "postgres"))
+	testDialectAgainstServer(t)
+}
+
+// testDialectAgainstServer checks the schema and statements of the configured database server
+func testDialectAgainstServer(t *testing.T) {
+	t.Helper()
+	// Every migration ran in useDatabase, preparing the schema again finds nothing to do
+	if err := prepareSchema(true); err != nil {
+		t.Fatalf("preparing the schema a second time: %v", err)
+	}
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := 0
+	if err := db.backendDB.QueryRow(selectSchemaVersion).Scan(&version); err != nil || version != schemaVersion() {
+		t.Errorf("schema version %d (%v), want %d", version, err, schemaVersion())
+	}
+
+	testStoreReportRoundTrip(t)
+
+	google := testTLSReport(t, "google.com", "2024-01-01T00:00:00Z_example.com")
+	microsoft := testTLSReport(t, "microsoft.com", "2024-01-01T00:00:00Z_example.com")
+	stored, failed, err := storeTLSReports([]*fetchedReport{google, microsoft, google})
+	if err != nil || len(stored) != 3 || len(failed) != 0 {
+		t.Fatalf("storeTLSReports stored %d and refused %d (%v), want all stored or skipped", len(stored), len(failed), err)
+	}
+	if count := testCount(t, "tlsrpt_report"); count != 2 {
+		t.Errorf("tlsrpt_report holds %d rows, want 2", count)
+	}
+}
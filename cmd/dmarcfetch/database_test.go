@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// useTestDatabase points the configuration at a new SQLite database with the current schema
+// The previous database settings are restored when the test ends.
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	useDatabase(t, "sqlite", filepath.Join(t.TempDir(), "dmarc.db"))
+}
+
+// useDatabase points the configuration at the database of driver and brings it to the current schema
+// The previous database settings are restored when the test ends.
+func useDatabase(t *testing.T, driver, connectionString string) {
+	t.Helper()
+	previousDriver, previousConnectionString := Configuration.Database.Driver, Configuration.Database.ConnectionString
+	Configuration.Database.Driver = driver
+	Configuration.Database.ConnectionString = connectionString
+	closeDatabase()
+	t.Cleanup(func() {
+		closeDatabase()
+		Configuration.Database.Driver, Configuration.Database.ConnectionString = previousDriver, previousConnectionString
+	})
+	if err := prepareSchema(true); err != nil {
+		t.Fatalf("preparing schema: %v", err)
+	}
+}
+
+// testTLSReport returns a decoded TLS report of organization with one failed session
+func testTLSReport(t *testing.T, organization, reportID string) *fetchedReport {
+	t.Helper()
+	content := []byte(`{
+		"organization-name": "` + organization + `",
+		"date-range": {"start-datetime": "2024-01-01T00:00:00Z", "end-datetime": "2024-01-01T23:59:59Z"},
+		"contact-info": "tlsrpt@` + organization + `",
+		"report-id": "` + reportID + `",
+		"policies": [{
+			"policy": {"policy-type": "sts", "policy-domain": "example.com"},
+			"summary": {"total-successful-session-count": 10, "total-failure-session-count": 1},
+			"failure-details": [{"result-type": "certificate-expired", "failed-session-count": 1}]
+		}]
+	}`)
+	tls, err := decodeTLSReport(content)
+	if err != nil {
+		t.Fatalf("decoding TLS report: %v", err)
+	}
+	return &fetchedReport{TLS: tls, Raw: content, Account: "test", Folder: "INBOX"}
+}
+
+func TestTLSReportIDsAreUniquePerOrganization(t *testing.T) {
+	useTestDatabase(t)
+	google := testTLSReport(t, "google.com", "2024-01-01T00:00:00Z_example.com")
+	microsoft := testTLSReport(t, "microsoft.com", "2024-01-01T00:00:00Z_example.com")
+
+	stored, failed, err := storeTLSReports([]*fetchedReport{google, microsoft})
+	if err != nil || len(stored) != 2 || len(failed) != 0 {
+		t.Fatalf("storeTLSReports stored %d and refused %d (%v), want both stored", len(stored), len(failed), err)
+	}
+	for table, want := range map[string]int{"tlsrpt_report": 2, "tlsrpt_policy": 2, "tlsrpt_failure": 2} {
+		if count := testCount(t, table); count != want {
+			t.Errorf("%s holds %d rows, want %d", table, count, want)
+		}
+	}
+
+	// Replacing the report of one reporter leaves the other alone
+	google.Replace = true
+	if _, _, err := storeTLSReports([]*fetchedReport{google}); err != nil {
+		t.Fatalf("replacing a TLS report: %v", err)
+	}
+	for table, want := range map[string]int{"tlsrpt_report": 2, "tlsrpt_policy": 2, "tlsrpt_failure": 2} {
+		if count := testCount(t, table); count != want {
+			t.Errorf("%s holds %d rows after replacing, want %d", table, count, want)
+		}
+	}
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphans := 0
+	err = db.backendDB.QueryRow(`SELECT COUNT(*) FROM tlsrpt_policy p LEFT JOIN tlsrpt_report r ON r.id = p.tlsrpt_report_id WHERE r.id IS NULL`).Scan(&orphans)
+	if err != nil || orphans != 0 {
+		t.Errorf("%d policies refer to a missing report (%v)", orphans, err)
+	}
+}
+
+func TestArchiveKeepsExactBytes(t *testing.T) {
+	useTestDatabase(t)
+	// Latin-1 and a NUL byte, neither is valid UTF-8 text
+	rep := &fetchedReport{
+		Raw:     []byte("<feedback><org_name>M\xfcller GmbH</org_name>\x00</feedback>"),
+		Headers: []byte("Subject: Report Domain: example.com \xe9\r\n\r\n"),
+		Account: "test",
+		Folder:  "INBOX",
+	}
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.inTransaction(func(tx *sql.Tx) error {
+		return db.archiveReport(tx, rep, archiveKindAggregate)
+	})
+	if err != nil {
+		t.Fatalf("archiveReport error: %v", err)
+	}
+	archived, err := getArchivedReports([]string{rep.rawSHA256()})
+	if err != nil {
+		t.Fatalf("getArchivedReports error: %v", err)
+	}
+	if !bytes.Equal(archived[0].Content, rep.Raw) {
+		t.Errorf("archived content %q, want %q", archived[0].Content, rep.Raw)
+	}
+	if !bytes.Equal(archived[0].Headers, rep.Headers) {
+		t.Errorf("archived headers %q, want %q", archived[0].Headers, rep.Headers)
+	}
+}
+
+func TestMigrateArchiveToBytes(t *testing.T) {
+	// A database of version 5, whose archive still holds text
+	all := migrations
+	migrations = migrations[:5]
+	useTestDatabase(t)
+	migrations = all
+	db := database{}
+	if err := db.connect(Configuration.Database.Driver, Configuration.Database.ConnectionString); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.backendDB.Exec(`INSERT INTO report_archive (sha256, kind, content, headers, account, folder) VALUES ('hash', 'aggregate', '<feedback/>', 'Subject: x', 'test', 'INBOX')`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := prepareSchema(true); err != nil {
+		t.Fatalf("migrating to version 6: %v", err)
+	}
+	archived, err := getArchivedReports([]string{"hash"})
+	if err != nil {
+		t.Fatalf("getArchivedReports error: %v", err)
+	}
+	if string(archived[0].Content) != "<feedback/>" || string(archived[0].Headers) != "Subject: x" {
+		t.Errorf("archived report %q %q changed by the migration", archived[0].Content, archived[0].Headers)
+	}
+	pool, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := ""
+	if err := pool.backendDB.QueryRow(`SELECT typeof(content) FROM report_archive`).Scan(&storage); err != nil || storage != "blob" {
+		t.Errorf("content stored as %q (%v), want blob", storage, err)
+	}
+}
+
+func TestStoreReportRoundTrip(t *testing.T) {
+	useTestDatabase(t)
+	testStoreReportRoundTrip(t)
+}
+
+// testStoreReportRoundTrip stores an aggregate report in the configured database, reads it back
+// and stores it again, first as a duplicate and then as a replacement
+func testStoreReportRoundTrip(t *testing.T) {
+	t.Helper()
+	rep, err := decodeReportFile("google.com!example.com!1700000000!1700086399.xml", []byte(testAggregateXML("round-trip")))
+	if err != nil {
+		t.Fatalf("decoding report: %v", err)
+	}
+	rep.Account, rep.Folder = "test", "INBOX"
+	rows := map[string]int{"metadata": 1, "policy_published": 1, "record": 1, "dkim_auth_result": 1, "spf_auth_result": 1, "report_archive": 1}
+	checkRows := func(when string) {
+		t.Helper()
+		for table, want := range rows {
+			if count := testCount(t, table); count != want {
+				t.Errorf("%s: %s holds %d rows, want %d", when, table, count, want)
+			}
+		}
+	}
+
+	stored, failed, err := storeReports([]*fetchedReport{rep})
+	if err != nil || len(stored) != 1 || len(failed) != 0 {
+		t.Fatalf("storeReports stored %d and refused %d (%v), want the report stored", len(stored), len(failed), err)
+	}
+	checkRows("after storing")
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var organization, reportID, archiveHash, sourceIP, dkimDomain, dkimResult, spfResult string
+	var beginDate, count int64
+	err = db.backendDB.QueryRow(`SELECT m.organization, m.report_id, m.begin_date, m.raw_sha256, r.source_ip, r.count, d.domain, d.result, s.result
+		FROM metadata m
+		JOIN record r ON r.metadata_id = m.id
+		JOIN dkim_auth_result d ON d.metadata_id = m.id
+		JOIN spf_auth_result s ON s.metadata_id = m.id`).Scan(
+		&organization, &reportID, &beginDate, &archiveHash, &sourceIP, &count, &dkimDomain, &dkimResult, &spfResult)
+	if err != nil {
+		t.Fatalf("reading the report back: %v", err)
+	}
+	if organization != "google.com" || reportID != "round-trip" || beginDate != 1700000000 || archiveHash != rep.rawSHA256() {
+		t.Errorf("metadata %q %q %d %q, want google.com round-trip 1700000000 %q", organization, reportID, beginDate, archiveHash, rep.rawSHA256())
+	}
+	if sourceIP != "192.0.2.1" || count != 2 || dkimDomain != "example.com" || dkimResult != "pass" || spfResult != "fail" {
+		t.Errorf("record %q %d with DKIM %q %q and SPF %q, want 192.0.2.1 2 with DKIM example.com pass and SPF fail", sourceIP, count, dkimDomain, dkimResult, spfResult)
+	}
+
+	// A report that is already stored is skipped without an error
+	stored, failed, err = storeReports([]*fetchedReport{rep})
+	if err != nil || len(stored) != 1 || len(failed) != 0 {
+		t.Fatalf("storing the report again stored %d and refused %d (%v), want it skipped", len(stored), len(failed), err)
+	}
+	checkRows("after storing again")
+
+	rep.Replace = true
+	stored, failed, err = storeReports([]*fetchedReport{rep})
+	if err != nil || len(stored) != 1 || len(failed) != 0 {
+		t.Fatalf("replacing the report stored %d and refused %d (%v), want it replaced", len(stored), len(failed), err)
+	}
+	checkRows("after replacing")
+}
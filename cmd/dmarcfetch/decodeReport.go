@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// decodeReportMessage finds the report in a message and decodes it
+// headers and body are the raw header and text sections of the message. The returned report
+// holds an aggregate, forensic or TLS report, the caller fills in where it came from.
+func decodeReportMessage(headers, body []byte) (*fetchedReport, error) {
+	if msg, err := mail.ReadMessage(bytes.NewReader(headers)); err == nil {
+		if boundary, ok := isForensicReport(msg.Header); ok {
+			forensic, err := decodeForensicReport(msg.Header, body, boundary)
+			if err != nil {
+				return nil, fmt.Errorf("decode failed: %w", err)
+			}
+			return &fetchedReport{Forensic: forensic}, nil
+		}
+	}
+
+	// Every part that looks like a report is a candidate, the first one that decodes wins
+	type candidate struct {
+		part   mimePart
+		format string
+	}
+	candidates := make([]candidate, 0)
+	walkErr := walkMessage(headers, body, func(part mimePart) {
+		if format, ok := reportPartFormat(part); ok && len(part.Data) > 0 {
+			candidates = append(candidates, candidate{part: part, format: format})
+		}
+	})
+	if len(candidates) == 0 {
+		if walkErr != nil {
+			return nil, fmt.Errorf("no attachment found: %w", walkErr)
+		}
+		return nil, fmt.Errorf("no attachment found")
+	}
+	if walkErr != nil {
+		slog.Debug("message partly unreadable", "error", walkErr)
+	}
+
+	var firstErr error
+	for _, c := range candidates {
+		rep, err := decodeReportData(c.format, c.part.Data)
+		if err != nil {
+			slog.Debug("candidate part failed", "type", c.part.ContentType, "filename", c.part.Filename, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		rep.Headers = headers
+		if Configuration.DKIM.Verify && rep.Aggregate != nil {
+			if err := checkReportSignature(rep, headers, body); err != nil {
+				return nil, err
+			}
+		}
+		return rep, nil
+	}
+	return nil, firstErr
+}
+
+// The ways a report can be packed, found from the first bytes of the data
+const (
+	formatZip   = "zip"
+	formatGzip  = "gzip"
+	formatBzip2 = "bzip2"
+	formatZstd  = "zstd"
+	formatXML   = "xml"
+	formatJSON  = "json"
+)
+
+// Default limits for report attachments, see ConfigLimits
+const (
+	defaultMaxCompressedBytes   = 20 * 1024 * 1024
+	defaultMaxDecompressedBytes = 200 * 1024 * 1024
+	defaultMaxRatio             = 200
+	defaultMaxZipEntries        = 16
+	defaultMaxXMLDepth          = 32
+)
+
+// maxPackingLayers limits how many compression layers are removed from a report
+// A gzipped report inside a zip file is the worst seen so far.
+const maxPackingLayers = 3
+
+// reportContentTypes are the declared content types that are taken to be a report, with the format they announce
+var reportContentTypes = map[string]string{
+	"application/zip":               formatZip,
+	"application/x-zip-compressed":  formatZip,
+	"application/x-zip":             formatZip,
+	"application/gzip":              formatGzip,
+	"application/x-gzip":            formatGzip,
+	"application/x-gzip-compressed": formatGzip,
+	"application/x-bzip2":           formatBzip2,
+	"application/x-bzip":            formatBzip2,
+	"application/zstd":              formatZstd,
+	"application/x-zstd":            formatZstd,
+	"text/xml":                      formatXML,
+	"application/xml":               formatXML,
+	contentTypeTLSReportGzip:        formatGzip,
+	contentTypeTLSReportJSON:        formatJSON,
+}
+
+// reportPartFormat decides if a part holds a report and returns the format it announces
+// The declared content type is tried first, then the filename and then the first bytes of the part.
+// What is announced only matters when the data itself is not recognized, see unpackReport.
+func reportPartFormat(part mimePart) (string, bool) {
+	if format, ok := reportContentTypes[part.ContentType]; ok {
+		return format, true
+	}
+	if format, ok := reportFileType(part.Filename); ok {
+		return format, true
+	}
+	format := sniffReportFormat(part.Data)
+	return format, format != ""
+}
+
+// sniffReportFormat recognizes zip, gzip, bzip2, zstd, XML and JSON data by its first bytes
+// An empty string is returned for anything else.
+func sniffReportFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return formatZip
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return formatGzip
+	case bytes.HasPrefix(data, []byte("BZh")) && len(data) > 3 && data[3] >= '1' && data[3] <= '9':
+		return formatBzip2
+	case bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return formatZstd
+	}
+	text := bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(text, []byte("<")):
+		return formatXML
+	case bytes.HasPrefix(text, []byte("{")):
+		return formatJSON
+	}
+	return ""
+}
+
+// decodeReportData decodes an attachment or file holding either a TLS or an aggregate report
+// format is what the content type or filename announced. JSON is taken to be a TLS report and XML an
+// aggregate report. The decompressed report is kept with it for the archive.
+func decodeReportData(format string, data []byte) (*fetchedReport, error) {
+	content, err := unpackReport(format, data)
+	if err != nil {
+		slog.Debug("decode failed", "error", err, "format", format)
+		return nil, fmt.Errorf("decode failed: %w", err)
+	}
+	if sniffReportFormat(content) == formatJSON {
+		tls, err := decodeTLSReport(content)
+		if err != nil {
+			return nil, err
+		}
+		return &fetchedReport{TLS: tls, Raw: content}, nil
+	}
+	agg, err := decodeAggregate(content)
+	if err != nil {
+		slog.Debug("decode failed", "error", err, "attachment", string(content))
+		return nil, fmt.Errorf("decode failed: %w", err)
+	}
+	return &fetchedReport{Aggregate: agg, Raw: content}, nil
+}
+
+// unpackReport removes the compression layers from a report until XML or JSON is left
+// The first bytes decide how a layer is unpacked, whatever was announced. When they are not
+// recognized, base64 that was not marked as such is decoded, else the announced format is trusted.
+// The configured limits apply to the attachment as a whole, a report that would grow past them is
+// not decompressed any further.
+func unpackReport(format string, data []byte) ([]byte, error) {
+	limits := Configuration.limits()
+	if int64(len(data)) > limits.MaxCompressedBytes {
+		return nil, fmt.Errorf("attachment of %d bytes is larger than %d bytes", len(data), limits.MaxCompressedBytes)
+	}
+	maxBytes := min(limits.MaxDecompressedBytes, int64(len(data))*limits.MaxRatio)
+	for layer := 0; layer < maxPackingLayers; layer++ {
+		found := sniffReportFormat(data)
+		if found == "" {
+			if decoded, ok := decodeUnmarkedBase64(data); ok {
+				data = decoded
+				continue
+			}
+			found = format
+		}
+		var err error
+		switch found {
+		case formatXML, formatJSON:
+			return data, nil
+		case formatZip:
+			data, err = unzipReport(data, maxBytes, limits.MaxZipEntries)
+		case formatGzip, formatBzip2, formatZstd:
+			data, err = decompressReport(found, data, maxBytes)
+		default:
+			err = fmt.Errorf("unknown format '%s'", format)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Whatever was announced was about the outer layer
+		format = ""
+	}
+	return nil, fmt.Errorf("report is packed in more than %d layers", maxPackingLayers)
+}
+
+// decodeUnmarkedBase64 decodes base64 that was sent without a Content-Transfer-Encoding
+// Only data that decodes to something recognizable is accepted.
+func decodeUnmarkedBase64(data []byte) ([]byte, bool) {
+	decoded, err := decodeTransferEncoding("base64", bytes.NewReader(data))
+	if err != nil || sniffReportFormat(decoded) == "" {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// decompressReport returns the decompressed contents of a gzip, bzip2 or zstd compressed report
+// Decompressing stops with an error once more than maxBytes come out.
+func decompressReport(format string, data []byte, maxBytes int64) ([]byte, error) {
+	var r io.Reader
+	switch format {
+	case formatGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("could not create gzip reader: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	case formatBzip2:
+		r = bzip2.NewReader(bytes.NewReader(data))
+	case formatZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderMaxMemory(uint64(maxBytes)))
+		if err != nil {
+			return nil, fmt.Errorf("could not create zstd reader: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", format)
+	}
+	decompressed, err := readLimited(r, maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s decompression failed: %w", format, err)
+	}
+	return decompressed, nil
+}
+
+// readLimited reads everything from r, or returns an error once more than maxBytes have been read
+func readLimited(r io.Reader, maxBytes int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("report decompresses to more than %d bytes", maxBytes)
+	}
+	return data, nil
+}
+
+// unzipReport returns the contents of the report in a zip file
+// That is the first file with a report extension, or the first file if none has one. Zip files with
+// more than maxEntries files are refused, the report is read up to maxBytes.
+func unzipReport(data []byte, maxBytes int64, maxEntries int) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("could not create zip reader: %w", err)
+	}
+	if len(zr.File) > maxEntries {
+		return nil, fmt.Errorf("zip file holds %d files, more than %d", len(zr.File), maxEntries)
+	}
+	var report *zip.File
+	for _, file := range zr.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		if _, ok := reportFileType(file.Name); ok {
+			report = file
+			break
+		}
+		if report == nil {
+			report = file
+		}
+	}
+	if report == nil {
+		return nil, fmt.Errorf("no file found in zip")
+	}
+	// The size in the zip header can be a lie, so the reading is limited as well
+	if report.UncompressedSize64 > uint64(maxBytes) {
+		return nil, fmt.Errorf("zipped file %s of %d bytes is larger than %d bytes", report.Name, report.UncompressedSize64, maxBytes)
+	}
+	fr, err := report.Open()
+	if err != nil {
+		return nil, fmt.Errorf("could not open zipped file %s: %w", report.Name, err)
+	}
+	defer fr.Close()
+	return readLimited(fr, maxBytes)
+}
+
+// reportFileTypes are the formats of report files by their extension
+var reportFileTypes = map[string]string{
+	".xml":  formatXML,
+	".json": formatJSON,
+	".zip":  formatZip,
+	".gz":   formatGzip,
+	".bz2":  formatBzip2,
+	".zst":  formatZstd,
+}
+
+// reportFileType returns the format of a report file by its name
+func reportFileType(name string) (string, bool) {
+	format, ok := reportFileTypes[strings.ToLower(filepath.Ext(name))]
+	return format, ok
+}
+
+// decodeReportFile decodes a local file, either a bare report file or a complete message
+func decodeReportFile(name string, data []byte) (*fetchedReport, error) {
+	if attachmentType, ok := reportFileType(name); ok {
+		return decodeReportData(attachmentType, data)
+	}
+	headers, body := splitMessage(data)
+	return decodeReportMessage(headers, body)
+}
+
+// splitMessage splits a raw message into its header and text sections
+// The empty line between them belongs to the header, like the IMAP HEADER section.
+func splitMessage(raw []byte) ([]byte, []byte) {
+	for _, separator := range []string{"\r\n\r\n", "\n\n"} {
+		if idx := bytes.Index(raw, []byte(separator)); idx >= 0 {
+			return raw[:idx+len(separator)], raw[idx+len(separator):]
+		}
+	}
+	return raw, nil
+}
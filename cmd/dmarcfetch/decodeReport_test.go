@@ -0,0 +1,248 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// readTestdata returns the contents of a file in testdata
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeReportCorpus(t *testing.T) {
+	tests := []struct {
+		file         string
+		reportID     string // Empty for a TLS report
+		organization string
+		tlsReportID  string
+		err          string
+	}{
+		{file: "messages/gzip-base64.eml", reportID: "gzip-base64", organization: "google.com"},
+		{file: "messages/multipart-zip.eml", reportID: "multipart-zip", organization: "Enterprise Outlook"},
+		{file: "messages/nested-multipart.eml", reportID: "nested-multipart", organization: "example.org"},
+		{file: "messages/forwarded-rfc822.eml", reportID: "forwarded-rfc822", organization: "google.com"},
+		{file: "messages/quoted-printable-latin1.eml", reportID: "quoted-printable-latin1", organization: "Müller Mail GmbH"},
+		{file: "messages/zip-windows-1252.eml", reportID: "zip-windows-1252", organization: "Société – Mail"},
+		{file: "messages/octet-stream-gzip.eml", reportID: "octet-stream-gzip", organization: "google.com"},
+		{file: "messages/mislabeled-zip.eml", reportID: "mislabeled-zip", organization: "google.com"},
+		{file: "messages/unmarked-base64.eml", reportID: "unmarked-base64", organization: "google.com"},
+		{file: "messages/tlsrpt-gzip.eml", tlsReportID: "tlsrpt-gzip", organization: "Google Inc."},
+		{file: "messages/no-report.eml", err: "no attachment found"},
+		{file: "files/protection.outlook.com!example.com!1700000000!1700086399.zip", reportID: "loose-zip", organization: "Enterprise Outlook"},
+	}
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.file), func(t *testing.T) {
+			rep, err := decodeReportFile(tt.file, readTestdata(t, tt.file))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("decodeReportFile error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeReportFile error: %v", err)
+			}
+			if len(rep.Raw) == 0 {
+				t.Errorf("the decompressed report is not kept for the archive")
+			}
+			if tt.tlsReportID != "" {
+				if rep.TLS == nil {
+					t.Fatalf("decoded %+v, want a TLS report", rep)
+				}
+				if rep.TLS.ReportID != tt.tlsReportID || rep.TLS.OrganizationName != tt.organization {
+					t.Errorf("TLS report %q of %q, want %q of %q", rep.TLS.ReportID, rep.TLS.OrganizationName, tt.tlsReportID, tt.organization)
+				}
+				return
+			}
+			if rep.Aggregate == nil {
+				t.Fatalf("decoded %+v, want an aggregate report", rep)
+			}
+			metadata := rep.Aggregate.Metadata
+			if metadata.ReportID != tt.reportID || metadata.OrgName != tt.organization {
+				t.Errorf("aggregate report %q of %q, want %q of %q", metadata.ReportID, metadata.OrgName, tt.reportID, tt.organization)
+			}
+		})
+	}
+}
+
+func TestWalkMessage(t *testing.T) {
+	tests := []struct {
+		file  string
+		parts []string // Content type and filename of every leaf part
+	}{
+		{
+			file:  "gzip-base64.eml",
+			parts: []string{"application/gzip google.com!example.com!1700000000!1700086399.xml.gz"},
+		},
+		{
+			file: "nested-multipart.eml",
+			parts: []string{
+				"text/plain ",
+				"text/html ",
+				"image/png ",
+				"application/x-gzip example.org!example.com!1700000000!1700086399.xml.gz",
+			},
+		},
+		{
+			// The forwarded message is walked as well, its own headers are not a part
+			file: "forwarded-rfc822.eml",
+			parts: []string{
+				"text/plain ",
+				"application/gzip google.com!example.com!1700000000!1700086399.xml.gz",
+			},
+		},
+		{
+			file:  "quoted-printable-latin1.eml",
+			parts: []string{"text/xml müller.de!example.com!1700000000!1700086399.xml"},
+		},
+		{
+			file:  "no-report.eml",
+			parts: []string{"text/plain "},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			headers, body := splitMessage(readTestdata(t, filepath.Join("messages", tt.file)))
+			parts := make([]string, 0)
+			err := walkMessage(headers, body, func(part mimePart) {
+				parts = append(parts, part.ContentType+" "+part.Filename)
+			})
+			if err != nil {
+				t.Fatalf("walkMessage error: %v", err)
+			}
+			if !slices.Equal(parts, tt.parts) {
+				t.Errorf("walkMessage visited %q, want %q", parts, tt.parts)
+			}
+		})
+	}
+}
+
+func TestWalkMessageDecodesTransferEncodings(t *testing.T) {
+	headers, body := splitMessage(readTestdata(t, "messages/quoted-printable-latin1.eml"))
+	var data []byte
+	if err := walkMessage(headers, body, func(part mimePart) { data = part.Data }); err != nil {
+		t.Fatalf("walkMessage error: %v", err)
+	}
+	// The part is still in ISO-8859-1, the XML decoder converts it
+	if !strings.Contains(string(data), "<org_name>M\xfcller Mail GmbH</org_name>") {
+		t.Errorf("quoted-printable part decoded to %q", data)
+	}
+	if strings.Contains(string(data), "=\r\n") || strings.Contains(string(data), "=FC") {
+		t.Errorf("quoted-printable encoding left in %q", data)
+	}
+}
+
+func TestSniffReportFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		format string
+	}{
+		{"zip", "PK\x03\x04rest", formatZip},
+		{"gzip", "\x1f\x8b\x08", formatGzip},
+		{"bzip2", "BZh91AY", formatBzip2},
+		{"bzip2 without block size", "BZhx", ""},
+		{"zstd", "\x28\xb5\x2f\xfd", formatZstd},
+		{"xml", "<?xml version=\"1.0\"?>", formatXML},
+		{"xml after a byte order mark and blank lines", "\xef\xbb\xbf\r\n  <feedback>", formatXML},
+		{"json", " {\"organization-name\":", formatJSON},
+		{"text", "This is a report", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if format := sniffReportFormat([]byte(tt.data)); format != tt.format {
+				t.Errorf("sniffReportFormat(%q) = %q, want %q", tt.data, format, tt.format)
+			}
+		})
+	}
+}
+
+// useLimits replaces the configured limits until the test ends
+func useLimits(t *testing.T, limits ConfigLimits) {
+	t.Helper()
+	previous := Configuration.Limits
+	Configuration.Limits = limits
+	t.Cleanup(func() { Configuration.Limits = previous })
+}
+
+func TestDecodeLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		limits ConfigLimits // Zero for the defaults
+		err    string
+		raised *ConfigLimits // Limits the file decodes with, to show the fixture is sound. nil for fixed limits.
+	}{
+		{
+			name:   "ratio",
+			file:   "ratio.xml.gz",
+			err:    "report decompresses to more than",
+			raised: &ConfigLimits{MaxRatio: 10000},
+		},
+		{
+			name:   "decompressed bytes",
+			file:   "ratio.xml.gz",
+			limits: ConfigLimits{MaxRatio: 10000, MaxDecompressedBytes: 1024 * 1024},
+			err:    "report decompresses to more than 1048576 bytes",
+			raised: &ConfigLimits{MaxRatio: 10000},
+		},
+		{
+			name:   "zip entries",
+			file:   "entries.zip",
+			err:    "zip file holds 17 files, more than 16",
+			raised: &ConfigLimits{MaxZipEntries: 17},
+		},
+		{
+			name:   "XML depth",
+			file:   "depth.xml",
+			err:    "XML nested deeper than 32 levels",
+			raised: &ConfigLimits{MaxXMLDepth: 64},
+		},
+		{
+			name: "packing layers",
+			file: "layers.xml.gz",
+			err:  "report is packed in more than 3 layers",
+		},
+		{
+			name: "MIME depth",
+			file: "mime-depth.eml",
+			err:  "MIME structure nested deeper than 16 levels",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := readTestdata(t, filepath.Join("bombs", tt.file))
+			useLimits(t, tt.limits)
+			_, err := decodeReportFile(tt.file, data)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("decodeReportFile error %v, want %q", err, tt.err)
+			}
+			if tt.raised == nil {
+				return
+			}
+			Configuration.Limits = *tt.raised
+			if _, err := decodeReportFile(tt.file, data); err != nil {
+				t.Errorf("decodeReportFile error %v with the limit raised", err)
+			}
+		})
+	}
+}
+
+func TestAttachmentOverMaxCompressedBytes(t *testing.T) {
+	useLimits(t, ConfigLimits{MaxCompressedBytes: 1024})
+	data := readTestdata(t, "bombs/ratio.xml.gz")
+	_, err := decodeReportFile("ratio.xml.gz", data)
+	if err == nil || !strings.Contains(err.Error(), "larger than 1024 bytes") {
+		t.Fatalf("decodeReportFile error %v, want the attachment refused for its size", err)
+	}
+}
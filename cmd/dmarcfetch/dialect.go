@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	// Database drivers, the errors of each are inspected to recognize duplicates
+	"github.com/go-sql-driver/mysql"   // mysql
+	"github.com/jackc/pgx/v5/pgconn"   // postgres
+	_ "github.com/jackc/pgx/v5/stdlib" // postgres, registered as pgx
+	"modernc.org/sqlite"               // sqlite
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// dialect holds what differs between the supported databases
+// Statements are written with Postgres placeholders ($1, $2, ...) and the DDL uses tokens for the
+// column types, see types.
+type dialect struct {
+	Name   string // Driver in the configuration
+	Driver string // Name of the database/sql driver
+	// types replaces the column type tokens in the DDL:
+	// {id} an auto incrementing primary key, {int} a 64 bit integer, {text} text of any length,
+	// {key} text that is indexed or referred to, {longtext} text of more than 64KB and {blob} bytes of
+	// any length
+	types *strings.Replacer
+	// reserved matches the table and column names of the schema that are reserved words of the
+	// database, they are quoted with backticks. nil if there are none.
+	reserved *regexp.Regexp
+}
+
+// dialects are the supported databases, by the driver in the configuration
+var dialects = map[string]*dialect{
+	"sqlite": {
+		Name:   "sqlite",
+		Driver: "sqlite",
+		types: strings.NewReplacer(
+			"{id}", "INTEGER PRIMARY KEY AUTOINCREMENT",
+			"{int}", "INTEGER",
+			"{text}", "TEXT",
+			"{key}", "TEXT",
+			"{longtext}", "TEXT",
+			"{blob}", "BLOB",
+		),
+	},
+	// MySQL cannot index TEXT columns without a prefix length, so indexed text is limited to 255 characters
+	"mysql": {
+		Name:   "mysql",
+		Driver: "mysql",
+		types: strings.NewReplacer(
+			"{id}", "BIGINT AUTO_INCREMENT PRIMARY KEY",
+			"{int}", "BIGINT",
+			"{text}", "TEXT",
+			"{key}", "VARCHAR(255)",
+			"{longtext}", "LONGTEXT",
+			"{blob}", "LONGBLOB",
+		),
+		// The table of the first releases, SYSTEM is reserved since MySQL 8.0.3
+		reserved: regexp.MustCompile(`\bsystem\b`),
+	},
+	"postgres": {
+		Name:   "postgres",
+		Driver: "pgx",
+		types: strings.NewReplacer(
+			"{id}", "BIGSERIAL PRIMARY KEY",
+			"{int}", "BIGINT",
+			"{text}", "TEXT",
+			"{key}", "TEXT",
+			"{longtext}", "TEXT",
+			"{blob}", "BYTEA",
+		),
+	},
+}
+
+// dialectFor returns the dialect of a configured driver
+func dialectFor(driver string) (*dialect, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("database driver %s not supported, use sqlite, mysql or postgres", driver)
+	}
+	return d, nil
+}
+
+var placeholderRegexp = regexp.MustCompile(`\$(\d+)`)
+
+// rebind rewrites the $1, $2, ... placeholders of a query for the dialect
+// SQLite takes ?1, ?2, ... MySQL only knows ?, so there the placeholders must be numbered in the
+// order they appear in the query, each used once.
+func (d *dialect) rebind(query string) (string, error) {
+	switch d.Name {
+	case "sqlite":
+		return placeholderRegexp.ReplaceAllString(query, "?$1"), nil
+	case "mysql":
+		next := 1
+		var err error
+		query = placeholderRegexp.ReplaceAllStringFunc(query, func(placeholder string) string {
+			if n, _ := strconv.Atoi(placeholder[1:]); n != next && err == nil {
+				err = fmt.Errorf("placeholder %s found where $%d was expected", placeholder, next)
+			}
+			next++
+			return "?"
+		})
+		return query, err
+	}
+	return query, nil
+}
+
+// ddl returns the statements of a schema definition for the dialect
+// The definition may hold several statements separated by semicolons. CREATE INDEX IF NOT EXISTS is
+// not known to MySQL, there the error for an existing index is ignored instead, see isDuplicateIndex.
+func (d *dialect) ddl(schema string) []string {
+	statements := make([]string, 0)
+	for _, statement := range strings.Split(d.types.Replace(schema), ";") {
+		statement = strings.TrimSpace(statement)
+		if statement == "" {
+			continue
+		}
+		if d.reserved != nil {
+			statement = d.reserved.ReplaceAllString(statement, "`$0`")
+		}
+		if d.Name == "mysql" {
+			statement = strings.Replace(statement, "INDEX IF NOT EXISTS", "INDEX", 1)
+		}
+		statements = append(statements, statement)
+	}
+	return statements
+}
+
+// upsertStatement is an insert that updates the row with the same keys if there is one
+// The generated SQL differs per dialect, see upsert.
+type upsertStatement struct {
+	Table   string
+	Columns []string // In the order of the parameters
+	Keys    []string // Columns of the unique index that decides if the row exists
+	Ignore  bool     // Leave an existing row as it is instead of updating it
+}
+
+// upsert returns the SQL of an upsert statement, with $1, $2, ... placeholders
+func (d *dialect) upsert(u upsertStatement) string {
+	placeholders := make([]string, len(u.Columns))
+	for i := range u.Columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", u.Table, strings.Join(u.Columns, ", "), strings.Join(placeholders, ", "))
+
+	update := make([]string, 0)
+	for _, column := range u.Columns {
+		if u.Ignore || slices.Contains(u.Keys, column) {
+			continue
+		}
+		if d.Name == "mysql" {
+			update = append(update, fmt.Sprintf("%s = VALUES(%s)", column, column))
+		} else {
+			update = append(update, fmt.Sprintf("%s = excluded.%s", column, column))
+		}
+	}
+	switch {
+	case d.Name == "mysql" && len(update) == 0:
+		// Assigning a key to itself changes nothing
+		return fmt.Sprintf("%s ON DUPLICATE KEY UPDATE %s = %s", query, u.Keys[0], u.Keys[0])
+	case d.Name == "mysql":
+		return fmt.Sprintf("%s ON DUPLICATE KEY UPDATE %s", query, strings.Join(update, ", "))
+	case len(update) == 0:
+		return fmt.Sprintf("%s ON CONFLICT (%s) DO NOTHING", query, strings.Join(u.Keys, ", "))
+	}
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s", query, strings.Join(u.Keys, ", "), strings.Join(update, ", "))
+}
+
+// isUniqueViolation returns true if err is a unique constraint violation, for each of the supported drivers
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	var mysqlErr *mysql.MySQLError
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &sqliteErr):
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	case errors.As(err, &mysqlErr):
+		return mysqlErr.Number == 1062 // ER_DUP_ENTRY
+	case errors.As(err, &pgErr):
+		return pgErr.Code == "23505" // unique_violation
+	}
+	return false
+}
+
+// isDuplicateIndex returns true if err says an index already exists, which MySQL reports when an index is created again
+func isDuplicateIndex(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1061 // ER_DUP_KEYNAME
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dialect string
+		query   string
+		want    string
+		err     string
+	}{
+		{"sqlite", "SELECT a FROM t WHERE b = $1 AND c = $2", "SELECT a FROM t WHERE b = ?1 AND c = ?2", ""},
+		{"sqlite", "SELECT a FROM t WHERE b = $2 OR c = $1 OR d = $1", "SELECT a FROM t WHERE b = ?2 OR c = ?1 OR d = ?1", ""},
+		{"sqlite", "SELECT a FROM t WHERE b = $10", "SELECT a FROM t WHERE b = ?10", ""},
+		{"postgres", "SELECT a FROM t WHERE b = $1 AND c = $2", "SELECT a FROM t WHERE b = $1 AND c = $2", ""},
+		{"mysql", "SELECT a FROM t WHERE b = $1 AND c = $2", "SELECT a FROM t WHERE b = ? AND c = ?", ""},
+		{"mysql", "INSERT INTO t VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)", "INSERT INTO t VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", ""},
+		{"mysql", "SELECT a FROM t", "SELECT a FROM t", ""},
+		// MySQL binds by position, a query that refers to its parameters out of order cannot be rewritten
+		{"mysql", "SELECT a FROM t WHERE b = $2 AND c = $1", "", "placeholder $2 found where $1 was expected"},
+		{"mysql", "SELECT a FROM t WHERE b = $1 OR c = $1", "", "placeholder $1 found where $2 was expected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dialect+" "+tt.query, func(t *testing.T) {
+			query, err := dialects[tt.dialect].rebind(tt.query)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("rebind error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || query != tt.want {
+				t.Errorf("rebind = %q (%v), want %q", query, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatementsRebindForEveryDialect(t *testing.T) {
+	for name, d := range dialects {
+		for statement, query := range preparedStatements {
+			if _, err := d.rebind(query); err != nil {
+				t.Errorf("%s: statement %q: %v", name, statement, err)
+			}
+		}
+		for statement, upsert := range upsertStatements {
+			if _, err := d.rebind(d.upsert(upsert)); err != nil {
+				t.Errorf("%s: upsert %q: %v", name, statement, err)
+			}
+		}
+	}
+}
+
+func TestDDL(t *testing.T) {
+	schema := `
+	CREATE TABLE IF NOT EXISTS t (
+	id {id},
+	name {key} NOT NULL,
+	count {int},
+	note {text},
+	report {longtext},
+	raw {blob}
+	);
+	CREATE INDEX IF NOT EXISTS t_name ON t (name);
+	`
+	tests := []struct {
+		dialect    string
+		statements []string
+	}{
+		{"sqlite", []string{
+			"CREATE TABLE IF NOT EXISTS t (\n\tid INTEGER PRIMARY KEY AUTOINCREMENT,\n\tname TEXT NOT NULL,\n\tcount INTEGER,\n\tnote TEXT,\n\treport TEXT,\n\traw BLOB\n\t)",
+			"CREATE INDEX IF NOT EXISTS t_name ON t (name)",
+		}},
+		{"mysql", []string{
+			"CREATE TABLE IF NOT EXISTS t (\n\tid BIGINT AUTO_INCREMENT PRIMARY KEY,\n\tname VARCHAR(255) NOT NULL,\n\tcount BIGINT,\n\tnote TEXT,\n\treport LONGTEXT,\n\traw LONGBLOB\n\t)",
+			// MySQL does not know IF NOT EXISTS for indexes, the duplicate is ignored instead
+			"CREATE INDEX t_name ON t (name)",
+		}},
+		{"postgres", []string{
+			"CREATE TABLE IF NOT EXISTS t (\n\tid BIGSERIAL PRIMARY KEY,\n\tname TEXT NOT NULL,\n\tcount BIGINT,\n\tnote TEXT,\n\treport TEXT,\n\traw BYTEA\n\t)",
+			"CREATE INDEX IF NOT EXISTS t_name ON t (name)",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dialect, func(t *testing.T) {
+			if statements := dialects[tt.dialect].ddl(schema); !slices.Equal(statements, tt.statements) {
+				t.Errorf("ddl = %q, want %q", statements, tt.statements)
+			}
+		})
+	}
+}
+
+func TestDDLQuotesReservedWords(t *testing.T) {
+	tests := map[string]string{
+		"sqlite":   "DROP TABLE IF EXISTS system",
+		"mysql":    "DROP TABLE IF EXISTS `system`",
+		"postgres": "DROP TABLE IF EXISTS system",
+	}
+	for name, want := range tests {
+		if statements := dialects[name].ddl("DROP TABLE IF EXISTS system; "); len(statements) != 1 || statements[0] != want {
+			t.Errorf("%s: ddl = %q, want %q", name, statements, want)
+		}
+	}
+}
+
+func TestMigrationsLeaveNoTypeTokens(t *testing.T) {
+	for name, d := range dialects {
+		for _, m := range migrations {
+			groups := m.Up
+			if dialectGroups, ok := m.Dialects[name]; ok {
+				groups = dialectGroups
+			}
+			for _, group := range groups {
+				for _, statement := range d.ddl(group) {
+					if strings.Contains(statement, "{") {
+						t.Errorf("%s: migration %d holds an unknown type token: %s", name, m.Version, statement)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	update := upsertStatement{Table: "t", Columns: []string{"a", "b", "c"}, Keys: []string{"a"}}
+	ignore := upsertStatement{Table: "t", Columns: []string{"a", "b"}, Keys: []string{"a", "b"}, Ignore: true}
+	tests := []struct {
+		dialect string
+		upsert  upsertStatement
+		want    string
+	}{
+		{"sqlite", update, "INSERT INTO t (a, b, c) VALUES ($1, $2, $3) ON CONFLICT (a) DO UPDATE SET b = excluded.b, c = excluded.c"},
+		{"postgres", update, "INSERT INTO t (a, b, c) VALUES ($1, $2, $3) ON CONFLICT (a) DO UPDATE SET b = excluded.b, c = excluded.c"},
+		{"mysql", update, "INSERT INTO t (a, b, c) VALUES ($1, $2, $3) ON DUPLICATE KEY UPDATE b = VALUES(b), c = VALUES(c)"},
+		{"sqlite", ignore, "INSERT INTO t (a, b) VALUES ($1, $2) ON CONFLICT (a, b) DO NOTHING"},
+		{"postgres", ignore, "INSERT INTO t (a, b) VALUES ($1, $2) ON CONFLICT (a, b) DO NOTHING"},
+		{"mysql", ignore, "INSERT INTO t (a, b) VALUES ($1, $2) ON DUPLICATE KEY UPDATE a = a"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s ignore=%t", tt.dialect, tt.upsert.Ignore), func(t *testing.T) {
+			if got := dialects[tt.dialect].upsert(tt.upsert); got != tt.want {
+				t.Errorf("upsert = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpsertOnSQLite(t *testing.T) {
+	useTestDatabase(t)
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range db.dialect.ddl(`CREATE TABLE t (a {key} NOT NULL, b {int}); CREATE UNIQUE INDEX t_a ON t (a)`) {
+		if _, err := db.backendDB.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec := func(u upsertStatement, args ...any) {
+		t.Helper()
+		query, err := db.dialect.rebind(db.dialect.upsert(u))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.backendDB.Exec(query, args...); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	update := upsertStatement{Table: "t", Columns: []string{"a", "b"}, Keys: []string{"a"}}
+	ignore := upsertStatement{Table: "t", Columns: []string{"a", "b"}, Keys: []string{"a"}, Ignore: true}
+	exec(update, "x", 1)
+	exec(update, "x", 2)
+	exec(ignore, "x", 3)
+	exec(ignore, "y", 4)
+
+	rows := map[string]int{}
+	result, err := db.backendDB.Query("SELECT a, b FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Close()
+	for result.Next() {
+		a, b := "", 0
+		if err := result.Scan(&a, &b); err != nil {
+			t.Fatal(err)
+		}
+		rows[a] = b
+	}
+	if len(rows) != 2 || rows["x"] != 2 || rows["y"] != 4 {
+		t.Errorf("t holds %v, want x updated to 2 and y inserted as 4", rows)
+	}
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	useTestDatabase(t)
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.backendDB.Exec("CREATE TABLE t (a TEXT UNIQUE, b INTEGER PRIMARY KEY, c TEXT NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.backendDB.Exec("INSERT INTO t (a, b, c) VALUES ('x', 1, 'c')"); err != nil {
+		t.Fatal(err)
+	}
+	_, uniqueErr := db.backendDB.Exec("INSERT INTO t (a, b, c) VALUES ('x', 2, 'c')")
+	_, primaryKeyErr := db.backendDB.Exec("INSERT INTO t (a, b, c) VALUES ('y', 1, 'c')")
+	_, notNullErr := db.backendDB.Exec("INSERT INTO t (a, b) VALUES ('z', 3)")
+	_, indexErr := db.backendDB.Exec("CREATE INDEX t_a ON t (a); CREATE INDEX t_a ON t (a)")
+
+	tests := []struct {
+		name           string
+		err            error
+		unique         bool
+		duplicateIndex bool
+	}{
+		{"sqlite unique", uniqueErr, true, false},
+		{"sqlite primary key", primaryKeyErr, true, false},
+		{"sqlite not null", notNullErr, false, false},
+		{"sqlite existing index", indexErr, false, false},
+		{"wrapped sqlite unique", fmt.Errorf("storing: %w", uniqueErr), true, false},
+		{"mysql duplicate entry", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'x' for key 't.a'"}, true, false},
+		{"mysql duplicate key name", &mysql.MySQLError{Number: 1061, Message: "Duplicate key name 't_a'"}, false, true},
+		{"mysql data too long", &mysql.MySQLError{Number: 1406, Message: "Data too long for column 'a'"}, false, false},
+		{"postgres unique violation", &pgconn.PgError{Code: "23505"}, true, false},
+		{"postgres not null violation", &pgconn.PgError{Code: "23502"}, false, false},
+		{"other", errors.New("connection refused"), false, false},
+		{"nil", nil, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if strings.HasPrefix(tt.name, "sqlite") && tt.err == nil {
+				t.Fatal("SQLite accepted the statement")
+			}
+			if got := isUniqueViolation(tt.err); got != tt.unique {
+				t.Errorf("isUniqueViolation(%v) = %t, want %t", tt.err, got, tt.unique)
+			}
+			if got := isDuplicateIndex(tt.err); got != tt.duplicateIndex {
+				t.Errorf("isDuplicateIndex(%v) = %t, want %t", tt.err, got, tt.duplicateIndex)
+			}
+		})
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// The DKIM result of a report message, as stored in metadata
+const (
+	dkimResultPass      = "pass"      // A valid signature of the reporting domain
+	dkimResultMismatch  = "mismatch"  // Only valid signatures of other domains
+	dkimResultFail      = "fail"      // A signature that does not verify
+	dkimResultNone      = "none"      // Not signed
+	dkimResultTempError = "temperror" // The key could not be looked up, try again later
+	dkimResultPermError = "permerror" // A broken signature or key
+)
+
+const (
+	dkimPolicyFlag = "flag"
+	dkimPolicyDrop = "drop"
+
+	defaultDKIMTimeout = 10
+)
+
+// txtResolver looks up TXT records, net.Resolver is one
+type txtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// dkimResolver looks up the public keys of DKIM signatures
+// It is replaced when a resolver is configured, and can be replaced by a stub.
+var dkimResolver txtResolver = net.DefaultResolver
+
+// dkimVerification is the outcome of verifying the signatures of a report message
+type dkimVerification struct {
+	Result string
+	Domain string // The signing domain the result is about, empty if not signed
+}
+
+// dkimSignatureResult is the outcome of verifying one DKIM-Signature header
+type dkimSignatureResult struct {
+	Result string
+	Domain string
+	Err    error
+}
+
+// dkimColumns returns the DKIM result and signing domain to store, nil if the message was not verified
+func (r *fetchedReport) dkimColumns() (*string, *string) {
+	if r.DKIM == nil {
+		return nil, nil
+	}
+	return &r.DKIM.Result, &r.DKIM.Domain
+}
+
+// dkimResolverFor returns the resolver to use for the configured DNS server, if any
+func dkimResolverFor(server string) txtResolver {
+	if server == "" {
+		return dkimResolver
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// checkReportSignature verifies the DKIM signatures of the message an aggregate report came in
+// The result is kept with the report. With the drop policy an error is returned when the message
+// is not signed by the domain of the reporting organization, unless the key could not be looked up.
+func checkReportSignature(rep *fetchedReport, headers, body []byte) error {
+	settings, err := Configuration.dkim()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(settings.Timeout)*time.Second)
+	defer cancel()
+	orgDomain := ""
+	if _, domain, ok := strings.Cut(rep.Aggregate.Metadata.Email, "@"); ok {
+		orgDomain = domain
+	}
+	verification := verifyDKIM(ctx, dkimResolverFor(settings.Resolver), headers, body, orgDomain)
+	rep.DKIM = &verification
+	slog.Debug("dkim verified", "report", rep.id(), "result", verification.Result, "domain", verification.Domain)
+	if settings.Policy != dkimPolicyDrop {
+		return nil
+	}
+	switch verification.Result {
+	case dkimResultPass:
+		return nil
+	case dkimResultTempError:
+		slog.Warn("dkim key lookup failed, keeping report", "report", rep.id())
+		return nil
+	case dkimResultNone:
+		return fmt.Errorf("report is not signed, expected a signature of %s", orgDomain)
+	default:
+		return fmt.Errorf("report is not signed by %s (dkim %s for %s)", orgDomain, verification.Result, verification.Domain)
+	}
+}
+
+// verifyDKIM verifies all DKIM signatures of a message and sums them up for orgDomain
+// A valid signature of a domain with the same organizational domain as orgDomain passes. Failing that,
+// a valid signature of another domain is a mismatch. Otherwise the result of the first signature is returned.
+func verifyDKIM(ctx context.Context, resolver txtResolver, headers, body []byte, orgDomain string) dkimVerification {
+	fields := splitHeaderFields(toCRLF(headers))
+	body = toCRLF(body)
+	results := make([]dkimSignatureResult, 0)
+	for idx, field := range fields {
+		if strings.EqualFold(field.Name, "DKIM-Signature") {
+			result := verifyDKIMSignature(ctx, resolver, fields, idx, body)
+			if result.Err != nil {
+				slog.Debug("dkim signature not valid", "domain", result.Domain, "result", result.Result, "error", result.Err)
+			}
+			results = append(results, result)
+		}
+	}
+	if len(results) == 0 {
+		return dkimVerification{Result: dkimResultNone}
+	}
+	var valid, temporary *dkimSignatureResult
+	for idx := range results {
+		result := &results[idx]
+		switch {
+		case result.Result == dkimResultPass && domainsRelated(result.Domain, orgDomain):
+			return dkimVerification{Result: dkimResultPass, Domain: result.Domain}
+		case result.Result == dkimResultPass && valid == nil:
+			valid = result
+		case result.Result == dkimResultTempError && temporary == nil:
+			temporary = result
+		}
+	}
+	switch {
+	case valid != nil:
+		return dkimVerification{Result: dkimResultMismatch, Domain: valid.Domain}
+	case temporary != nil:
+		return dkimVerification{Result: dkimResultTempError, Domain: temporary.Domain}
+	}
+	return dkimVerification{Result: results[0].Result, Domain: results[0].Domain}
+}
+
+// domainsRelated returns true if the domains have the same organizational domain
+// This is the relaxed alignment of DMARC: the organizational domain is the public suffix and one label
+// more, looked up in the public suffix list. A signature of attacker.github.io does not align with
+// github.io, as github.io is a public suffix of its own.
+func domainsRelated(a, b string) bool {
+	a = strings.TrimSuffix(strings.ToLower(a), ".")
+	b = strings.TrimSuffix(strings.ToLower(b), ".")
+	if a == "" || b == "" {
+		return false
+	}
+	if a == b {
+		return true
+	}
+	orgA, err := publicsuffix.EffectiveTLDPlusOne(a)
+	if err != nil {
+		return false
+	}
+	orgB, err := publicsuffix.EffectiveTLDPlusOne(b)
+	return err == nil && orgA == orgB
+}
+
+// headerField is a header field as it appears in the message, including folding and the final CRLF
+type headerField struct {
+	Name string
+	Raw  []byte
+}
+
+// toCRLF converts bare LF line endings to CRLF, messages read from files often have them
+func toCRLF(data []byte) []byte {
+	if !bytes.Contains(data, []byte("\n")) || bytes.Count(data, []byte("\r\n")) == bytes.Count(data, []byte("\n")) {
+		return data
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+// splitHeaderFields splits a header section into its fields, folded lines stay with their field
+func splitHeaderFields(headers []byte) []headerField {
+	fields := make([]headerField, 0)
+	for _, line := range bytes.SplitAfter(headers, []byte("\r\n")) {
+		if len(line) == 0 || bytes.Equal(line, []byte("\r\n")) {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := &fields[len(fields)-1]
+			last.Raw = append(last.Raw, line...)
+			continue
+		}
+		name, _, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			continue
+		}
+		fields = append(fields, headerField{
+			Name: strings.TrimSpace(string(name)),
+			Raw:  append([]byte{}, line...),
+		})
+	}
+	return fields
+}
+
+// parseTagList parses a DKIM tag list like "v=1; a=rsa-sha256; d=example.com"
+// Whitespace around tags and values is removed.
+func parseTagList(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag '%s'", part)
+		}
+		tags[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// removeWhitespace removes folding whitespace from base64 values
+func removeWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// dkimSignatureValue matches the value of the b= tag, to leave it out of the header hash
+var dkimSignatureValue = regexp.MustCompile(`((?:^|[;:])[ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// verifyDKIMSignature verifies the DKIM-Signature header at fields[idx] (RFC 6376)
+func verifyDKIMSignature(ctx context.Context, resolver txtResolver, fields []headerField, idx int, body []byte) dkimSignatureResult {
+	signature := fields[idx]
+	_, value, _ := bytes.Cut(signature.Raw, []byte(":"))
+	tags, err := parseTagList(string(value))
+	if err != nil {
+		return dkimSignatureResult{Result: dkimResultPermError, Err: err}
+	}
+	result := dkimSignatureResult{Domain: strings.ToLower(tags["d"])}
+	permError := func(format string, args ...any) dkimSignatureResult {
+		result.Result = dkimResultPermError
+		result.Err = fmt.Errorf(format, args...)
+		return result
+	}
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return permError("missing tag %s=", tag)
+		}
+	}
+	if tags["v"] != "1" {
+		return permError("unknown version %s", tags["v"])
+	}
+	signedHeaders := strings.Split(tags["h"], ":")
+	for idx := range signedHeaders {
+		signedHeaders[idx] = strings.TrimSpace(signedHeaders[idx])
+	}
+	if !containsFold(signedHeaders, "From") {
+		return permError("From is not signed")
+	}
+	if expires := tags["x"]; expires != "" {
+		if seconds, err := strconv.ParseInt(expires, 10, 64); err == nil && time.Unix(seconds, 0).Before(time.Now()) {
+			result.Result = dkimResultFail
+			result.Err = fmt.Errorf("signature expired")
+			return result
+		}
+	}
+
+	keyAlgorithm, hashAlgorithm, _ := strings.Cut(strings.ToLower(tags["a"]), "-")
+	var hashFunc crypto.Hash
+	var newHash func() hash.Hash
+	switch hashAlgorithm {
+	case "sha256":
+		hashFunc, newHash = crypto.SHA256, sha256.New
+	case "sha1":
+		hashFunc, newHash = crypto.SHA1, sha1.New
+	default:
+		return permError("unknown algorithm %s", tags["a"])
+	}
+	headerCanon, bodyCanon, _ := strings.Cut(strings.ToLower(tags["c"]), "/")
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+
+	// The body hash
+	canonicalBody, err := canonicalizeBody(bodyCanon, body)
+	if err != nil {
+		return permError("%w", err)
+	}
+	if length := tags["l"]; length != "" {
+		l, err := strconv.Atoi(length)
+		if err != nil || l < 0 {
+			return permError("malformed body length %s", length)
+		}
+		if l < len(canonicalBody) {
+			canonicalBody = canonicalBody[:l]
+		}
+	}
+	bodyHash := newHash()
+	bodyHash.Write(canonicalBody)
+	expectedBodyHash, err := base64.StdEncoding.DecodeString(removeWhitespace(tags["bh"]))
+	if err != nil {
+		return permError("malformed body hash: %w", err)
+	}
+	if !bytes.Equal(bodyHash.Sum(nil), expectedBodyHash) {
+		result.Result = dkimResultFail
+		result.Err = fmt.Errorf("body hash does not match")
+		return result
+	}
+
+	// The header hash, signed fields are taken from the bottom up
+	headerHash := newHash()
+	used := map[int]bool{}
+	for _, name := range signedHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && i != idx && strings.EqualFold(fields[i].Name, name) {
+				used[i] = true
+				headerHash.Write(canonicalizeHeader(headerCanon, fields[i].Raw))
+				break
+			}
+		}
+	}
+	unsigned := dkimSignatureValue.ReplaceAll(signature.Raw, []byte("$1"))
+	headerHash.Write(bytes.TrimSuffix(canonicalizeHeader(headerCanon, unsigned), []byte("\r\n")))
+	hashed := headerHash.Sum(nil)
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(removeWhitespace(tags["b"]))
+	if err != nil {
+		return permError("malformed signature: %w", err)
+	}
+	key, err := lookupDKIMKey(ctx, resolver, tags["s"], result.Domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && !dnsErr.IsNotFound {
+			result.Result = dkimResultTempError
+			result.Err = err
+			return result
+		}
+		return permError("%w", err)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if keyAlgorithm != "rsa" {
+			return permError("key type does not match algorithm %s", tags["a"])
+		}
+		err = rsa.VerifyPKCS1v15(key, hashFunc, hashed, signatureBytes)
+	case ed25519.PublicKey:
+		if keyAlgorithm != "ed25519" {
+			return permError("key type does not match algorithm %s", tags["a"])
+		}
+		if !ed25519.Verify(key, hashed, signatureBytes) {
+			err = fmt.Errorf("ed25519 verification error")
+		}
+	}
+	if err != nil {
+		result.Result = dkimResultFail
+		result.Err = err
+		return result
+	}
+	result.Result = dkimResultPass
+	return result
+}
+
+// containsFold returns true if list holds s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupDKIMKey returns the public key of a selector, an *rsa.PublicKey or an ed25519.PublicKey
+func lookupDKIMKey(ctx context.Context, resolver txtResolver, selector, domain string) (crypto.PublicKey, error) {
+	records, err := resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no key for selector %s", selector)
+	}
+	tags, err := parseTagList(records[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed key: %w", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("unknown key version %s", v)
+	}
+	if tags["p"] == "" {
+		return nil, fmt.Errorf("key of selector %s is revoked", selector)
+	}
+	data, err := base64.StdEncoding.DecodeString(removeWhitespace(tags["p"]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed key: %w", err)
+	}
+	switch strings.ToLower(tags["k"]) {
+	case "", "rsa":
+		key, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			// Some keys are published as a bare PKCS#1 key
+			if pkcs1, pkcs1Err := x509.ParsePKCS1PublicKey(data); pkcs1Err == nil {
+				key = pkcs1
+			} else {
+				return nil, fmt.Errorf("malformed key: %w", err)
+			}
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key of selector %s is not an RSA key", selector)
+		}
+		if rsaKey.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("RSA key of %d bits is too short", rsaKey.N.BitLen())
+		}
+		return rsaKey, nil
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("malformed ed25519 key")
+		}
+		return ed25519.PublicKey(data), nil
+	default:
+		return nil, fmt.Errorf("unknown key type %s", tags["k"])
+	}
+}
+
+// canonicalizeHeader returns a header field in simple or relaxed canonical form
+func canonicalizeHeader(canon string, raw []byte) []byte {
+	if canon == "simple" {
+		return raw
+	}
+	name, value, _ := bytes.Cut(raw, []byte(":"))
+	// Unfold, then turn every run of whitespace into a single space
+	value = bytes.ReplaceAll(value, []byte("\r\n"), nil)
+	value = bytes.TrimSpace(collapseWhitespace(value))
+	canonical := append(bytes.ToLower(bytes.TrimSpace(name)), ':')
+	canonical = append(canonical, value...)
+	return append(canonical, '\r', '\n')
+}
+
+// canonicalizeBody returns a body in simple or relaxed canonical form
+func canonicalizeBody(canon string, body []byte) ([]byte, error) {
+	switch canon {
+	case "simple":
+		body = bytes.TrimRight(body, "\r\n")
+		return append(body, '\r', '\n'), nil
+	case "relaxed":
+		lines := bytes.Split(body, []byte("\r\n"))
+		canonical := make([]byte, 0, len(body))
+		for _, line := range lines {
+			canonical = append(canonical, bytes.TrimRight(collapseWhitespace(line), " ")...)
+			canonical = append(canonical, '\r', '\n')
+		}
+		// Empty lines at the end are ignored, an empty body stays empty
+		canonical = bytes.TrimRight(canonical, "\r\n")
+		if len(canonical) == 0 {
+			return canonical, nil
+		}
+		return append(canonical, '\r', '\n'), nil
+	default:
+		return nil, fmt.Errorf("unknown canonicalization %s", canon)
+	}
+}
+
+// collapseWhitespace replaces every run of spaces and tabs by a single space
+func collapseWhitespace(data []byte) []byte {
+	collapsed := make([]byte, 0, len(data))
+	inWhitespace := false
+	for _, c := range data {
+		if c == ' ' || c == '\t' {
+			if !inWhitespace {
+				collapsed = append(collapsed, ' ')
+			}
+			inWhitespace = true
+			continue
+		}
+		inWhitespace = false
+		collapsed = append(collapsed, c)
+	}
+	return collapsed
+}
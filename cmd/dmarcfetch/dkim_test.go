@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// The public keys the fixtures in testdata/dkim are signed with
+const (
+	// testDKIMKey signed the fixtures of example.org
+	testDKIMKey = "MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAxFVImoVSeb13xMowq0ROnmKcPyuRl90NaW0MNXGQ32AerTutOjQTt4TrO10hEYHTeDJQlNNAF9zJGJP2W2oi3rabfn1paFuZ+nyNDz5GkzpxYxOHx9drHBC0LOUsWNIEP4MQpdGxS/H81C4VE5nADloYXqF/tHLhY5v/Z89PFMlSKHh52j+2ncQY9AF63ubmbRcVQr8eSeQl4of4iYbxnH3LsRN7J6ZCnEy79/S08CNmv0vKM1yMUZswznjplG+q75eS0xd1VSTUkBxelqUbrteqbOBBl5H/PFDzWPPiMyMLsNFFB0Xhdpr+5VaUWsfyJa4xHSa5S+W1AoxBeH2uvQIDAQAB"
+	// testDKIMOtherKey is a valid key that signed nothing
+	testDKIMOtherKey = "MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAwbNGx6BFlzgyJ7wYyW0bhce8mNAB0tfq9dey3ev335wSIb21R93F7EDhplyoiCslEV32+40JNCy0xbwt1v4K6dEGOamot6vgvk42GtcNvJoqsnjGhlax9vdukOisG+0ZsonMBCBDtJFehP1jFQIsev6DbnREEmz46wDBBlrUd6wJabeYwkjU18/xmZ+d8oGrsvuJkPX6XJyUZPnJwggxU61ICwjm253+FmT9VJfZkZmGcMF4Qp8aHs+hSoNayV/kvQ8LW4oPKd7Islo+BrOYc2eI7eeN5NADcCbzc1GnpjF/z1dwH+fxOSaHhMxOo/Eq/PUEt+u+VtiXKc/WUqR6dQIDAQAB"
+	// testDKIMShortKey has 512 bits, too few to be trusted
+	testDKIMShortKey = "MFwwDQYJKoZIhvcNAQEBBQADSwAwSAJBAN7Vu+b5zV1ryo1cXwrKdaOEY5dWkEocJhl4eozVZTA5mLk5GhFGt7szfw5Ghog/ChHVgBDw+8+0zLjGf1/Np5kCAwEAAQ=="
+	// testDKIMEd25519Key is the key of the example in RFC 8463 appendix A
+	testDKIMEd25519Key = "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+)
+
+// stubResolver answers TXT lookups from records, or with err for every name if set
+// A name without records is not found.
+type stubResolver struct {
+	records map[string]string
+	err     error
+}
+
+func (r stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	record, ok := r.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return []string{record}, nil
+}
+
+// testDKIMResolver publishes the keys the fixtures were signed with
+func testDKIMResolver() stubResolver {
+	return stubResolver{records: map[string]string{
+		"s2048._domainkey.example.org":             "v=DKIM1; k=rsa; p=" + testDKIMKey,
+		"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p=" + testDKIMEd25519Key,
+	}}
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		edit      func(message string) string // Changes the message before it is verified
+		resolver  stubResolver                // testDKIMResolver if empty
+		orgDomain string
+		result    string
+		domain    string
+	}{
+		// Canonicalization
+		{name: "ed25519 relaxed example of RFC 8463", file: "rfc8463.eml", orgDomain: "football.example.com", result: dkimResultPass, domain: "football.example.com"},
+		{name: "simple", file: "simple.eml", orgDomain: "example.org", result: dkimResultPass, domain: "example.org"},
+		{name: "relaxed with folded headers", file: "relaxed.eml", orgDomain: "example.org", result: dkimResultPass, domain: "example.org"},
+		{
+			name:      "simple header changed in whitespace",
+			file:      "simple.eml",
+			edit:      replace("Subject: Report Domain:", "Subject: Report  Domain:"),
+			orgDomain: "example.org", result: dkimResultFail, domain: "example.org",
+		},
+		{
+			name:      "simple body changed in whitespace",
+			file:      "simple.eml",
+			edit:      replace("example.org.  \r\n", "example.org.\r\n"),
+			orgDomain: "example.org", result: dkimResultFail, domain: "example.org",
+		},
+		{
+			name: "relaxed header and body changed in whitespace",
+			file: "relaxed.eml",
+			edit: func(message string) string {
+				message = replace("Report Domain:  example.com", "Report \t Domain: example.com", "example.org.  \r\n", "example.org.\t\r\n")(message)
+				return message + "\r\n\r\n"
+			},
+			orgDomain: "example.org", result: dkimResultPass, domain: "example.org",
+		},
+		{
+			name:      "relaxed body changed",
+			file:      "relaxed.eml",
+			edit:      replace("1700000000.example.org\t", "1700000001.example.org\t"),
+			orgDomain: "example.org", result: dkimResultFail, domain: "example.org",
+		},
+		{
+			name:      "relaxed header changed",
+			file:      "relaxed.eml",
+			edit:      replace("Report Domain:  example.com", "Report Domain:  example.net"),
+			orgDomain: "example.org", result: dkimResultFail, domain: "example.org",
+		},
+		{
+			name:      "ed25519 header changed",
+			file:      "rfc8463.eml",
+			edit:      replace("Is dinner ready?", "Is lunch ready?"),
+			orgDomain: "football.example.com", result: dkimResultFail, domain: "football.example.com",
+		},
+
+		// Body length
+		{name: "l= with text added after signing", file: "length.eml", orgDomain: "example.org", result: dkimResultPass, domain: "example.org"},
+		{
+			name:      "l= with the signed part changed",
+			file:      "length.eml",
+			edit:      replace("aggregate report", "aggregate rep0rt"),
+			orgDomain: "example.org", result: dkimResultFail, domain: "example.org",
+		},
+
+		// Duplicate headers are signed from the bottom up
+		{name: "duplicate headers", file: "duplicates.eml", orgDomain: "example.org", result: dkimResultPass, domain: "example.org"},
+		{
+			name:      "duplicate header added below the signed ones",
+			file:      "duplicates.eml",
+			edit:      replace("Received: from mx1.example.org by mx2.example.org; Tue, 14 Nov 2023 00:00:01 +0000\r\n", "Received: from mx1.example.org by mx2.example.org; Tue, 14 Nov 2023 00:00:01 +0000\r\nReceived: from forged.example by mx1.example.org\r\n"),
+			orgDomain: "example.org", result: dkimResultFail, domain: "example.org",
+		},
+		{
+			name:      "oversigned header added",
+			file:      "duplicates.eml",
+			edit:      func(message string) string { return "Subject: Forged\r\n" + message },
+			orgDomain: "example.org", result: dkimResultFail, domain: "example.org",
+		},
+		{
+			name:      "unsigned header added",
+			file:      "duplicates.eml",
+			edit:      func(message string) string { return "X-Spam-Score: 0\r\n" + message },
+			orgDomain: "example.org", result: dkimResultPass, domain: "example.org",
+		},
+
+		// Keys
+		{
+			name:      "revoked key",
+			file:      "simple.eml",
+			resolver:  stubResolver{records: map[string]string{"s2048._domainkey.example.org": "v=DKIM1; k=rsa; p="}},
+			orgDomain: "example.org", result: dkimResultPermError, domain: "example.org",
+		},
+		{
+			name:      "other key",
+			file:      "simple.eml",
+			resolver:  stubResolver{records: map[string]string{"s2048._domainkey.example.org": "v=DKIM1; k=rsa; p=" + testDKIMOtherKey}},
+			orgDomain: "example.org", result: dkimResultFail, domain: "example.org",
+		},
+		{
+			name:      "short key",
+			file:      "simple.eml",
+			resolver:  stubResolver{records: map[string]string{"s2048._domainkey.example.org": "v=DKIM1; k=rsa; p=" + testDKIMShortKey}},
+			orgDomain: "example.org", result: dkimResultPermError, domain: "example.org",
+		},
+		{
+			name:      "ed25519 key for an RSA signature",
+			file:      "simple.eml",
+			resolver:  stubResolver{records: map[string]string{"s2048._domainkey.example.org": "v=DKIM1; k=ed25519; p=" + testDKIMEd25519Key}},
+			orgDomain: "example.org", result: dkimResultPermError, domain: "example.org",
+		},
+		{
+			name:      "malformed key",
+			file:      "simple.eml",
+			resolver:  stubResolver{records: map[string]string{"s2048._domainkey.example.org": "v=DKIM1; k=rsa; p=not*base64"}},
+			orgDomain: "example.org", result: dkimResultPermError, domain: "example.org",
+		},
+		{
+			name:      "key not published",
+			file:      "simple.eml",
+			resolver:  stubResolver{records: map[string]string{}},
+			orgDomain: "example.org", result: dkimResultPermError, domain: "example.org",
+		},
+		{
+			name:      "key lookup timed out",
+			file:      "simple.eml",
+			resolver:  stubResolver{err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}},
+			orgDomain: "example.org", result: dkimResultTempError, domain: "example.org",
+		},
+
+		// The domain of the reporting organization
+		{name: "reporter is a subdomain", file: "simple.eml", orgDomain: "reports.example.org", result: dkimResultPass, domain: "example.org"},
+		{name: "domain mismatch", file: "simple.eml", orgDomain: "example.net", result: dkimResultMismatch, domain: "example.org"},
+		{name: "lookalike domain", file: "simple.eml", orgDomain: "badexample.org", result: dkimResultMismatch, domain: "example.org"},
+		{
+			name:      "not signed",
+			file:      "simple.eml",
+			edit:      func(message string) string { return message[strings.Index(message, "From:"):] },
+			orgDomain: "example.org", result: dkimResultNone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := string(readTestdata(t, "dkim/"+tt.file))
+			if tt.edit != nil {
+				edited := tt.edit(message)
+				if edited == message {
+					t.Fatalf("the edit did not change %s", tt.file)
+				}
+				message = edited
+			}
+			resolver := tt.resolver
+			if resolver.records == nil && resolver.err == nil {
+				resolver = testDKIMResolver()
+			}
+			headers, body := splitMessage([]byte(message))
+			verification := verifyDKIM(context.Background(), resolver, headers, body, tt.orgDomain)
+			if verification.Result != tt.result || verification.Domain != tt.domain {
+				t.Errorf("verifyDKIM = %s for %q, want %s for %q", verification.Result, verification.Domain, tt.result, tt.domain)
+			}
+		})
+	}
+}
+
+func TestDomainsRelated(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"example.org", "example.org", true},
+		{"Example.ORG.", "example.org", true},
+		{"mail.example.org", "example.org", true},
+		{"example.org", "reports.example.org", true},
+		// Relaxed alignment only compares the organizational domains
+		{"mail.example.org", "reports.example.org", true},
+		{"example.org", "badexample.org", false},
+		{"example.org", "example.net", false},
+		{"example.co.uk", "other.co.uk", false},
+		{"mail.example.co.uk", "example.co.uk", true},
+		// github.io is a private suffix, its subdomains belong to different owners
+		{"attacker.github.io", "github.io", false},
+		{"attacker.github.io", "victim.github.io", false},
+		{"reports.victim.github.io", "victim.github.io", true},
+		{"co.uk", "example.co.uk", false},
+		{"", "example.org", false},
+		{"example.org", "", false},
+	}
+	for _, tt := range tests {
+		if got := domainsRelated(tt.a, tt.b); got != tt.want {
+			t.Errorf("domainsRelated(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// replace returns an edit that replaces each old string by the new one that follows it
+func replace(oldNew ...string) func(message string) string {
+	return func(message string) string {
+		return strings.NewReplacer(oldNew...).Replace(message)
+	}
+}
+
+func TestDKIMSignatureValue(t *testing.T) {
+	tests := []struct {
+		field    string
+		unsigned string
+	}{
+		{"DKIM-Signature: v=1; b=abc; bh=xyz; d=example.org", "DKIM-Signature: v=1; b=; bh=xyz; d=example.org"},
+		{"DKIM-Signature: bh=xyz; b=abc\r\n\t def==\r\n", "DKIM-Signature: bh=xyz; b="},
+		{"DKIM-Signature: b = abc;bh=xyz", "DKIM-Signature: b =;bh=xyz"},
+		{"DKIM-Signature:b=abc", "DKIM-Signature:b="},
+		{"DKIM-Signature: v=1; bh=xyz; d=b.example", "DKIM-Signature: v=1; bh=xyz; d=b.example"},
+	}
+	for _, tt := range tests {
+		if got := dkimSignatureValue.ReplaceAllString(tt.field, "$1"); got != tt.unsigned {
+			t.Errorf("removing b= from %q gave %q, want %q", tt.field, got, tt.unsigned)
+		}
+	}
+}
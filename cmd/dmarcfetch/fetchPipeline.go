@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sync"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+const (
+	defaultFetchBatchSize = 100
+)
+
+// rawMessage is a fetched message or file waiting to be decoded
+type rawMessage struct {
+	UID     imap.UID // IMAP only
+	Path    string   // Local sources only, the file the message was read from
+	Index   int      // Local sources only, the position of the message in an mbox file
+	ID      string   // POP3 only, the unique id (UIDL) of the message
+	Headers []byte
+	Body    []byte
+	// Oversized is the size of a message that is over the limits, only its headers are read
+	Oversized int64
+}
+
+// decodedMessage is the outcome of decoding one message: either a report or an ingest error
+type decodedMessage struct {
+	UID    imap.UID
+	Path   string
+	ID     string
+	Report *fetchedReport
+	Failed *ingestError
+}
+
+// processResult is what processMessages managed to store, also when it stopped early
+type processResult struct {
+	Stats     syncStats
+	Succeeded imap.UIDSet // Messages whose report is stored
+	Failed    imap.UIDSet // Messages that are stored as ingest errors
+}
+
+// fetchBatchSize returns the configured number of messages per FETCH command and per store
+func fetchBatchSize() int {
+	if Configuration.FetchBatchSize > 0 {
+		return Configuration.FetchBatchSize
+	}
+	return defaultFetchBatchSize
+}
+
+// decodeWorkers returns the configured number of concurrent decoders
+func decodeWorkers() int {
+	if Configuration.DecodeWorkers > 0 {
+		return Configuration.DecodeWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// processMessages fetches, decodes and stores the messages in uids with runPipeline
+// After every stored batch the checkpoint in state is moved up to the first message that
+// is not stored yet, or to covered once all messages are stored.
+func processMessages(client *imapclient.Client, account ConfigIMAPAccount, state mailboxState, covered uint32, uids []imap.UID) (processResult, error) {
+	result := processResult{}
+	total := len(uids)
+
+	// stored holds the messages that are stored but not yet below the checkpoint
+	stored := make(map[imap.UID]bool)
+	next := 0 // index in uids of the first message that is not stored
+	store := func(msgs []decodedMessage) error {
+		reports := make([]*fetchedReport, 0, len(msgs))
+		failed := make([]*ingestError, 0)
+		for _, msg := range msgs {
+			if msg.Report != nil {
+				reports = append(reports, msg.Report)
+			} else {
+				failed = append(failed, msg.Failed)
+			}
+			stored[msg.UID] = true
+		}
+		checkpoint, advanced := nextCheckpoint(state, covered, uids, next, stored)
+
+		storeMutex.Lock()
+		defer storeMutex.Unlock()
+		reports, failed, err := storeDecoded(reports, failed)
+		if err != nil {
+			// Nothing of the batch is stored, it must not move the checkpoint
+			for _, msg := range msgs {
+				delete(stored, msg.UID)
+			}
+			return err
+		}
+		if account.Actions.RetentionDays > 0 && account.Actions.Success.Move == "" && len(reports) > 0 {
+			// The messages stay in the folder, retention must know which ones it may delete
+			storedUIDs := make([]uint32, 0, len(reports))
+			for _, rep := range reports {
+				storedUIDs = append(storedUIDs, uint32(rep.UID))
+			}
+			if err := addStoredUIDs(state, storedUIDs); err != nil {
+				return fmt.Errorf("error saving stored messages: %w", err)
+			}
+		}
+		if err := setMailboxStates([]mailboxState{checkpoint}); err != nil {
+			return fmt.Errorf("error saving mailbox states: %w", err)
+		}
+		for ; next < advanced; next++ {
+			delete(stored, uids[next])
+		}
+		for _, rep := range reports {
+			result.Succeeded.AddNum(rep.UID)
+		}
+		for _, ie := range failed {
+			result.Failed.AddNum(imap.UID(ie.UID))
+		}
+		result.Stats.Reports += len(reports)
+		result.Stats.Errors += len(failed)
+		return nil
+	}
+	fetch := func(ctx context.Context, out chan<- rawMessage) error {
+		return fetchMessages(ctx, client, uids, fetchBatchSize(), out)
+	}
+	decode := func(raw rawMessage) decodedMessage {
+		return decodeIMAPMessage(account, state, raw)
+	}
+	err := runPipeline(account.Name, state.Folder, total, fetch, decode, store)
+	return result, err
+}
+
+// nextCheckpoint returns the state of a folder once the messages in stored are stored, and the index in
+// uids of the first message that is not. uids are the messages of the run in ascending order, the ones
+// before index next are stored already. The checkpoint stays below the first message that is not stored,
+// so it is fetched again by the next run, and moves to covered once all of them are stored.
+func nextCheckpoint(state mailboxState, covered uint32, uids []imap.UID, next int, stored map[imap.UID]bool) (mailboxState, int) {
+	for next < len(uids) && stored[uids[next]] {
+		next++
+	}
+	checkpoint := state
+	if next == len(uids) {
+		checkpoint.LastUID = covered
+	} else {
+		checkpoint.LastUID = max(state.LastUID, uint32(uids[next])-1)
+	}
+	return checkpoint, next
+}
+
+// runPipeline decodes the messages that fetch sends to a pool of workers and hands the
+// outcomes to store in batches. The channels between the stages are bounded, so only a
+// few batches are in memory at any time no matter how many messages there are.
+// store runs in the calling goroutine. It is called once more at the end with the remaining
+// messages (possibly none), unless fetch failed and nothing remains. An error of store stops
+// the pipeline. total is only used for progress logging and may be 0 if it is not known.
+func runPipeline(source, folder string, total int, fetch func(ctx context.Context, out chan<- rawMessage) error, decode func(raw rawMessage) decodedMessage, store func(msgs []decodedMessage) error) error {
+	batchSize := fetchBatchSize()
+	workers := decodeWorkers()
+	slog.Info("Fetching messages", "account", source, "folder", folder, "total", total, "batchSize", batchSize, "workers", workers)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	raws := make(chan rawMessage, workers)
+	decoded := make(chan decodedMessage, batchSize)
+	fetchDone := make(chan error, 1)
+	go func() {
+		defer close(raws)
+		fetchDone <- fetch(ctx, raws)
+	}()
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for raw := range raws {
+				select {
+				case decoded <- decode(raw):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(decoded)
+	}()
+
+	pending := make([]decodedMessage, 0, batchSize)
+	count := 0
+	for msg := range decoded {
+		count++
+		if Configuration.LogProgress > 0 && count%Configuration.LogProgress == 0 {
+			slog.Info("Processing messages:", "account", source, "folder", folder, "current", count, "total", total)
+		}
+		slog.Debug("Processing messages:", "current", count, "total", total, "uid", msg.UID, "path", msg.Path)
+		pending = append(pending, msg)
+		if len(pending) < batchSize {
+			continue
+		}
+		if err := store(pending); err != nil {
+			// Stop the fetcher and wait for it, the connection may be used again by the caller
+			cancel()
+			<-fetchDone
+			return err
+		}
+		pending = pending[:0]
+	}
+	// The decoders are done, so the fetcher is done as well
+	fetchErr := <-fetchDone
+	if len(pending) > 0 || fetchErr == nil {
+		if err := store(pending); err != nil {
+			return err
+		}
+	}
+	if fetchErr != nil {
+		slog.Error("fetch failed", "error", fetchErr)
+		return fmt.Errorf("fetch failed: %w", fetchErr)
+	}
+	return nil
+}
+
+// storeDecoded stores the reports and the ingest errors of a batch, the caller holds storeMutex
+// A report that cannot be stored is recorded as an ingest error instead. The reports that are stored
+// and all ingest errors are returned.
+func storeDecoded(reports []*fetchedReport, failed []*ingestError) ([]*fetchedReport, []*ingestError, error) {
+	aggregates := make([]*fetchedReport, 0, len(reports))
+	forensics := make([]*fetchedReport, 0)
+	tlsReports := make([]*fetchedReport, 0)
+	for _, rep := range reports {
+		switch {
+		case rep.Forensic != nil:
+			forensics = append(forensics, rep)
+		case rep.TLS != nil:
+			tlsReports = append(tlsReports, rep)
+		default:
+			aggregates = append(aggregates, rep)
+		}
+	}
+	stored := make([]*fetchedReport, 0, len(reports))
+	failed = append(make([]*ingestError, 0, len(failed)), failed...)
+	kinds := []struct {
+		name    string
+		reports []*fetchedReport
+		store   func([]*fetchedReport) ([]*fetchedReport, []*ingestError, error)
+	}{
+		{"reports", aggregates, storeReports},
+		{"forensic reports", forensics, storeForensicReports},
+		{"TLS reports", tlsReports, storeTLSReports},
+	}
+	for _, kind := range kinds {
+		if len(kind.reports) == 0 {
+			continue
+		}
+		ok, refused, err := kind.store(kind.reports)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error storing %s: %w", kind.name, err)
+		}
+		stored = append(stored, ok...)
+		failed = append(failed, refused...)
+	}
+	if len(failed) > 0 {
+		if err := storeIngestErrors(failed); err != nil {
+			return nil, nil, fmt.Errorf("error storing ingest errors: %w", err)
+		}
+	}
+	return stored, failed, nil
+}
+
+// fetchMessages fetches the messages in uids batch by batch and sends them to out
+// Messages are streamed from the server, not collected per batch. The sizes of a batch are
+// fetched first, of messages over the limits only the headers are fetched.
+func fetchMessages(ctx context.Context, client *imapclient.Client, uids []imap.UID, batchSize int, out chan<- rawMessage) error {
+	maxBytes := Configuration.limits().maxMessageBytes()
+	for start := 0; start < len(uids); start += batchSize {
+		batch := imap.UIDSetNum(uids[start:min(start+batchSize, len(uids))]...)
+		slog.Debug("Fetching batch", "uids", batch.String())
+		sizes, err := client.Fetch(batch, &imap.FetchOptions{UID: true, RFC822Size: true}).Collect()
+		if err != nil {
+			return err
+		}
+		var fitting, oversized imap.UIDSet
+		oversizes := make(map[imap.UID]int64)
+		for _, msg := range sizes {
+			if msg.RFC822Size > maxBytes {
+				oversized.AddNum(msg.UID)
+				oversizes[msg.UID] = msg.RFC822Size
+			} else {
+				fitting.AddNum(msg.UID)
+			}
+		}
+		if len(oversized) > 0 {
+			headerOnly := []imap.PartSpecifier{imap.PartSpecifierHeader}
+			if err := fetchSections(ctx, client, oversized, headerOnly, oversizes, out); err != nil {
+				return err
+			}
+		}
+		if len(fitting) > 0 {
+			complete := []imap.PartSpecifier{imap.PartSpecifierText, imap.PartSpecifierHeader}
+			if err := fetchSections(ctx, client, fitting, complete, nil, out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetchSections fetches the given sections of the messages in uids and sends them to out
+// oversizes holds the sizes of the messages that are over the limits.
+func fetchSections(ctx context.Context, client *imapclient.Client, uids imap.UIDSet, specifiers []imap.PartSpecifier, oversizes map[imap.UID]int64, out chan<- rawMessage) error {
+	fetchOptions := &imap.FetchOptions{UID: true}
+	for _, specifier := range specifiers {
+		fetchOptions.BodySection = append(fetchOptions.BodySection, &imap.FetchItemBodySection{Specifier: specifier})
+	}
+	cmd := client.Fetch(uids, fetchOptions)
+	for {
+		msg := cmd.Next()
+		if msg == nil {
+			break
+		}
+		buffer, err := msg.Collect()
+		if err != nil {
+			cmd.Close()
+			return err
+		}
+		raw := rawMessage{UID: buffer.UID, Oversized: oversizes[buffer.UID]}
+	bodyParts:
+		for section, body := range buffer.BodySection {
+			switch section.Specifier {
+			case imap.PartSpecifierText:
+				raw.Body = append(raw.Body, body...)
+			case imap.PartSpecifierHeader:
+				raw.Headers = body
+			default:
+				slog.Debug("Unknown body section", "section", section, "body", body)
+				continue bodyParts
+			}
+		}
+		select {
+		case out <- raw:
+		case <-ctx.Done():
+			cmd.Close()
+			return ctx.Err()
+		}
+	}
+	return cmd.Close()
+}
+
+// decodeIMAPMessage decodes a message fetched from an IMAP folder
+func decodeIMAPMessage(account ConfigIMAPAccount, state mailboxState, raw rawMessage) decodedMessage {
+	msg := decodedMessage{UID: raw.UID}
+	if raw.Oversized > 0 {
+		maxBytes := Configuration.limits().maxMessageBytes()
+		slog.Warn("message quarantined", "account", account.Name, "folder", state.Folder, "uid", raw.UID, "size", raw.Oversized, "max", maxBytes)
+		msg.Failed = newOversizedError(account.Name, state.Folder, uint32(raw.UID), imapURL(account.Name, state.Folder, state.UIDValidity, uint32(raw.UID)), raw.Headers, raw.Oversized, maxBytes)
+		return msg
+	}
+	rep, err := decodeReportMessage(raw.Headers, raw.Body)
+	if err != nil {
+		// One bad message should not cost us all the other reports
+		slog.Warn("message quarantined", "account", account.Name, "folder", state.Folder, "uid", raw.UID, "error", err)
+		rawMsg := append(append([]byte{}, raw.Headers...), raw.Body...)
+		msg.Failed = newIngestError(account.Name, state.Folder, uint32(raw.UID), imapURL(account.Name, state.Folder, state.UIDValidity, uint32(raw.UID)), rawMsg, err)
+		return msg
+	}
+	rep.Account = account.Name
+	rep.Folder = state.Folder
+	rep.UID = raw.UID
+	rep.Ref = imapURL(account.Name, state.Folder, state.UIDValidity, uint32(raw.UID))
+	msg.Report = rep
+	return msg
+}
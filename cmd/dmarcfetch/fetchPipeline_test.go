@@ -0,0 +1,205 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// testCount returns the number of rows in a table of the test database
+func testCount(t *testing.T, table string) int {
+	t.Helper()
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err := db.backendDB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+		t.Fatalf("counting %s: %v", table, err)
+	}
+	return count
+}
+
+func TestRefusedReportDoesNotStopTheBatch(t *testing.T) {
+	useTestDatabase(t)
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stands in for anything the database may refuse, like a value that is too long for its column
+	_, err = db.backendDB.Exec(`CREATE TRIGGER refuse_report BEFORE INSERT ON metadata WHEN NEW.report_id = 'refused'
+		BEGIN SELECT RAISE(ABORT, 'report refused'); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, user := startTestIMAPServer(t)
+	account.Actions.Failure.Move = "Failed"
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com first", "first"))
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com refused", "refused"))
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com last", "last"))
+
+	stats, err := syncAccount(account)
+	if err != nil {
+		t.Fatalf("syncAccount error: %v", err)
+	}
+	if stats.Reports != 2 || stats.Errors != 1 {
+		t.Fatalf("syncAccount stored %d reports and %d errors, want 2 and 1", stats.Reports, stats.Errors)
+	}
+	if count := testCount(t, "metadata"); count != 2 {
+		t.Errorf("metadata holds %d reports, want 2", count)
+	}
+	if count := testCount(t, "report_archive"); count != 2 {
+		t.Errorf("report_archive holds %d reports, want 2, the refused report must be rolled back", count)
+	}
+	if count := testCount(t, "ingest_errors"); count != 1 {
+		t.Errorf("ingest_errors holds %d rows, want 1", count)
+	}
+	want := []string{"Report Domain: example.com refused"}
+	if got := testFolderSubjects(t, account, "Failed"); !slices.Equal(got, want) {
+		t.Errorf("Failed holds %q, want %q", got, want)
+	}
+
+	// The checkpoint moved past the refused message
+	stats, err = syncAccount(account)
+	if err != nil {
+		t.Fatalf("second syncAccount error: %v", err)
+	}
+	if stats.Reports != 0 || stats.Errors != 0 {
+		t.Errorf("second syncAccount stored %d reports and %d errors, want nothing", stats.Reports, stats.Errors)
+	}
+}
+
+func TestNextCheckpoint(t *testing.T) {
+	state := mailboxState{Account: "test", Folder: "INBOX", UIDValidity: 7, LastUID: 2}
+	uids := []imap.UID{3, 5, 9}
+	tests := []struct {
+		name    string
+		next    int
+		stored  []imap.UID
+		lastUID uint32
+		index   int
+	}{
+		{"nothing stored", 0, nil, 2, 0},
+		{"first stored", 0, []imap.UID{3}, 4, 1},
+		// Decoders finish out of order, the checkpoint waits for the first message
+		{"later one stored", 0, []imap.UID{5}, 2, 0},
+		{"later one stored after the first", 1, []imap.UID{9}, 4, 1},
+		{"gap filled", 1, []imap.UID{5, 9}, 19, 3},
+		{"all stored", 0, []imap.UID{9, 3, 5}, 19, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := make(map[imap.UID]bool)
+			for _, uid := range tt.stored {
+				stored[uid] = true
+			}
+			checkpoint, index := nextCheckpoint(state, 19, uids, tt.next, stored)
+			if checkpoint.LastUID != tt.lastUID || index != tt.index {
+				t.Errorf("nextCheckpoint = LastUID %d and index %d, want %d and %d", checkpoint.LastUID, index, tt.lastUID, tt.index)
+			}
+			checkpoint.LastUID = state.LastUID
+			if checkpoint != state {
+				t.Errorf("nextCheckpoint changed more than LastUID: %+v", checkpoint)
+			}
+		})
+	}
+}
+
+func TestFailedBatchKeepsCheckpoint(t *testing.T) {
+	useTestDatabase(t)
+	useQuarantine(t)
+	previousBatchSize, previousWorkers := Configuration.FetchBatchSize, Configuration.DecodeWorkers
+	Configuration.FetchBatchSize, Configuration.DecodeWorkers = 1, 1
+	t.Cleanup(func() { Configuration.FetchBatchSize, Configuration.DecodeWorkers = previousBatchSize, previousWorkers })
+	refuseIngestErrors(t)
+
+	account, user := startTestIMAPServer(t)
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com first", "first"))
+	appendTestMessage(t, user, "INBOX", time.Now(), testTextMessage("Report Domain: example.com broken"))
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com last", "last"))
+
+	if _, err := syncAccount(account); err == nil {
+		t.Fatal("syncAccount succeeded, want the batch of the broken message to fail")
+	}
+	states, err := getMailboxStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := states[mailboxKey{Account: account.Name, Folder: "INBOX"}]; state.LastUID != 1 {
+		t.Errorf("checkpoint at UID %d, want 1, behind the batch that failed", state.LastUID)
+	}
+	if count := testCount(t, "metadata"); count != 1 {
+		t.Errorf("metadata holds %d reports, want the one before the failure", count)
+	}
+}
+
+// testLargeMessage returns a message of at least size bytes without a report
+func testLargeMessage(subject string, size int) string {
+	line := strings.Repeat("padding ", 8) + "\r\n"
+	return testTextMessage(subject) + strings.Repeat(line, size/len(line)+1)
+}
+
+func TestOversizedIMAPMessageIsNotRead(t *testing.T) {
+	useTestDatabase(t)
+	useLimits(t, ConfigLimits{MaxCompressedBytes: 4096}) // Messages up to 6144 bytes
+	useQuarantine(t)
+	account, user := startTestIMAPServer(t)
+	account.Actions.Failure.Move = "Failed"
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com small", "small"))
+	appendTestMessage(t, user, "INBOX", time.Now(), testLargeMessage("Report Domain: example.com large", 100000))
+
+	stats, err := syncAccount(account)
+	if err != nil {
+		t.Fatalf("syncAccount error: %v", err)
+	}
+	if stats.Reports != 1 || stats.Errors != 1 {
+		t.Fatalf("syncAccount stored %d reports and %d errors, want 1 and 1", stats.Reports, stats.Errors)
+	}
+	want := []string{"Report Domain: example.com large"}
+	if got := testFolderSubjects(t, account, "Failed"); !slices.Equal(got, want) {
+		t.Errorf("Failed holds %q, want %q", got, want)
+	}
+	checkOversizedError(t, "Report Domain: example.com large", 100000)
+}
+
+// useQuarantine saves the messages of ingest errors in a new directory until the test ends
+func useQuarantine(t *testing.T) {
+	t.Helper()
+	previous := Configuration.QuarantineDir
+	Configuration.QuarantineDir = t.TempDir()
+	t.Cleanup(func() { Configuration.QuarantineDir = previous })
+}
+
+// checkOversizedError checks the ingest error of a message that was skipped for its size
+// Only the headers may have been read: they give the subject, the padding of the body must not be
+// in the quarantine.
+func checkOversizedError(t *testing.T, subject string, minSize int) {
+	t.Helper()
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, ref := "", ""
+	size := 0
+	err = db.backendDB.QueryRow(`SELECT error, raw_ref, raw_size FROM ingest_errors WHERE subject = $1`, subject).Scan(&message, &ref, &size)
+	if err != nil {
+		t.Fatalf("no ingest error for %q: %v", subject, err)
+	}
+	if !strings.Contains(message, "is larger than") {
+		t.Errorf("ingest error %q, want the message refused for its size", message)
+	}
+	if size < minSize {
+		t.Errorf("ingest error records %d bytes, want the size of the message", size)
+	}
+	quarantined, err := os.ReadFile(ref)
+	if err != nil {
+		t.Fatalf("reading the quarantined headers: %v", err)
+	}
+	if strings.Contains(string(quarantined), "padding") {
+		t.Errorf("the body of the message was read")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	fileSourceDir     = "dir"
+	fileSourceMaildir = "maildir"
+	fileSourceMbox    = "mbox"
+
+	defaultWatchInterval = 10 // Seconds between scans of a watched file source
+)
+
+// syncFileSource reads the new and changed files of a local source, stores the reports in them
+// and records the files as imported, so they are skipped next time
+func syncFileSource(source ConfigFileSource) (syncStats, error) {
+	stats := syncStats{}
+	storeMutex.Lock()
+	imported, err := getImportedFiles(source.Name)
+	storeMutex.Unlock()
+	if err != nil {
+		return stats, fmt.Errorf("error getting imported files: %w", err)
+	}
+	files, err := listSourceFiles(source)
+	if err != nil {
+		return stats, err
+	}
+	files = slices.DeleteFunc(files, func(file importedFile) bool {
+		previous, ok := imported[file.Path]
+		return ok && previous.Size == file.Size && previous.Modified == file.Modified
+	})
+	if len(files) == 0 {
+		slog.Debug("no new files", "source", source.Name)
+		return stats, nil
+	}
+
+	timer := time.Now()
+	var fetch func(ctx context.Context, out chan<- rawMessage) error
+	total := len(files)
+	if source.Type == fileSourceMbox {
+		fetch = func(ctx context.Context, out chan<- rawMessage) error {
+			for _, file := range files {
+				if err := readMbox(ctx, file.Path, out); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		total = 0 // The number of messages is not known in advance
+	} else {
+		limits := Configuration.limits()
+		fetch = func(ctx context.Context, out chan<- rawMessage) error {
+			for _, file := range files {
+				raw := rawMessage{Path: file.Path}
+				if file.Size > limits.maxFileBytes(file.Path) {
+					raw.Oversized = file.Size
+				} else {
+					data, err := os.ReadFile(file.Path)
+					if err != nil {
+						return err
+					}
+					raw.Body = data
+				}
+				select {
+				case out <- raw:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		}
+	}
+	decode := func(raw rawMessage) decodedMessage {
+		return decodeFileMessage(source, raw)
+	}
+	byPath := make(map[string]importedFile, len(files))
+	for _, file := range files {
+		byPath[file.Path] = file
+	}
+	store := func(msgs []decodedMessage) error {
+		reports := make([]*fetchedReport, 0, len(msgs))
+		failed := make([]*ingestError, 0)
+		done := make([]importedFile, 0, len(msgs))
+		for _, msg := range msgs {
+			if msg.Report != nil {
+				reports = append(reports, msg.Report)
+			} else {
+				failed = append(failed, msg.Failed)
+			}
+			if source.Type != fileSourceMbox {
+				done = append(done, byPath[msg.Path])
+			}
+		}
+		storeMutex.Lock()
+		defer storeMutex.Unlock()
+		reports, failed, err := storeDecoded(reports, failed)
+		if err != nil {
+			return err
+		}
+		if err := setImportedFiles(done); err != nil {
+			return fmt.Errorf("error saving imported files: %w", err)
+		}
+		stats.Reports += len(reports)
+		stats.Errors += len(failed)
+		return nil
+	}
+	if err := runPipeline(source.Name, source.Path, total, fetch, decode, store); err != nil {
+		return stats, err
+	}
+	if source.Type == fileSourceMbox {
+		// An mbox file is only done once all its messages are stored
+		storeMutex.Lock()
+		err = setImportedFiles(files)
+		storeMutex.Unlock()
+		if err != nil {
+			return stats, fmt.Errorf("error saving imported files: %w", err)
+		}
+	}
+	slog.Info("finished", "source", source.Name, "files", len(files), "reports", stats.Reports, "errors", stats.Errors, "duration", time.Since(timer))
+	return stats, nil
+}
+
+// watchFileSource reads a file source every WatchInterval seconds and never returns
+func watchFileSource(source ConfigFileSource) {
+	for {
+		if _, err := syncFileSource(source); err != nil {
+			slog.Error("error reading file source", "source", source.Name, "error", err)
+		}
+		time.Sleep(time.Duration(source.WatchInterval) * time.Second)
+	}
+}
+
+// listSourceFiles returns the files of a source that may contain reports
+// A directory is searched recursively for messages (.eml) and report files (.xml, .zip, .gz and .json),
+// a Maildir contributes every message in cur and new, an mbox is a single file.
+func listSourceFiles(source ConfigFileSource) ([]importedFile, error) {
+	files := make([]importedFile, 0)
+	add := func(path string, info fs.FileInfo) {
+		files = append(files, importedFile{
+			Source:   source.Name,
+			Path:     path,
+			Size:     info.Size(),
+			Modified: info.ModTime().UnixNano(),
+		})
+	}
+	switch source.Type {
+	case fileSourceDir:
+		err := filepath.WalkDir(source.Path, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			ext := strings.ToLower(filepath.Ext(path))
+			if _, ok := reportFileTypes[ext]; !ok && ext != ".eml" {
+				slog.Debug("skipping file", "source", source.Name, "path", path)
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			add(path, info)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading directory: %w", err)
+		}
+	case fileSourceMaildir:
+		for _, sub := range []string{"cur", "new"} {
+			entries, err := os.ReadDir(filepath.Join(source.Path, sub))
+			if err != nil {
+				return nil, fmt.Errorf("error reading maildir: %w", err)
+			}
+			for _, entry := range entries {
+				if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+					continue
+				}
+				info, err := entry.Info()
+				if err != nil {
+					return nil, fmt.Errorf("error reading maildir: %w", err)
+				}
+				add(filepath.Join(source.Path, sub, entry.Name()), info)
+			}
+		}
+	case fileSourceMbox:
+		info, err := os.Stat(source.Path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading mbox: %w", err)
+		}
+		add(source.Path, info)
+	default:
+		return nil, fmt.Errorf("unknown file source type '%s'", source.Type)
+	}
+	return files, nil
+}
+
+// readMbox sends every message in an mbox file to out
+// Both mboxo and mboxrd are understood: the From_ lines separate the messages and one '>'
+// is removed from quoted From_ lines in the body. Of a message over the limits only the headers
+// are kept.
+func readMbox(ctx context.Context, path string, out chan<- rawMessage) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	maxBytes := Configuration.limits().maxMessageBytes()
+	reader := bufio.NewReader(file)
+	var message *bytes.Buffer
+	size := int64(0) // Of the message, also what was not kept
+	index := 0
+	send := func() error {
+		if message == nil {
+			return nil
+		}
+		index++
+		// The empty line before the next From_ line belongs to the separator
+		raw := rawMessage{Path: path, Index: index, Body: bytes.TrimSuffix(message.Bytes(), []byte("\n"))}
+		if size > maxBytes {
+			raw.Headers, _ = splitMessage(raw.Body)
+			raw.Body = nil
+			raw.Oversized = size
+		}
+		select {
+		case out <- raw:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if err := send(); err != nil {
+					return err
+				}
+				message = &bytes.Buffer{}
+				size = 0
+			case message == nil:
+				return fmt.Errorf("%s is not an mbox file", path)
+			default:
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				size += int64(len(line))
+				if size <= maxBytes {
+					message.Write(line)
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return send()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decodeFileMessage decodes a file, or a message from an mbox file, of a file source
+func decodeFileMessage(source ConfigFileSource, raw rawMessage) decodedMessage {
+	msg := decodedMessage{Path: raw.Path}
+	name := raw.Path
+	ref := raw.Path
+	if source.Type == fileSourceMbox {
+		name = "" // Always a message, whatever the name of the mbox file
+		ref = fmt.Sprintf("%s#%d", raw.Path, raw.Index)
+	}
+	folder, err := filepath.Rel(source.Path, raw.Path)
+	if err != nil || folder == "." {
+		folder = filepath.Base(raw.Path)
+	}
+	if raw.Oversized > 0 {
+		maxBytes := Configuration.limits().maxFileBytes(name)
+		slog.Warn("file quarantined", "source", source.Name, "path", ref, "size", raw.Oversized, "max", maxBytes)
+		msg.Failed = newOversizedError(source.Name, folder, uint32(raw.Index), ref, raw.Headers, raw.Oversized, maxBytes)
+		return msg
+	}
+	rep, err := decodeReportFile(name, raw.Body)
+	if err != nil {
+		slog.Warn("file quarantined", "source", source.Name, "path", ref, "error", err)
+		msg.Failed = newIngestError(source.Name, folder, uint32(raw.Index), ref, raw.Body, err)
+		return msg
+	}
+	rep.Account = source.Name
+	rep.Folder = folder
+	rep.Ref = ref
+	msg.Report = rep
+	return msg
+}
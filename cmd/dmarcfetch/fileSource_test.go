@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOversizedFilesAreNotRead(t *testing.T) {
+	useTestDatabase(t)
+	useLimits(t, ConfigLimits{MaxCompressedBytes: 4096}) // Report files up to 4096 bytes, messages up to 6144
+	useQuarantine(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"small.eml": testReportMessage("Report Domain: example.com small", "small"),
+		"large.eml": testLargeMessage("Report Domain: example.com large", 100000),
+		// A message of this size would be read, a report file not
+		"large.xml": strings.Replace(testAggregateXML("large"), "</feedback>", strings.Repeat(" ", 5000)+"</feedback>", 1),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := syncFileSource(ConfigFileSource{Name: "files", Type: fileSourceDir, Path: dir})
+	if err != nil {
+		t.Fatalf("syncFileSource error: %v", err)
+	}
+	if stats.Reports != 1 || stats.Errors != 2 {
+		t.Fatalf("syncFileSource stored %d reports and %d errors, want 1 and 2", stats.Reports, stats.Errors)
+	}
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"large.eml", "large.xml"} {
+		path := filepath.Join(dir, name)
+		message := ""
+		if err := db.backendDB.QueryRow(`SELECT error FROM ingest_errors WHERE raw_ref = $1`, path).Scan(&message); err != nil {
+			t.Errorf("no ingest error referring to %s: %v", name, err)
+		} else if !strings.Contains(message, "is larger than") {
+			t.Errorf("ingest error %q for %s, want it refused for its size", message, name)
+		}
+	}
+}
+
+func TestOversizedMboxMessageIsSkipped(t *testing.T) {
+	useTestDatabase(t)
+	useLimits(t, ConfigLimits{MaxCompressedBytes: 4096})
+	useQuarantine(t)
+	mbox := ""
+	for _, msg := range []string{
+		testReportMessage("Report Domain: example.com first", "first"),
+		testLargeMessage("Report Domain: example.com large", 100000),
+		testReportMessage("Report Domain: example.com last", "last"),
+	} {
+		mbox += "From dmarc@example.com Tue Nov 14 00:00:00 2023\n" + strings.ReplaceAll(msg, "\r\n", "\n") + "\n"
+	}
+	path := filepath.Join(t.TempDir(), "reports.mbox")
+	if err := os.WriteFile(path, []byte(mbox), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := syncFileSource(ConfigFileSource{Name: "mbox", Type: fileSourceMbox, Path: path})
+	if err != nil {
+		t.Fatalf("syncFileSource error: %v", err)
+	}
+	if stats.Reports != 2 || stats.Errors != 1 {
+		t.Fatalf("syncFileSource stored %d reports and %d errors, want 2 and 1", stats.Reports, stats.Errors)
+	}
+	checkOversizedError(t, "Report Domain: example.com large", 95000) // Smaller by the line endings
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// forensicReport is a DMARC failure report: an ARF feedback report (RFC 5965) with the
+// authentication failure extensions of RFC 6591, and the headers of the failed message
+type forensicReport struct {
+	Hash                  string // SHA-256 of the feedback report and the original headers, identifies the report
+	Reporter              string // From of the report message
+	FeedbackType          string
+	UserAgent             string
+	Version               string
+	ArrivalDate           time.Time
+	ReportingMTA          string
+	SourceIP              string
+	Incidents             int
+	ReportedDomain        string
+	ReportedURI           string
+	AuthFailure           string
+	DeliveryResult        string
+	AuthenticationResults string
+	OriginalEnvelopeID    string
+	OriginalMailFrom      string
+	OriginalRcptTo        string
+	DKIMDomain            string
+	DKIMIdentity          string
+	DKIMSelector          string
+	SPFDNS                string
+	IdentityAlignment     string
+	OriginalHeaders       []forensicHeader
+}
+
+// forensicHeader is one header of the message that failed authentication, in the original order
+type forensicHeader struct {
+	Name  string
+	Value string
+}
+
+const (
+	contentTypeMultipartReport = "multipart/report"
+	contentTypeFeedbackReport  = "message/feedback-report"
+	contentTypeRFC822          = "message/rfc822"
+	contentTypeRFC822Headers   = "text/rfc822-headers"
+)
+
+// isForensicReport returns the boundary of the message if it is an ARF feedback report
+func isForensicReport(header mail.Header) (string, bool) {
+	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || contentType != contentTypeMultipartReport || !strings.EqualFold(params["report-type"], "feedback-report") {
+		return "", false
+	}
+	return params["boundary"], params["boundary"] != ""
+}
+
+// decodeForensicReport parses the parts of a multipart/report message with a feedback report
+// The human readable part is ignored, the original message is only kept for its headers.
+func decodeForensicReport(header mail.Header, body []byte, boundary string) (*forensicReport, error) {
+	forensic := &forensicReport{}
+	if from, err := mail.ParseAddress(header.Get("From")); err == nil {
+		forensic.Reporter = from.Address
+	}
+	var feedback, original []byte
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading report part failed: %w", err)
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch contentType {
+		case contentTypeFeedbackReport:
+			feedback, err = readPart(part)
+		case contentTypeRFC822, contentTypeRFC822Headers:
+			original, err = readPart(part)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s part failed: %w", contentType, err)
+		}
+	}
+	if feedback == nil {
+		return nil, fmt.Errorf("no %s part found", contentTypeFeedbackReport)
+	}
+
+	// The feedback report has the same syntax as a message header
+	fields, err := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(feedback), strings.NewReader("\r\n\r\n")))).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parsing feedback report failed: %w", err)
+	}
+	get := func(key string) string {
+		return strings.TrimSpace(fields.Get(key))
+	}
+	forensic.FeedbackType = get("Feedback-Type")
+	forensic.UserAgent = get("User-Agent")
+	forensic.Version = get("Version")
+	forensic.ReportingMTA = get("Reporting-MTA")
+	forensic.SourceIP = get("Source-IP")
+	forensic.ReportedDomain = strings.ToLower(get("Reported-Domain"))
+	forensic.ReportedURI = get("Reported-URI")
+	forensic.AuthFailure = get("Auth-Failure")
+	forensic.DeliveryResult = get("Delivery-Result")
+	forensic.AuthenticationResults = get("Authentication-Results")
+	forensic.OriginalEnvelopeID = get("Original-Envelope-Id")
+	forensic.OriginalMailFrom = strings.Trim(get("Original-Mail-From"), "<>")
+	recipients := make([]string, 0)
+	for _, recipient := range fields.Values("Original-Rcpt-To") {
+		recipients = append(recipients, strings.Trim(strings.TrimSpace(recipient), "<>"))
+	}
+	forensic.OriginalRcptTo = strings.Join(recipients, ", ")
+	forensic.DKIMDomain = get("DKIM-Domain")
+	forensic.DKIMIdentity = get("DKIM-Identity")
+	forensic.DKIMSelector = get("DKIM-Selector")
+	forensic.SPFDNS = get("SPF-DNS")
+	forensic.IdentityAlignment = get("Identity-Alignment")
+	fmt.Sscan(get("Incidents"), &forensic.Incidents)
+	if forensic.Incidents == 0 {
+		forensic.Incidents = 1
+	}
+	// RFC 5965 requires these fields in every feedback report, RFC 6591 adds Auth-Failure
+	for _, required := range []string{"Feedback-Type", "User-Agent", "Version"} {
+		if get(required) == "" {
+			return nil, fmt.Errorf("feedback report lacks the required field %s", required)
+		}
+	}
+	if !strings.EqualFold(forensic.FeedbackType, "auth-failure") {
+		return nil, fmt.Errorf("unsupported feedback type '%s'", forensic.FeedbackType)
+	}
+	if forensic.AuthFailure == "" {
+		return nil, fmt.Errorf("feedback report lacks the required field Auth-Failure")
+	}
+
+	// The arrival date is optional, fall back to the date of the report
+	forensic.ArrivalDate, err = mail.ParseDate(get("Arrival-Date"))
+	if err != nil {
+		forensic.ArrivalDate, err = mail.ParseDate(get("Received-Date"))
+	}
+	if err != nil {
+		forensic.ArrivalDate, _ = mail.ParseDate(header.Get("Date"))
+	}
+
+	if original != nil {
+		forensic.OriginalHeaders = parseOriginalHeaders(original)
+	}
+	hash := sha256.New()
+	hash.Write(feedback)
+	hash.Write(original)
+	forensic.Hash = hex.EncodeToString(hash.Sum(nil))
+	return forensic, nil
+}
+
+// readPart returns the body of a MIME part with its transfer encoding removed
+func readPart(part *multipart.Part) ([]byte, error) {
+	// multipart already decodes quoted-printable (and hides the header), only base64 is left
+	var reader io.Reader = part
+	if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+		reader = base64.NewDecoder(base64.StdEncoding, part)
+	}
+	return io.ReadAll(reader)
+}
+
+// parseOriginalHeaders returns the headers of the original message in order, unfolded
+// Everything after the first empty line (the body, if included) is ignored.
+func parseOriginalHeaders(original []byte) []forensicHeader {
+	headers := make([]forensicHeader, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(original))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		headers = append(headers, forensicHeader{
+			Name:  strings.TrimSpace(name),
+			Value: decodeMimeSentence(strings.TrimSpace(value)),
+		})
+	}
+	return headers
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeForensicReport(t *testing.T) {
+	tests := []struct {
+		file    string
+		want    *forensicReport // Without Hash and ArrivalDate
+		arrival time.Time
+		err     string
+	}{
+		{
+			file: "arf-headers.eml",
+			want: &forensicReport{
+				Reporter:              "dmarc-failures@reporter.example",
+				FeedbackType:          "auth-failure",
+				UserAgent:             "reporter-arf/1.0",
+				Version:               "1",
+				ReportingMTA:          "dns; mx.reporter.example",
+				SourceIP:              "192.0.2.25",
+				Incidents:             3,
+				ReportedDomain:        "example.com",
+				AuthFailure:           "dkim",
+				DeliveryResult:        "reject",
+				AuthenticationResults: "mx.reporter.example; dkim=fail header.d=example.com",
+				OriginalMailFrom:      "bounce@example.com",
+				OriginalRcptTo:        "alice@reporter.example, bob@reporter.example",
+				DKIMDomain:            "example.com",
+				DKIMIdentity:          "@example.com",
+				DKIMSelector:          "s2023",
+				IdentityAlignment:     "dkim",
+				OriginalHeaders: []forensicHeader{
+					{"From", "Example Newsletter <news@example.com>"},
+					{"To", "alice@reporter.example"},
+					{"Subject", "Café news"},
+					{"Date", "Tue, 14 Nov 2023 22:13:19 +0000"},
+					{"DKIM-Signature", "v=1; a=rsa-sha256; d=example.com; s=s2023; h=from:to:subject; bh=placeholder=; b=placeholder="},
+					{"Message-ID", "<newsletter-1@example.com>"},
+				},
+			},
+			arrival: time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC),
+		},
+		{
+			// Without an Arrival-Date the date of the report is used, the body of the original message is dropped
+			file: "arf-rfc822.eml",
+			want: &forensicReport{
+				Reporter:           "dmarc-failures@reporter.example",
+				FeedbackType:       "auth-failure",
+				UserAgent:          "reporter-arf/1.0",
+				Version:            "1",
+				SourceIP:           "198.51.100.7",
+				Incidents:          1,
+				ReportedDomain:     "example.com",
+				ReportedURI:        "mailto:abuse@example.com",
+				AuthFailure:        "spf",
+				OriginalEnvelopeID: "envelope-7",
+				OriginalMailFrom:   "spoofer@example.com",
+				OriginalRcptTo:     "",
+				SPFDNS:             `txt : example.com : "v=spf1 -all"`,
+				OriginalHeaders: []forensicHeader{
+					{"From", "spoofer@example.com"},
+					{"To", "carol@reporter.example"},
+					{"Subject", "Invoice"},
+					{"Date", "Wed, 15 Nov 2023 07:59:00 +0000"},
+				},
+			},
+			arrival: time.Date(2023, 11, 15, 8, 0, 0, 0, time.UTC),
+		},
+		{file: "arf-missing-fields.eml", err: "feedback report lacks the required field User-Agent"},
+		// A bounce is a multipart/report as well, but not a feedback report
+		{file: "delivery-status.eml", err: "no attachment found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			rep, err := decodeReportFile("", readTestdata(t, filepath.Join("forensic", tt.file)))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("decode error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode error: %v", err)
+			}
+			got := rep.Forensic
+			if got == nil {
+				t.Fatalf("decoded %+v, want a forensic report", rep)
+			}
+			if len(got.Hash) != 64 {
+				t.Errorf("hash %q, want a hex SHA-256", got.Hash)
+			}
+			if !got.ArrivalDate.Equal(tt.arrival) {
+				t.Errorf("arrival date %v, want %v", got.ArrivalDate, tt.arrival)
+			}
+			decoded := *got
+			decoded.Hash, decoded.ArrivalDate = "", time.Time{}
+			if !reflect.DeepEqual(&decoded, tt.want) {
+				t.Errorf("decoded\n%+v\nwant\n%+v", &decoded, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreForensicReports(t *testing.T) {
+	useTestDatabase(t)
+	reps := make([]*fetchedReport, 0)
+	for _, file := range []string{"arf-headers.eml", "arf-rfc822.eml"} {
+		rep, err := decodeReportFile("", readTestdata(t, filepath.Join("forensic", file)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep.Account, rep.Folder = "test", "INBOX"
+		reps = append(reps, rep)
+	}
+	stored, failed, err := storeForensicReports(reps)
+	if err != nil || len(stored) != 2 || len(failed) != 0 {
+		t.Fatalf("storeForensicReports stored %d and refused %d (%v), want both stored", len(stored), len(failed), err)
+	}
+	// The same reports again are skipped
+	stored, failed, err = storeForensicReports(reps)
+	if err != nil || len(stored) != 2 || len(failed) != 0 {
+		t.Fatalf("storing again stored %d and refused %d (%v), want both skipped", len(stored), len(failed), err)
+	}
+	if count := testCount(t, "forensic_report"); count != 2 {
+		t.Errorf("forensic_report holds %d rows, want 2", count)
+	}
+	if count := testCount(t, "forensic_header"); count != 10 {
+		t.Errorf("forensic_header holds %d rows, want 10", count)
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reporter, sourceIP, domain, authFailure, rcptTo, account, folder string
+	var arrival int64
+	var incidents int
+	err = db.backendDB.QueryRow(`SELECT reporter, source_ip, reported_domain, auth_failure, original_rcpt_to, arrival_date, incidents, account, folder
+		FROM forensic_report WHERE report_hash = ?`, reps[0].Forensic.Hash).Scan(&reporter, &sourceIP, &domain, &authFailure, &rcptTo, &arrival, &incidents, &account, &folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reporter != "dmarc-failures@reporter.example" || sourceIP != "192.0.2.25" || domain != "example.com" || authFailure != "dkim" ||
+		rcptTo != "alice@reporter.example, bob@reporter.example" || arrival != 1700000000 || incidents != 3 || account != "test" || folder != "INBOX" {
+		t.Errorf("stored %s %s %s %s %q %d %d %s %s", reporter, sourceIP, domain, authFailure, rcptTo, arrival, incidents, account, folder)
+	}
+
+	rows, err := db.backendDB.Query(`SELECT name FROM forensic_header WHERE report_hash = ? ORDER BY position`, reps[1].Forensic.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	names := make([]string, 0)
+	for rows.Next() {
+		name := ""
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if want := []string{"From", "To", "Subject", "Date"}; !slices.Equal(names, want) {
+		t.Errorf("headers of the rfc822 report %q, want %q", names, want)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// applyActions runs the success action on the stored messages and the failure action on the messages
+// that could not be decoded
+func applyActions(client *imapclient.Client, account ConfigIMAPAccount, succeeded, failed imap.UIDSet) error {
+	if err := applyAction(client, account.Actions.Success, succeeded); err != nil {
+		return fmt.Errorf("success action failed: %w", err)
+	}
+	if err := applyAction(client, account.Actions.Failure, failed); err != nil {
+		return fmt.Errorf("failure action failed: %w", err)
+	}
+	return nil
+}
+
+// applyRetention expunges the processed messages that are older than the retention age
+// Only the success and failure folders are emptied, anything else in there was moved by us. When stored
+// messages stay in the folder of state, only those recorded by addStoredUIDs are deleted there, never
+// mail that was not a report or that could not be decoded. Afterwards the folder of state is selected
+// again, so the caller can continue where it was.
+func applyRetention(client *imapclient.Client, account ConfigIMAPAccount, state mailboxState) error {
+	days := account.Actions.RetentionDays
+	if days <= 0 {
+		return nil
+	}
+	if account.Actions.Success.Move == "" {
+		if err := expungeStored(client, state, days); err != nil {
+			return fmt.Errorf("retention failed in %s: %w", state.Folder, err)
+		}
+	}
+
+	destinations := make([]string, 0, 2)
+	for _, destination := range []string{account.Actions.Success.Move, account.Actions.Failure.Move} {
+		if destination != "" && destination != state.Folder && !slices.Contains(destinations, destination) {
+			destinations = append(destinations, destination)
+		}
+	}
+	if len(destinations) == 0 {
+		return nil
+	}
+	for _, destination := range destinations {
+		mailboxes, err := client.List("", destination, nil).Collect()
+		if err != nil {
+			return fmt.Errorf("list failed: %w", err)
+		}
+		if len(mailboxes) == 0 {
+			// Nothing was moved there yet
+			continue
+		}
+		if _, err := client.Select(destination, nil).Wait(); err != nil {
+			return fmt.Errorf("select failed: %w", err)
+		}
+		if _, err := expungeOlderThan(client, nil, days); err != nil {
+			return fmt.Errorf("retention failed in %s: %w", destination, err)
+		}
+	}
+	if _, err := client.Select(state.Folder, nil).Wait(); err != nil {
+		return fmt.Errorf("select failed: %w", err)
+	}
+	return nil
+}
+
+// expungeStored deletes the messages in the selected folder whose report is stored and that arrived
+// more than days ago, and forgets them
+func expungeStored(client *imapclient.Client, state mailboxState, days int) error {
+	stored, err := getStoredUIDs(state)
+	if err != nil {
+		return fmt.Errorf("error getting stored messages: %w", err)
+	}
+	if len(stored) == 0 {
+		return nil
+	}
+	uids := imap.UIDSet{}
+	for _, uid := range stored {
+		uids.AddNum(imap.UID(uid))
+	}
+	// Messages that someone else deleted are forgotten as well
+	searchData, err := client.UIDSearch(&imap.SearchCriteria{UID: []imap.UIDSet{uids}}, nil).Wait()
+	if err != nil {
+		return fmt.Errorf("search failed: %w", err)
+	}
+	existing := searchData.AllUIDs()
+	expunged := make([]imap.UID, 0)
+	if len(existing) > 0 {
+		expunged, err = expungeOlderThan(client, imap.UIDSetNum(existing...), days)
+		if err != nil {
+			return err
+		}
+	}
+	gone := make([]uint32, 0)
+	for _, uid := range stored {
+		if !slices.Contains(existing, imap.UID(uid)) || slices.Contains(expunged, imap.UID(uid)) {
+			gone = append(gone, uid)
+		}
+	}
+	return removeStoredUIDs(state, gone)
+}
+
+// applyAction sets the flags and keywords of an action on the messages in the selected folder
+// and then moves them if the action has a destination folder
+func applyAction(client *imapclient.Client, action ConfigAction, uids imap.UIDSet) error {
+	if len(uids) == 0 || !action.enabled() {
+		return nil
+	}
+	flags := make([]imap.Flag, 0, len(action.Keywords)+1)
+	if action.Seen {
+		flags = append(flags, imap.FlagSeen)
+	}
+	for _, keyword := range action.Keywords {
+		flags = append(flags, imap.Flag(keyword))
+	}
+	if len(flags) > 0 {
+		slog.Debug("setting flags", "uids", uids, "flags", flags)
+		err := client.Store(uids, &imap.StoreFlags{
+			Op:     imap.StoreFlagsAdd,
+			Silent: true,
+			Flags:  flags,
+		}, nil).Close()
+		if err != nil {
+			return fmt.Errorf("store failed: %w", err)
+		}
+	}
+	if action.Move != "" {
+		return moveMessages(client, uids, action.Move)
+	}
+	return nil
+}
+
+// moveMessages moves messages from the selected folder to another folder, which is created if needed
+// MOVE is used if the server supports it, otherwise the messages are copied and only then deleted
+func moveMessages(client *imapclient.Client, uids imap.UIDSet, destination string) error {
+	if err := ensureFolder(client, destination); err != nil {
+		return err
+	}
+	slog.Debug("moving messages", "uids", uids, "destination", destination)
+	caps := client.Caps()
+	if caps.Has(imap.CapMove) || caps.Has(imap.CapIMAP4rev2) {
+		if _, err := client.Move(uids, destination).Wait(); err != nil {
+			return fmt.Errorf("move failed: %w", err)
+		}
+		return nil
+	}
+
+	// The messages may only be deleted once we know the copy succeeded
+	if _, err := client.Copy(uids, destination).Wait(); err != nil {
+		return fmt.Errorf("copy failed: %w", err)
+	}
+	return deleteMessages(client, uids)
+}
+
+// deleteMessages flags messages in the selected folder as deleted and expunges them
+// Without UIDPLUS the messages are only flagged: EXPUNGE would remove every message flagged as deleted
+// in the folder, also those someone else flagged and may still undelete.
+func deleteMessages(client *imapclient.Client, uids imap.UIDSet) error {
+	err := client.Store(uids, &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Silent: true,
+		Flags:  []imap.Flag{imap.FlagDeleted},
+	}, nil).Close()
+	if err != nil {
+		return fmt.Errorf("store failed: %w", err)
+	}
+	caps := client.Caps()
+	if !caps.Has(imap.CapUIDPlus) && !caps.Has(imap.CapIMAP4rev2) {
+		slog.Warn("server does not support UIDPLUS, messages are flagged as deleted but not expunged", "uids", uids)
+		return nil
+	}
+	if err := client.UIDExpunge(uids).Close(); err != nil {
+		return fmt.Errorf("expunge failed: %w", err)
+	}
+	return nil
+}
+
+// expungeOlderThan deletes the messages in the selected folder that arrived more than days ago
+// When uids is set only those messages are considered. The UIDs of the deleted messages are returned.
+func expungeOlderThan(client *imapclient.Client, uids imap.UIDSet, days int) ([]imap.UID, error) {
+	criteria := &imap.SearchCriteria{
+		Before: time.Now().AddDate(0, 0, -days),
+	}
+	if uids != nil {
+		criteria.UID = []imap.UIDSet{uids}
+	}
+	searchData, err := client.UIDSearch(criteria, nil).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %w", err)
+	}
+	old := searchData.AllUIDs()
+	if len(old) == 0 {
+		return nil, nil
+	}
+	slog.Info("expunging old messages", "count", len(old), "days", days)
+	return old, deleteMessages(client, imap.UIDSetNum(old...))
+}
+
+// ensureFolder creates a folder if it does not exist yet
+func ensureFolder(client *imapclient.Client, folder string) error {
+	mailboxes, err := client.List("", folder, nil).Collect()
+	if err != nil {
+		return fmt.Errorf("list failed: %w", err)
+	}
+	if len(mailboxes) > 0 {
+		return nil
+	}
+	slog.Info("creating folder", "folder", folder)
+	if err := client.Create(folder, nil).Wait(); err != nil {
+		return fmt.Errorf("create failed: %w", err)
+	}
+	return nil
+}
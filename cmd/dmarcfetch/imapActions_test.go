@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+)
+
+// startTestIMAPServer starts an in-memory IMAP server with an empty INBOX and returns an account for it
+func startTestIMAPServer(t *testing.T) (ConfigIMAPAccount, *imapmemserver.User) {
+	t.Helper()
+	return startTestIMAPServerWithCaps(t, imap.CapSet{imap.CapIMAP4rev1: {}, imap.CapIMAP4rev2: {}})
+}
+
+// startTestIMAPServerWithCaps starts the test IMAP server announcing only caps
+func startTestIMAPServerWithCaps(t *testing.T, caps imap.CapSet) (ConfigIMAPAccount, *imapmemserver.User) {
+	t.Helper()
+	memServer := imapmemserver.New()
+	user := imapmemserver.NewUser("user", "password")
+	if err := user.Create("INBOX", nil); err != nil {
+		t.Fatal(err)
+	}
+	memServer.AddUser(user)
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		},
+		Caps:         caps,
+		InsecureAuth: true,
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	config := ConfigDatabase{Accounts: []ConfigIMAPAccount{{
+		Name:     "test",
+		Address:  host,
+		Port:     port,
+		Username: "user",
+		Password: "password",
+		Folders:  []string{"INBOX"},
+		TLS:      ConfigTLS{Mode: tlsModeNone},
+	}}}
+	return config.imapAccounts()[0], user
+}
+
+// appendTestMessage adds a message to a folder of the test server as if it arrived at received
+func appendTestMessage(t *testing.T, user *imapmemserver.User, folder string, received time.Time, msg string) {
+	t.Helper()
+	if _, err := user.Append(folder, bytes.NewReader([]byte(msg)), &imap.AppendOptions{Time: received}); err != nil {
+		t.Fatalf("appending to %s: %v", folder, err)
+	}
+}
+
+// testFolderSubjects returns the subjects of the messages in a folder of the test server
+func testFolderSubjects(t *testing.T, account ConfigIMAPAccount, folder string) []string {
+	t.Helper()
+	return testFolderSubjectsFlagged(t, account, folder, "")
+}
+
+// testFolderSubjectsFlagged returns the subjects of the messages in a folder of the test server that
+// have flag, or of all messages if flag is empty
+func testFolderSubjectsFlagged(t *testing.T, account ConfigIMAPAccount, folder string, flag imap.Flag) []string {
+	t.Helper()
+	client, err := imapclient.DialInsecure(net.JoinHostPort(account.Address, account.Port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Login(account.Username, account.Password).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	selectData, err := client.Select(folder, nil).Wait()
+	if err != nil {
+		t.Fatalf("selecting %s: %v", folder, err)
+	}
+	subjects := make([]string, 0)
+	if selectData.NumMessages == 0 {
+		return subjects
+	}
+	all := imap.SeqSet{imap.SeqRange{Start: 1, Stop: 0}} // 1:*
+	msgs, err := client.Fetch(all, &imap.FetchOptions{Envelope: true, Flags: true}).Collect()
+	if err != nil {
+		t.Fatalf("fetching %s: %v", folder, err)
+	}
+	for _, msg := range msgs {
+		if flag == "" || slices.Contains(msg.Flags, flag) {
+			subjects = append(subjects, msg.Envelope.Subject)
+		}
+	}
+	slices.Sort(subjects)
+	return subjects
+}
+
+// testAggregateXML returns an aggregate report with a single record
+func testAggregateXML(reportID string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<feedback>
+  <report_metadata>
+    <org_name>google.com</org_name>
+    <email>noreply-dmarc-support@google.com</email>
+    <report_id>` + reportID + `</report_id>
+    <date_range><begin>1700000000</begin><end>1700086399</end></date_range>
+  </report_metadata>
+  <policy_published>
+    <domain>example.com</domain><adkim>r</adkim><aspf>r</aspf><p>none</p><sp>none</sp><pct>100</pct>
+  </policy_published>
+  <record>
+    <row>
+      <source_ip>192.0.2.1</source_ip><count>2</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><header_from>example.com</header_from></identifiers>
+    <auth_results>
+      <dkim><domain>example.com</domain><result>pass</result><selector>s1</selector></dkim>
+      <spf><domain>example.com</domain><result>fail</result></spf>
+    </auth_results>
+  </record>
+</feedback>
+`
+}
+
+// testReportMessage returns a report message with the gzipped aggregate report of reportID attached
+func testReportMessage(subject, reportID string) string {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(testAggregateXML(reportID)))
+	gz.Close()
+	return "From: noreply-dmarc-support@google.com\r\n" +
+		"To: dmarc@example.com\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Message-ID: <" + reportID + "@google.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: application/gzip; name=\"google.com!example.com!1700000000!1700086399.xml.gz\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(compressed.Bytes()) + "\r\n"
+}
+
+// testTextMessage returns a message without a report
+func testTextMessage(subject string) string {
+	return "From: someone@example.org\r\nTo: dmarc@example.com\r\nSubject: " + subject + "\r\n\r\nNo report here.\r\n"
+}
+
+func TestRetentionInFetchedFolder(t *testing.T) {
+	useTestDatabase(t)
+	account, user := startTestIMAPServer(t)
+	account.Actions.RetentionDays = 30
+	old := time.Now().AddDate(0, 0, -60)
+	appendTestMessage(t, user, "INBOX", old, testReportMessage("Report Domain: example.com old", "old"))
+	appendTestMessage(t, user, "INBOX", old, testTextMessage("Old personal mail"))
+	appendTestMessage(t, user, "INBOX", old, testTextMessage("Report Domain: example.com broken"))
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com new", "new"))
+
+	stats, err := syncAccount(account)
+	if err != nil {
+		t.Fatalf("syncAccount error: %v", err)
+	}
+	if stats.Reports != 2 || stats.Errors != 1 {
+		t.Fatalf("syncAccount stored %d reports and %d errors, want 2 and 1", stats.Reports, stats.Errors)
+	}
+	// Only the old message whose report is stored may go
+	want := []string{"Old personal mail", "Report Domain: example.com broken", "Report Domain: example.com new"}
+	if got := testFolderSubjects(t, account, "INBOX"); !slices.Equal(got, want) {
+		t.Fatalf("INBOX holds %q, want %q", got, want)
+	}
+	state := mailboxState{Account: account.Name, Folder: "INBOX", UIDValidity: 1}
+	if uids, err := getStoredUIDs(state); err != nil || len(uids) != 1 {
+		t.Fatalf("imap_stored holds %v (%v), want only the new report", uids, err)
+	}
+}
+
+func TestRetentionInDestinationFolders(t *testing.T) {
+	useTestDatabase(t)
+	account, user := startTestIMAPServer(t)
+	account.Actions.RetentionDays = 30
+	account.Actions.Success.Move = "Processed"
+	account.Actions.Failure.Move = "Failed"
+	old := time.Now().AddDate(0, 0, -60)
+	appendTestMessage(t, user, "INBOX", old, testReportMessage("Report Domain: example.com old", "old"))
+	appendTestMessage(t, user, "INBOX", old, testTextMessage("Old personal mail"))
+	appendTestMessage(t, user, "INBOX", old, testTextMessage("Report Domain: example.com broken"))
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com new", "new"))
+
+	if _, err := syncAccount(account); err != nil {
+		t.Fatalf("syncAccount error: %v", err)
+	}
+	checks := map[string][]string{
+		"INBOX":     {"Old personal mail"},
+		"Processed": {"Report Domain: example.com new"},
+		"Failed":    {},
+	}
+	for folder, want := range checks {
+		if got := testFolderSubjects(t, account, folder); !slices.Equal(got, want) {
+			t.Errorf("%s holds %q, want %q", folder, got, want)
+		}
+	}
+
+	// Retention also runs when there is nothing new to fetch
+	appendTestMessage(t, user, "Processed", old, testReportMessage("Report Domain: example.com moved earlier", "earlier"))
+	if _, err := syncAccount(account); err != nil {
+		t.Fatalf("syncAccount error: %v", err)
+	}
+	want := []string{"Report Domain: example.com new"}
+	if got := testFolderSubjects(t, account, "Processed"); !slices.Equal(got, want) {
+		t.Errorf("Processed holds %q after a quiet run, want %q", got, want)
+	}
+}
+
+func TestMoveWithoutUIDPlusOnlyFlagsMessages(t *testing.T) {
+	useTestDatabase(t)
+	account, user := startTestIMAPServerWithCaps(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	account.Actions.Success.Move = "Processed"
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com report", "report"))
+	// Flagged by someone else, a plain EXPUNGE would remove it as well
+	if _, err := user.Append("INBOX", bytes.NewReader([]byte(testTextMessage("Flagged by the user"))), &imap.AppendOptions{Flags: []imap.Flag{imap.FlagDeleted}}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := syncAccount(account)
+	if err != nil {
+		t.Fatalf("syncAccount error: %v", err)
+	}
+	if stats.Reports != 1 {
+		t.Fatalf("syncAccount stored %d reports, want 1", stats.Reports)
+	}
+	checks := map[string][]string{
+		"Processed": {"Report Domain: example.com report"},
+		"INBOX":     {"Flagged by the user", "Report Domain: example.com report"},
+	}
+	for folder, want := range checks {
+		if got := testFolderSubjects(t, account, folder); !slices.Equal(got, want) {
+			t.Errorf("%s holds %q, want %q", folder, got, want)
+		}
+	}
+	want := []string{"Flagged by the user", "Report Domain: example.com report"}
+	if got := testFolderSubjectsFlagged(t, account, "INBOX", imap.FlagDeleted); !slices.Equal(got, want) {
+		t.Errorf("INBOX holds %q flagged as deleted, want %q", got, want)
+	}
+}
+
+func TestRetentionWithoutUIDPlusOnlyFlagsMessages(t *testing.T) {
+	useTestDatabase(t)
+	account, user := startTestIMAPServerWithCaps(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	account.Actions.RetentionDays = 30
+	old := time.Now().AddDate(0, 0, -60)
+	appendTestMessage(t, user, "INBOX", old, testReportMessage("Report Domain: example.com old", "old"))
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com new", "new"))
+
+	if _, err := syncAccount(account); err != nil {
+		t.Fatalf("syncAccount error: %v", err)
+	}
+	want := []string{"Report Domain: example.com new", "Report Domain: example.com old"}
+	if got := testFolderSubjects(t, account, "INBOX"); !slices.Equal(got, want) {
+		t.Errorf("INBOX holds %q, want nothing expunged", got)
+	}
+	want = []string{"Report Domain: example.com old"}
+	if got := testFolderSubjectsFlagged(t, account, "INBOX", imap.FlagDeleted); !slices.Equal(got, want) {
+		t.Errorf("INBOX holds %q flagged as deleted, want %q", got, want)
+	}
+}
@@ -1,175 +1,351 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
-	"strings"
+	"net"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
-	report "github.com/oliverpool/go-dmarc-report"
 )
 
-// DialTLS connects to an IMAP server with implicit TLS.
-func DialTLS(address string, insecure bool, options *imapclient.Options) (*imapclient.Client, error) {
-	tlsconf := tls.Config{
-		NextProtos: []string{"imap"},
-	}
-	if insecure {
-		tlsconf.InsecureSkipVerify = true
+// dialIMAP connects to the IMAP server of an account using the configured TLS mode
+// The handler receives unsolicited updates from the server and may be nil.
+func dialIMAP(account ConfigIMAPAccount, handler *imapclient.UnilateralDataHandler) (*imapclient.Client, error) {
+	server := net.JoinHostPort(account.Address, account.Port)
+	if account.TLS.Mode == tlsModeNone {
+		// Credentials would go over the wire in plain text, so this is only for local servers
+		if !isLoopback(account.Address) {
+			return nil, fmt.Errorf("plaintext connections are only allowed to localhost, not %s", account.Address)
+		}
+		return imapclient.DialInsecure(server, &imapclient.Options{
+			UnilateralDataHandler: handler,
+		})
 	}
-	conn, err := tls.Dial("tcp", address, &tlsconf)
+
+	tlsConfig, err := newTLSConfig(account.Address, account.TLS)
 	if err != nil {
 		return nil, err
 	}
-	return imapclient.New(conn, options), nil
+	options := &imapclient.Options{
+		TLSConfig:             tlsConfig,
+		UnilateralDataHandler: handler,
+	}
+	switch account.TLS.Mode {
+	case tlsModeImplicit:
+		return imapclient.DialTLS(server, options)
+	case tlsModeStartTLS:
+		return imapclient.DialStartTLS(server, options)
+	default:
+		return nil, fmt.Errorf("unknown TLS mode '%s'", account.TLS.Mode)
+	}
 }
 
-func getReportsViaIMAP4(server, user, password string, since, before time.Time) ([]*report.Aggregate, error) {
-	slog.Debug("Connecting to IMAP4 server:", "server", server)
-	client, err := DialTLS(server, true, nil)
+// authenticateIMAP logs in with a password or authenticates with an OAuth2 access token
+func authenticateIMAP(client *imapclient.Client, account ConfigIMAPAccount) error {
+	if account.Auth.Method == authMethodPassword {
+		return client.Login(account.Username, account.Password).Wait()
+	}
+	saslClient, err := newSASLClient(account)
 	if err != nil {
-		slog.Error("connect failed", "error", err)
-		return nil, fmt.Errorf("connect failed: %w", err)
+		return err
 	}
-	defer client.Close()
+	if err := client.Authenticate(saslClient); err != nil {
+		// The token may have been revoked or expired early, the next attempt gets a new one
+		forgetToken(account)
+		return err
+	}
+	return nil
+}
 
-	slog.Debug("Logging in to IMAP4 server:", "user", user)
-	cmd := client.Login(user, password)
-	if err := cmd.Wait(); err != nil {
-		slog.Error("login failed", "error", err)
-		return nil, fmt.Errorf("login failed: %w", err)
+// fetchedReport is a decoded report together with the account, folder and message it was fetched from
+// One of Aggregate, Forensic or TLS is set.
+type fetchedReport struct {
+	Aggregate *aggregateReport
+	Forensic  *forensicReport
+	TLS       *tlsReport
+	Raw       []byte            // The decompressed XML or JSON of an aggregate or TLS report, for the archive
+	Headers   []byte            // The header section of the message the report came in, if any
+	DKIM      *dkimVerification // The DKIM result of the message, if verified
+	Replace   bool              // Replace a stored report with the same id, instead of skipping this one
+	Account   string
+	Folder    string
+	UID       imap.UID
+	Ref       string // Where the message can be found, for an ingest error if the report cannot be stored
+}
+
+// id identifies the report in log messages
+func (r *fetchedReport) id() string {
+	if r.Forensic != nil {
+		return "forensic:" + r.Forensic.Hash
+	}
+	if r.TLS != nil {
+		return "tlsrpt:" + r.TLS.ReportID
 	}
+	return r.Aggregate.Metadata.ReportID
+}
 
-	slog.Debug("Selecting Agents.Dmarc")
-	// select the mailbox
-	if _, err := client.Select("Agents.Dmarc", &imap.SelectOptions{
-		ReadOnly: true,
-	}).Wait(); err != nil {
-		slog.Error("select failed", "error", err)
-		return nil, fmt.Errorf("select failed: %w", err)
-	}
-	searchData, err := client.Search(&imap.SearchCriteria{
-		Since:  since,
-		Before: before,
-		Header: []imap.SearchCriteriaHeaderField{
-			{
-				Key:   "Subject",
-				Value: "Report Domain: ",
-			},
-		},
-	}, nil).Wait()
+// storeMutex makes sure only one folder at a time writes to the database
+var storeMutex sync.Mutex
+
+// syncStats counts what a sync did, for the summary at the end of a run
+type syncStats struct {
+	Reports int // Reports stored
+	Errors  int // Messages that could not be decoded
+}
+
+func (s *syncStats) add(other syncStats) {
+	s.Reports += other.Reports
+	s.Errors += other.Errors
+}
+
+// syncAccount fetches and stores the new reports in every folder of an account
+// A folder that fails is logged and skipped, the error of the last failing folder is returned
+func syncAccount(account ConfigIMAPAccount) (syncStats, error) {
+	stats := syncStats{}
+	client, err := connectIMAP(account, nil)
 	if err != nil {
-		slog.Error("IMAP4 search failed", "error", err)
-		return nil, fmt.Errorf("IMAP4 search failed: %w", err)
+		return stats, err
 	}
+	defer client.Close()
 
-	if searchData.Count == 0 {
-		return nil, fmt.Errorf("no reports found")
+	folders, err := listFolders(client, account)
+	if err != nil {
+		return stats, err
 	}
-	fetchOptions := &imap.FetchOptions{
-		Flags:    true,
-		Envelope: true,
-		BodySection: []*imap.FetchItemBodySection{
-			{
-				Specifier: imap.PartSpecifierText,
-			},
-			{
-				Specifier: imap.PartSpecifierHeader,
-			},
-		},
+
+	var folderErr error
+	for _, folder := range folders {
+		folderStats, err := syncFolder(client, account, folder)
+		stats.add(folderStats)
+		if err != nil {
+			// A broken folder should not keep us from fetching the other folders
+			slog.Error("fetching folder failed", "account", account.Name, "folder", folder, "error", err)
+			folderErr = err
+		}
 	}
-	msgs, err := client.Fetch(searchData.All, fetchOptions).Collect()
+	return stats, folderErr
+}
+
+// syncFolder fetches the new reports of one folder, stores them, moves the checkpoint of the folder,
+// applies the post-processing actions of the account to the messages and finally the retention
+func syncFolder(client *imapclient.Client, account ConfigIMAPAccount, folder string) (syncStats, error) {
+	storeMutex.Lock()
+	states, err := getMailboxStates()
+	storeMutex.Unlock()
 	if err != nil {
-		slog.Error("fetch failed", "error", err)
-		return nil, fmt.Errorf("fetch failed: %w", err)
-	}
-	reports := make([]*report.Aggregate, 0)
-	total := len(msgs)
-	slog.Info("Fetching messages", "total", total)
-	for id, msg := range msgs {
-		if Configuration.LogProgress > 0 && (id+1)%Configuration.LogProgress == 0 {
-			slog.Info("Fetching messages:", "current", id+1, "total", total) //id+1 because id starts at 0
+		return syncStats{}, fmt.Errorf("error getting mailbox states: %w", err)
+	}
+	state, ok := states[mailboxKey{Account: account.Name, Folder: folder}]
+	if !ok {
+		state = mailboxState{Account: account.Name, Folder: folder}
+	}
+
+	uids, newState, covered, err := selectFolder(client, account, state)
+	if err != nil {
+		return syncStats{}, err
+	}
+	if len(uids) == 0 {
+		newState.LastUID = covered
+		storeMutex.Lock()
+		err = setMailboxStates([]mailboxState{newState})
+		storeMutex.Unlock()
+		if err != nil {
+			return syncStats{}, fmt.Errorf("error saving mailbox states: %w", err)
 		}
-		slog.Debug("Fetching messages:", "current", id+1, "total", total) //id+1 because id starts at 0
-		bodyTxt := []byte{}
-		headersTxt := []byte{}
-	bodyParts:
-		for section, body := range msg.BodySection {
-			switch section.Specifier {
-			case imap.PartSpecifierText:
-				bodyTxt = append(bodyTxt, body...)
-			case imap.PartSpecifierHeader:
-				headersTxt = body
-			default:
-				slog.Debug("Unknown body section", "section", section, "body", body)
-				continue bodyParts
-			}
+		if err := applyRetention(client, account, newState); err != nil {
+			return syncStats{}, fmt.Errorf("error applying retention: %w", err)
 		}
-		messageToParse := string(headersTxt) + string(bodyTxt)
-		email, err := Parse(bytes.NewReader([]byte(messageToParse)))
-		if err != nil {
-			// handle error
-			slog.Error("parse failed", "error", err)
+		return syncStats{}, nil
+	}
+
+	timer := time.Now()
+	result, err := processMessages(client, account, newState, covered, uids)
+	if result.Stats.Reports > 0 || result.Stats.Errors > 0 {
+		slog.Info("finished", "account", account.Name, "folder", folder, "reports", result.Stats.Reports, "errors", result.Stats.Errors, "duration", time.Since(timer))
+	}
+
+	// The stored reports are safe, so their messages can be moved out of the way, even if a later batch failed
+	if account.actionsEnabled() && (len(result.Succeeded) > 0 || len(result.Failed) > 0) {
+		if actionErr := applyActions(client, account, result.Succeeded, result.Failed); actionErr != nil {
+			err = errors.Join(err, fmt.Errorf("error applying actions: %w", actionErr))
+		}
+	}
+	// Nothing is deleted after a failure, when it is not certain what was stored
+	if err == nil {
+		if retentionErr := applyRetention(client, account, newState); retentionErr != nil {
+			err = fmt.Errorf("error applying retention: %w", retentionErr)
 		}
-		attachment := []byte{}
-		attachmentType := ""
-		if len(email.Attachments) < 1 { // Empty message, only data (Google does this)
-			attachmentType = email.Header.Get("Content-Type")
-			attachment = bodyTxt
-		} else {
-			for _, a := range email.Attachments {
-				attachmentBytes, err := io.ReadAll(a.Data)
-				if err != nil {
-					slog.Error("attachment read failed", "error", err)
-				}
-				if strings.HasPrefix(a.ContentType, "text/plain") { // FIXME, maybe uncompressed?
-					continue
-				}
-				attachment = attachmentBytes
-				attachmentType = a.ContentType
+	}
+	return result.Stats, err
+}
+
+// connectIMAP connects and authenticates to the IMAP server of an account
+func connectIMAP(account ConfigIMAPAccount, handler *imapclient.UnilateralDataHandler) (*imapclient.Client, error) {
+	slog.Debug("Connecting to IMAP4 server:", "account", account.Name, "server", account.Address, "port", account.Port, "tls", account.TLS.Mode)
+	client, err := dialIMAP(account, handler)
+	if err != nil {
+		slog.Error("connect failed", "account", account.Name, "error", err)
+		return nil, fmt.Errorf("connect failed: %w", err)
+	}
+
+	slog.Debug("Logging in to IMAP4 server:", "account", account.Name, "user", account.Username, "method", account.Auth.Method)
+	if err := authenticateIMAP(client, account); err != nil {
+		client.Close()
+		slog.Error("login failed", "account", account.Name, "error", err)
+		return nil, fmt.Errorf("login failed: %w", err)
+	}
+	return client, nil
+}
+
+// listFolders returns the configured folders of an account, followed by every selectable
+// folder that matches the LIST wildcard pattern (if any). Duplicates are removed.
+func listFolders(client *imapclient.Client, account ConfigIMAPAccount) ([]string, error) {
+	folders := make([]string, 0, len(account.Folders))
+	seen := make(map[string]bool)
+	for _, folder := range account.Folders {
+		if !seen[folder] {
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+	if account.FolderPattern == "" {
+		return folders, nil
+	}
+
+	slog.Debug("Listing folders", "account", account.Name, "pattern", account.FolderPattern)
+	mailboxes, err := client.List("", account.FolderPattern, nil).Collect()
+	if err != nil {
+		slog.Error("list failed", "account", account.Name, "error", err)
+		return nil, fmt.Errorf("list failed: %w", err)
+	}
+mailboxLoop:
+	for _, mailbox := range mailboxes {
+		for _, attr := range mailbox.Attrs {
+			if attr == imap.MailboxAttrNoSelect || attr == imap.MailboxAttrNonExistent {
+				continue mailboxLoop
 			}
 		}
-		if len(attachment) < 1 || attachmentType == "" {
-			slog.Error("No attachment found", "message", messageToParse)
-			return nil, fmt.Errorf("no attachment found")
+		if !seen[mailbox.Mailbox] {
+			seen[mailbox.Mailbox] = true
+			folders = append(folders, mailbox.Mailbox)
 		}
+	}
+	return folders, nil
+}
+
+// searchCriteria builds the IMAP search for an account from its search options
+// Only messages after the last processed UID of the folder are searched
+func searchCriteria(account ConfigIMAPAccount, lastUID imap.UID) *imap.SearchCriteria {
+	criteria := &imap.SearchCriteria{
+		UID: []imap.UIDSet{{imap.UIDRange{Start: lastUID + 1, Stop: 0}}}, // Stop 0 means '*'
+	}
+	if account.Search.Subject != "" {
+		criteria.Header = append(criteria.Header, imap.SearchCriteriaHeaderField{
+			Key:   "Subject",
+			Value: account.Search.Subject,
+		})
+	}
+	if account.Search.From != "" {
+		criteria.Header = append(criteria.Header, imap.SearchCriteriaHeaderField{
+			Key:   "From",
+			Value: account.Search.From,
+		})
+	}
+	if account.Search.Unseen {
+		criteria.NotFlag = append(criteria.NotFlag, imap.FlagSeen)
+	}
+	return criteria
+}
 
-		// Let's try and decode it. If it fails it is no problem
-		base64.StdEncoding.Decode(attachment, attachment)
+// selectFolder selects the folder of state and searches for the reports that arrived after its checkpoint
+// It returns the UIDs of the messages to fetch in ascending order, the state to save once they are stored
+// and the UID the checkpoint may move to when all of them are stored.
+func selectFolder(client *imapclient.Client, account ConfigIMAPAccount, state mailboxState) ([]imap.UID, mailboxState, uint32, error) {
+	folder := state.Folder
+	condStore := client.Caps().Has(imap.CapCondStore)
+	slog.Debug("Selecting folder", "account", account.Name, "folder", folder, "condstore", condStore)
+	// select the mailbox, only writable if we are going to change the messages
+	selectData, err := client.Select(folder, &imap.SelectOptions{
+		ReadOnly:  !account.actionsEnabled(),
+		CondStore: condStore,
+	}).Wait()
+	if err != nil {
+		slog.Error("select failed", "error", err)
+		return nil, state, 0, fmt.Errorf("select failed: %w", err)
+	}
 
-		attachmentReader := bytes.NewReader(attachment)
-		agg := &report.Aggregate{}
-		if strings.Index(attachmentType, ";") > 0 {
-			attachmentType = strings.Split(attachmentType, ";")[0]
-		}
-		err = nil
-		switch attachmentType {
-		case "application/zip":
-			agg, err = report.DecodeZip(attachmentReader, int64(len(attachment)))
-		case "application/x-gzip-compressed", "application/gzip":
-			agg, err = report.DecodeGzip(attachmentReader)
-		case "text/plain":
-			agg, err = report.Decode(attachmentReader)
-		case "application/x-zip-compressed":
-			agg, err = report.DecodeZip(attachmentReader, int64(len(attachment)))
-		case "multipart/mixed":
-			attachmentReader = newAttachmentReaderFromMultipartMixed(attachment)
-			agg, err = report.DecodeGzip(attachmentReader)
-		default:
-			slog.Debug("unknown type", "type", attachmentType)
-			err = fmt.Errorf("unknown type '%s'", attachmentType)
+	plan := planFolderSync(state, selectData, condStore)
+	if plan.Resync {
+		// UIDs of the old and new mailbox cannot be compared, so everything is fetched again.
+		// Reports that were already stored are skipped when storing.
+		slog.Warn("UIDVALIDITY changed, resyncing folder", "account", account.Name, "folder", folder, "old", state.UIDValidity, "new", selectData.UIDValidity)
+	}
+	if plan.Unchanged {
+		slog.Debug("folder unchanged since last run", "account", account.Name, "folder", folder)
+		return nil, plan.State, plan.Covered, nil
+	}
+
+	searchData, err := client.UIDSearch(searchCriteria(account, imap.UID(plan.State.LastUID)), nil).Wait()
+	if err != nil {
+		slog.Error("IMAP4 search failed", "error", err)
+		return nil, state, 0, fmt.Errorf("IMAP4 search failed: %w", err)
+	}
+
+	uids, covered := plan.found(searchData.AllUIDs())
+	if len(uids) == 0 {
+		slog.Debug("no reports found", "account", account.Name, "folder", folder)
+	}
+	return uids, plan.State, covered, nil
+}
+
+// folderSync is what a run does in a folder, decided by planFolderSync
+type folderSync struct {
+	State     mailboxState // The state the run starts from
+	Covered   uint32       // The UID the checkpoint may move to once the messages found are stored
+	Unchanged bool         // Nothing changed since the last run, there is no need to search
+	Resync    bool         // UIDVALIDITY changed, the folder is fetched again from the start
+}
+
+// planFolderSync decides from the saved state of a folder and the response to SELECT where the run starts
+// and whether it has to search at all. condStore tells if the server supports CONDSTORE.
+func planFolderSync(state mailboxState, selectData *imap.SelectData, condStore bool) folderSync {
+	plan := folderSync{State: state}
+	if state.UIDValidity != selectData.UIDValidity {
+		plan.Resync = state.UIDValidity != 0
+		plan.State = mailboxState{
+			Account:     state.Account,
+			Folder:      state.Folder,
+			UIDValidity: selectData.UIDValidity,
 		}
-		if err != nil {
-			slog.Error("decode failed", "error", err, "attachment", string(attachment))
-			return nil, fmt.Errorf("decode failed: %w", err)
+	}
+	plan.State.HighestModSeq = selectData.HighestModSeq
+	// Everything below UIDNEXT is covered by this run, even messages that do not match the search
+	plan.Covered = plan.State.LastUID
+	if selectData.UIDNext > 0 {
+		plan.Covered = max(plan.Covered, uint32(selectData.UIDNext-1))
+	}
+	plan.Unchanged = !plan.Resync && plan.State.UIDValidity == state.UIDValidity && condStore && state.HighestModSeq != 0 &&
+		state.HighestModSeq == selectData.HighestModSeq && uint32(selectData.UIDNext) == state.LastUID+1
+	return plan
+}
+
+// found returns the UIDs of a search that are after the checkpoint in ascending order, and the UID
+// the checkpoint may move to once they are stored
+func (plan folderSync) found(searched []imap.UID) ([]imap.UID, uint32) {
+	// A search for 'n:*' always matches the last message, even when its UID is below n
+	uids := make([]imap.UID, 0)
+	covered := plan.Covered
+	for _, uid := range searched {
+		if uint32(uid) > plan.State.LastUID {
+			uids = append(uids, uid)
+			covered = max(covered, uint32(uid))
 		}
-		reports = append(reports, agg)
 	}
-	return reports, nil
+	slices.Sort(uids)
+	return uids, covered
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestPlanFolderSync(t *testing.T) {
+	saved := mailboxState{Account: "test", Folder: "INBOX", UIDValidity: 7, LastUID: 10, HighestModSeq: 100}
+	tests := []struct {
+		name      string
+		state     mailboxState
+		selected  imap.SelectData
+		condStore bool
+		want      folderSync
+	}{
+		{
+			name:     "first run",
+			state:    mailboxState{Account: "test", Folder: "INBOX"},
+			selected: imap.SelectData{UIDValidity: 7, UIDNext: 5},
+			want:     folderSync{State: mailboxState{Account: "test", Folder: "INBOX", UIDValidity: 7}, Covered: 4},
+		},
+		{
+			name:     "new messages",
+			state:    saved,
+			selected: imap.SelectData{UIDValidity: 7, UIDNext: 15, HighestModSeq: 120},
+			want:     folderSync{State: mailboxState{Account: "test", Folder: "INBOX", UIDValidity: 7, LastUID: 10, HighestModSeq: 120}, Covered: 14},
+		},
+		{
+			name:     "UIDVALIDITY changed",
+			state:    saved,
+			selected: imap.SelectData{UIDValidity: 8, UIDNext: 3, HighestModSeq: 5},
+			want:     folderSync{State: mailboxState{Account: "test", Folder: "INBOX", UIDValidity: 8, HighestModSeq: 5}, Covered: 2, Resync: true},
+		},
+		{
+			name:      "UIDVALIDITY changed with the same modseq",
+			state:     saved,
+			selected:  imap.SelectData{UIDValidity: 8, UIDNext: 11, HighestModSeq: 100},
+			condStore: true,
+			want:      folderSync{State: mailboxState{Account: "test", Folder: "INBOX", UIDValidity: 8, HighestModSeq: 100}, Covered: 10, Resync: true},
+		},
+		{
+			name:      "unchanged modseq",
+			state:     saved,
+			selected:  imap.SelectData{UIDValidity: 7, UIDNext: 11, HighestModSeq: 100},
+			condStore: true,
+			want:      folderSync{State: saved, Covered: 10, Unchanged: true},
+		},
+		{
+			name:     "unchanged modseq without CONDSTORE",
+			state:    saved,
+			selected: imap.SelectData{UIDValidity: 7, UIDNext: 11, HighestModSeq: 100},
+			want:     folderSync{State: saved, Covered: 10},
+		},
+		{
+			name:      "unchanged modseq but a message behind the checkpoint",
+			state:     saved,
+			selected:  imap.SelectData{UIDValidity: 7, UIDNext: 12, HighestModSeq: 100},
+			condStore: true,
+			want:      folderSync{State: saved, Covered: 11},
+		},
+		{
+			name:      "no modseq saved",
+			state:     mailboxState{Account: "test", Folder: "INBOX", UIDValidity: 7, LastUID: 10},
+			selected:  imap.SelectData{UIDValidity: 7, UIDNext: 11, HighestModSeq: 100},
+			condStore: true,
+			want:      folderSync{State: saved, Covered: 10},
+		},
+		{
+			name:     "no UIDNEXT",
+			state:    saved,
+			selected: imap.SelectData{UIDValidity: 7, HighestModSeq: 100},
+			want:     folderSync{State: saved, Covered: 10},
+		},
+		{
+			// Messages were expunged, UIDNEXT does not move back
+			name:     "UIDNEXT below the checkpoint",
+			state:    saved,
+			selected: imap.SelectData{UIDValidity: 7, UIDNext: 5, HighestModSeq: 100},
+			want:     folderSync{State: saved, Covered: 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := planFolderSync(tt.state, &tt.selected, tt.condStore); got != tt.want {
+				t.Errorf("planFolderSync = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFolderSyncFound(t *testing.T) {
+	plan := folderSync{State: mailboxState{LastUID: 10}, Covered: 19}
+	tests := []struct {
+		name     string
+		plan     folderSync
+		searched []imap.UID
+		uids     []imap.UID
+		covered  uint32
+	}{
+		{"nothing found", plan, nil, []imap.UID{}, 19},
+		// The messages from 11 to 19 that did not match the search are covered as well
+		{"gap in the UIDs", plan, []imap.UID{12}, []imap.UID{12}, 19},
+		{"unordered", plan, []imap.UID{17, 11, 14}, []imap.UID{11, 14, 17}, 19},
+		// A search for 11:* matches the last message when there are no newer ones
+		{"last message behind the checkpoint", plan, []imap.UID{9}, []imap.UID{}, 19},
+		// A message may arrive between SELECT and SEARCH
+		{"message after UIDNEXT", plan, []imap.UID{15, 21}, []imap.UID{15, 21}, 21},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uids, covered := tt.plan.found(tt.searched)
+			if !slices.Equal(uids, tt.uids) || covered != tt.covered {
+				t.Errorf("found = %v, %d, want %v, %d", uids, covered, tt.uids, tt.covered)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+const (
+	modePoll = "poll"
+	modeIdle = "idle"
+
+	defaultIdleRefresh = 25 * 60 // Seconds, servers may drop idle connections after 30 minutes
+	defaultRetryDelay  = 60      // Seconds to wait before reconnecting when Sleep is not set
+)
+
+// runIdle watches every folder of every account with IMAP IDLE and only returns if there is nothing to watch
+// POP3 has no push, so POP3 accounts are polled every retry delay. File sources are read once,
+// or watched when configured to.
+func runIdle() {
+	accounts := Configuration.imapAccounts()
+	pop3Accounts := Configuration.pop3Accounts()
+	sources := Configuration.fileSources()
+	if len(accounts) == 0 && len(pop3Accounts) == 0 && len(sources) == 0 && !receiverEnabled() {
+		slog.Error("no accounts, file sources or receiver configured")
+		os.Exit(1)
+	}
+	var wg sync.WaitGroup
+	for _, account := range pop3Accounts {
+		wg.Add(1)
+		go func(account ConfigPOP3Account) {
+			defer wg.Done()
+			for {
+				if _, err := syncPOP3Account(account); err != nil {
+					slog.Error("error fetching reports", "account", account.Name, "error", err)
+				}
+				time.Sleep(retryDelay())
+			}
+		}(account)
+	}
+	for _, source := range sources {
+		wg.Add(1)
+		go func(source ConfigFileSource) {
+			defer wg.Done()
+			if source.Watch {
+				watchFileSource(source)
+				return
+			}
+			if _, err := syncFileSource(source); err != nil {
+				slog.Error("error reading file source", "source", source.Name, "error", err)
+			}
+		}(source)
+	}
+	for _, account := range accounts {
+		wg.Add(1)
+		go func(account ConfigIMAPAccount) {
+			defer wg.Done()
+			watchAccount(account)
+		}(account)
+	}
+	wg.Wait()
+	if receiverEnabled() {
+		// The receiver keeps running on its own
+		select {}
+	}
+}
+
+// retryDelay is how long to wait before reconnecting after a failure
+func retryDelay() time.Duration {
+	if Configuration.Sleep > 0 {
+		return time.Duration(Configuration.Sleep) * time.Second
+	}
+	return defaultRetryDelay * time.Second
+}
+
+// watchAccount lists the folders of an account once and then watches each folder on its own connection,
+// because IDLE only reports changes in the selected folder
+func watchAccount(account ConfigIMAPAccount) {
+	var folders []string
+	for {
+		client, err := connectIMAP(account, nil)
+		if err == nil {
+			folders, err = listFolders(client, account)
+			client.Close()
+		}
+		if err == nil {
+			break
+		}
+		slog.Error("error listing folders", "account", account.Name, "error", err)
+		time.Sleep(retryDelay())
+	}
+
+	var wg sync.WaitGroup
+	for _, folder := range folders {
+		wg.Add(1)
+		go func(folder string) {
+			defer wg.Done()
+			for {
+				err := watchFolder(account, folder)
+				slog.Error("watching folder stopped, reconnecting", "account", account.Name, "folder", folder, "error", err, "delay", retryDelay())
+				time.Sleep(retryDelay())
+			}
+		}(folder)
+	}
+	wg.Wait()
+}
+
+// watchFolder keeps a session open on one folder and syncs it whenever the server reports new messages,
+// and at least every IdleRefresh seconds. It only returns when the session fails.
+func watchFolder(account ConfigIMAPAccount, folder string) error {
+	newMessages := make(chan struct{}, 1)
+	client, err := connectIMAP(account, newMessagesHandler(newMessages))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if _, err := syncFolder(client, account, folder); err != nil {
+		return err
+	}
+
+	caps := client.Caps()
+	if !caps.Has(imap.CapIdle) && !caps.Has(imap.CapIMAP4rev2) {
+		slog.Warn("server does not support IDLE, polling instead", "account", account.Name, "folder", folder, "interval", retryDelay())
+		for {
+			time.Sleep(retryDelay())
+			if _, err := syncFolder(client, account, folder); err != nil {
+				return err
+			}
+		}
+	}
+
+	refresh := time.Duration(Configuration.IdleRefresh) * time.Second
+	if refresh <= 0 {
+		refresh = defaultIdleRefresh * time.Second
+	}
+	for {
+		slog.Debug("idling", "account", account.Name, "folder", folder)
+		idle, err := client.Idle()
+		if err != nil {
+			return fmt.Errorf("IDLE failed: %w", err)
+		}
+		idleDone := make(chan error, 1)
+		go func() { idleDone <- idle.Wait() }()
+
+		timer := time.NewTimer(refresh)
+		select {
+		case <-newMessages:
+			slog.Debug("new messages", "account", account.Name, "folder", folder)
+		case <-timer.C:
+			slog.Debug("re-issuing IDLE", "account", account.Name, "folder", folder)
+		case err := <-idleDone:
+			timer.Stop()
+			return idleEndedError(err)
+		}
+		timer.Stop()
+
+		if err := idle.Close(); err != nil {
+			return fmt.Errorf("stopping IDLE failed: %w", err)
+		}
+		if err := <-idleDone; err != nil {
+			return fmt.Errorf("stopping IDLE failed: %w", err)
+		}
+		// A notification that arrives during the sync is kept, it may be for a message the sync missed.
+		// At worst the next sync finds nothing new.
+		if _, err := syncFolder(client, account, folder); err != nil {
+			return err
+		}
+	}
+}
+
+// newMessagesHandler signals on newMessages when the server reports a new number of messages
+func newMessagesHandler(newMessages chan<- struct{}) *imapclient.UnilateralDataHandler {
+	return &imapclient.UnilateralDataHandler{
+		Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+			if data.NumMessages == nil {
+				return
+			}
+			// Never block the client, one pending notification is enough to trigger a sync
+			select {
+			case newMessages <- struct{}{}:
+			default:
+			}
+		},
+	}
+}
+
+// idleEndedError is the error of an IDLE command that ended before it was stopped
+// err is nil if the server ended it with an OK response.
+func idleEndedError(err error) error {
+	if err != nil {
+		return fmt.Errorf("IDLE ended: %w", err)
+	}
+	return errors.New("IDLE ended by the server")
+}
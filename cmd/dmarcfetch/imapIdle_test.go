@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// waitForCount waits until a table of the test database holds want rows
+func waitForCount(t *testing.T, table string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		count := testCount(t, table)
+		if count == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s holds %d rows, want %d", table, count, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// watchTestFolder runs watchFolder until the test IMAP server is closed
+// It must be called before startTestIMAPServer, so the server is closed before the test waits for
+// watchFolder to return and the database is closed after.
+func watchTestFolder(t *testing.T) func(account ConfigIMAPAccount, folder string) {
+	t.Helper()
+	done := make(chan error, 1)
+	t.Cleanup(func() {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Error("watchFolder did not return after the server closed")
+		}
+	})
+	return func(account ConfigIMAPAccount, folder string) {
+		go func() { done <- watchFolder(account, folder) }()
+	}
+}
+
+func TestWatchFolderSyncsOnNewMessages(t *testing.T) {
+	useTestDatabase(t)
+	previousRefresh := Configuration.IdleRefresh
+	Configuration.IdleRefresh = 3600
+	t.Cleanup(func() { Configuration.IdleRefresh = previousRefresh })
+	watch := watchTestFolder(t)
+	account, user := startTestIMAPServer(t)
+	account, idling := signalIdling(t, account)
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com first", "first"))
+
+	watch(account, "INBOX")
+	waitForCount(t, "metadata", 1)
+	// The refresh is an hour away, only the notification of the server can trigger these syncs
+	waitForIdle(t, idling)
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com during idle", "during-idle"))
+	waitForCount(t, "metadata", 2)
+	waitForIdle(t, idling)
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com next idle", "next-idle"))
+	waitForCount(t, "metadata", 3)
+}
+
+// proxyIMAP returns the account connecting through a proxy that passes what the server sends through
+// rewrite, which must keep the length
+func proxyIMAP(t *testing.T, account ConfigIMAPAccount, rewrite func(data []byte) []byte) ConfigIMAPAccount {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	upstream := net.JoinHostPort(account.Address, account.Port)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", upstream)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				io.Copy(server, conn)
+				server.Close()
+			}()
+			go func() {
+				buf := make([]byte, 64*1024)
+				for {
+					n, err := server.Read(buf)
+					if n > 0 {
+						if _, err := conn.Write(rewrite(buf[:n])); err != nil {
+							break
+						}
+					}
+					if err != nil {
+						break
+					}
+				}
+				conn.Close()
+			}()
+		}
+	}()
+	account.Address, account.Port, _ = net.SplitHostPort(listener.Addr().String())
+	return account
+}
+
+// hideIdle hides the IDLE capability of the test server, which it always announces with IMAP4rev1
+func hideIdle(t *testing.T, account ConfigIMAPAccount) ConfigIMAPAccount {
+	t.Helper()
+	return proxyIMAP(t, account, func(data []byte) []byte {
+		return bytes.ReplaceAll(data, []byte(" IDLE"), []byte(" XDLE"))
+	})
+}
+
+// signalIdling signals on the returned channel whenever the test server starts an IDLE command
+func signalIdling(t *testing.T, account ConfigIMAPAccount) (ConfigIMAPAccount, <-chan struct{}) {
+	t.Helper()
+	idling := make(chan struct{}, 1)
+	account = proxyIMAP(t, account, func(data []byte) []byte {
+		if bytes.Contains(data, []byte("+ idling")) {
+			select {
+			case idling <- struct{}{}:
+			default:
+			}
+		}
+		return data
+	})
+	return account, idling
+}
+
+// waitForIdle waits until the test server started an IDLE command
+// The in-memory server only watches the folder a moment after it answered IDLE.
+func waitForIdle(t *testing.T, idling <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-idling:
+	case <-time.After(10 * time.Second):
+		t.Fatal("watchFolder did not start IDLE")
+	}
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestWatchFolderPollsWithoutIdle(t *testing.T) {
+	useTestDatabase(t)
+	previousSleep := Configuration.Sleep
+	Configuration.Sleep = 1
+	t.Cleanup(func() { Configuration.Sleep = previousSleep })
+	watch := watchTestFolder(t)
+	account, user := startTestIMAPServerWithCaps(t, imap.CapSet{imap.CapIMAP4rev1: {}})
+	account = hideIdle(t, account)
+
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com first", "first"))
+
+	watch(account, "INBOX")
+	waitForCount(t, "metadata", 1)
+	appendTestMessage(t, user, "INBOX", time.Now(), testReportMessage("Report Domain: example.com polled", "polled"))
+	waitForCount(t, "metadata", 2)
+}
+
+func TestNewMessagesHandler(t *testing.T) {
+	newMessages := make(chan struct{}, 1)
+	handler := newMessagesHandler(newMessages)
+
+	handler.Mailbox(&imapclient.UnilateralDataMailbox{Flags: []imap.Flag{imap.FlagSeen}})
+	select {
+	case <-newMessages:
+		t.Error("a change of flags triggered a sync")
+	default:
+	}
+
+	// Notifications while a sync is pending must not block the client
+	numMessages := uint32(3)
+	for range 3 {
+		handler.Mailbox(&imapclient.UnilateralDataMailbox{NumMessages: &numMessages})
+	}
+	select {
+	case <-newMessages:
+	default:
+		t.Fatal("a new number of messages did not trigger a sync")
+	}
+	select {
+	case <-newMessages:
+		t.Error("more than one sync pending")
+	default:
+	}
+}
+
+func TestIdleEndedError(t *testing.T) {
+	if err := idleEndedError(nil); err == nil || err.Error() != "IDLE ended by the server" {
+		t.Errorf("idleEndedError(nil) = %v, want IDLE ended by the server", err)
+	}
+	cause := errors.New("connection reset")
+	if err := idleEndedError(cause); !errors.Is(err, cause) || err.Error() != "IDLE ended: connection reset" {
+		t.Errorf("idleEndedError = %v, want it to wrap %v", err, cause)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ingestError is a message that could not be turned into a report
+// It is stored in the ingest_errors table instead of aborting the whole run
+type ingestError struct {
+	Account   string
+	Folder    string
+	UID       uint32
+	MessageID string
+	Subject   string
+	Reporter  string
+	Err       error
+	RawRef    string // Where the raw message can be found: a file in the quarantine directory, an IMAP URL or the source file
+	RawSHA256 string
+	RawSize   int
+	Time      time.Time
+}
+
+// newIngestError records why a message failed, together with the identifying headers of the message
+// ref points at the message in its source. If a quarantine directory is configured, the raw
+// message is saved there and referred to instead, unless nothing of it was read.
+func newIngestError(account, folder string, uid uint32, ref string, raw []byte, err error) *ingestError {
+	hash := sha256.Sum256(raw)
+	ie := &ingestError{
+		Account:   account,
+		Folder:    folder,
+		UID:       uid,
+		Err:       err,
+		RawRef:    ref,
+		RawSHA256: hex.EncodeToString(hash[:]),
+		RawSize:   len(raw),
+		Time:      time.Now(),
+	}
+	if msg, headerErr := mail.ReadMessage(bytes.NewReader(raw)); headerErr == nil {
+		ie.MessageID = strings.Trim(msg.Header.Get("Message-ID"), "<> ")
+		ie.Subject = decodeMimeSentence(msg.Header.Get("Subject"))
+		ie.Reporter = decodeMimeSentence(msg.Header.Get("From"))
+	}
+
+	if Configuration.QuarantineDir != "" && len(raw) > 0 {
+		path := filepath.Join(Configuration.QuarantineDir, ie.RawSHA256+".eml")
+		if writeErr := os.WriteFile(path, raw, 0600); writeErr != nil {
+			slog.Error("error saving quarantined message", "path", path, "error", writeErr)
+		} else {
+			ie.RawRef = path
+		}
+	}
+	return ie
+}
+
+// newStoreError records a report that was decoded but refused by the database
+// The quarantined copy holds the headers of the message followed by the decoded report.
+func newStoreError(rep *fetchedReport, err error) *ingestError {
+	raw := append(append([]byte{}, rep.Headers...), rep.Raw...)
+	return newIngestError(rep.Account, rep.Folder, uint32(rep.UID), rep.Ref, raw, fmt.Errorf("store failed: %w", err))
+}
+
+// newOversizedError records a message that was not read because it is larger than maxBytes
+// Only its headers are kept, if they could be read separately.
+func newOversizedError(account, folder string, uid uint32, ref string, headers []byte, size, maxBytes int64) *ingestError {
+	ie := newIngestError(account, folder, uid, ref, headers, fmt.Errorf("message of %d bytes is larger than %d bytes", size, maxBytes))
+	ie.RawSize = int(size)
+	return ie
+}
+
+// imapURL is an RFC 5092 style reference to a message on the server
+func imapURL(account, folder string, uidValidity, uid uint32) string {
+	return fmt.Sprintf("imap://%s/%s;UIDVALIDITY=%d/;UID=%d", url.PathEscape(account), url.PathEscape(folder), uidValidity, uid)
+}
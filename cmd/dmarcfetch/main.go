@@ -3,43 +3,97 @@ package main
 import (
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
-fetchLoop:
-	for {
-		startTime, err := getLastRun()
-		if err != nil {
-			slog.Error("error getting last run", "error", err)
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1])
+		return
+	}
+
+	if _, err := Configuration.dkim(); err != nil {
+		slog.Error("invalid dkim settings", "error", err)
+		os.Exit(1)
+	}
+	if receiverEnabled() {
+		if _, err := Configuration.receiver(); err != nil {
+			slog.Error("invalid receiver settings", "error", err)
 			os.Exit(1)
 		}
-		setLastRun(time.Now().Add(-time.Second))
-		endTime := time.Now().AddDate(100, 0, 1)
-		timerFetch := time.Now()
-		reps, err := getReportsViaIMAP4(Configuration.IMAP.Address+":"+Configuration.IMAP.Port, Configuration.IMAP.Username, Configuration.IMAP.Password, startTime, endTime)
-		if err != nil {
-			slog.Info("no new reports found", "error", err)
-			if Configuration.Sleep == 0 {
-				os.Exit(0)
-			} else {
-				// Sleep until the next run
-				slog.Info("sleeping", "duration", Configuration.Sleep)
-				time.Sleep(time.Duration(Configuration.Sleep) * time.Second)
-				continue fetchLoop
+	}
+	checkSchema()
+	closeOnShutdown()
+
+	if receiverEnabled() {
+		go func() {
+			if err := runReceiver(); err != nil {
+				slog.Error("receiver failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	switch Configuration.Mode {
+	case modeIdle:
+		runIdle()
+		closeDatabase()
+		return
+	case modePoll, "":
+	default:
+		slog.Error("unknown mode", "mode", Configuration.Mode)
+		os.Exit(1)
+	}
+
+	// Watched file sources are read by their own goroutine, unless this is a single run
+	if Configuration.Sleep > 0 {
+		for _, source := range Configuration.fileSources() {
+			if source.Watch {
+				go watchFileSource(source)
 			}
 		}
-		durationFetch := time.Since(timerFetch)
+	}
 
-		timerStore := time.Now()
-		err = storeReports(reps)
-		if err != nil {
-			slog.Error("error storing reports", "error", err)
-			os.Exit(1)
+	for {
+		timerRun := time.Now()
+		failed := false
+		stats := syncStats{}
+		for _, account := range Configuration.imapAccounts() {
+			accountStats, err := syncAccount(account)
+			stats.add(accountStats)
+			if err != nil {
+				// One unreachable account should not keep the others from being fetched
+				slog.Error("error fetching reports", "account", account.Name, "error", err)
+				failed = true
+			}
+		}
+		for _, account := range Configuration.pop3Accounts() {
+			accountStats, err := syncPOP3Account(account)
+			stats.add(accountStats)
+			if err != nil {
+				slog.Error("error fetching reports", "account", account.Name, "error", err)
+				failed = true
+			}
 		}
-		durationStore := time.Since(timerStore)
-		slog.Info("finished", "durationFetch", durationFetch, "durationStore", durationStore, "total", durationFetch+durationStore)
+		for _, source := range Configuration.fileSources() {
+			if source.Watch && Configuration.Sleep > 0 {
+				continue
+			}
+			sourceStats, err := syncFileSource(source)
+			stats.add(sourceStats)
+			if err != nil {
+				slog.Error("error reading file source", "source", source.Name, "error", err)
+				failed = true
+			}
+		}
+		slog.Info("finished run", "reports", stats.Reports, "errors", stats.Errors, "duration", time.Since(timerRun))
 		if Configuration.Sleep == 0 {
+			closeDatabase()
+			if failed {
+				os.Exit(1)
+			}
 			os.Exit(0)
 		}
 		// Sleep until the next run
@@ -47,3 +101,51 @@ fetchLoop:
 		time.Sleep(time.Duration(Configuration.Sleep) * time.Second)
 	}
 }
+
+// runCommand runs a one-off maintenance command instead of fetching reports
+func runCommand(command string) {
+	switch command {
+	case "migrate":
+		if err := prepareSchema(true); err != nil {
+			slog.Error("error migrating database", "error", err)
+			os.Exit(1)
+		}
+	case "reingest":
+		checkSchema()
+		_, err := reingestArchive()
+		closeDatabase()
+		if err != nil {
+			slog.Error("error re-ingesting archive", "error", err)
+			os.Exit(1)
+		}
+	default:
+		slog.Error("unknown command", "command", command)
+		os.Exit(1)
+	}
+}
+
+// checkSchema makes sure the database schema matches this binary before anything is stored, or exits
+func checkSchema() {
+	migrate, err := Configuration.autoMigrate()
+	if err != nil {
+		slog.Error("invalid database settings", "error", err)
+		os.Exit(1)
+	}
+	if err := prepareSchema(migrate); err != nil {
+		slog.Error("database schema not usable", "error", err)
+		os.Exit(1)
+	}
+}
+
+// closeOnShutdown closes the database pool when the process is told to stop
+// Reports are stored in transactions and checkpoints only move after them, so stopping halfway is safe.
+func closeOnShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		slog.Info("shutting down", "signal", sig.String())
+		closeDatabase()
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,883 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// migration is a step in the schema of the database, migrations are applied in the order of their version
+// The statements use the type tokens of dialect.ddl, a statement group may hold several statements.
+type migration struct {
+	Version     int
+	Description string
+	Up          []string            // Statement groups for every dialect
+	Dialects    map[string][]string // Statement groups for a specific dialect, instead of Up
+}
+
+// migrations must only ever be appended to, a released migration is never changed
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "aggregate reports",
+		Up: []string{
+			// CREATE TABLE system
+			`
+			CREATE TABLE IF NOT EXISTS system (
+			id {id},
+			last_run {int}
+			);
+			`,
+			// CREATE TABLE metadata
+			`
+			CREATE TABLE IF NOT EXISTS metadata (
+			id {id},
+			organization {key},
+			email {key},
+			extra_contact_info {text},
+			report_id {key} UNIQUE NOT NULL,
+			begin_date {int},
+			end_date {int}
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS metadata_report_id ON metadata (report_id);
+			CREATE INDEX IF NOT EXISTS metadata_organization ON metadata (organization);
+			CREATE INDEX IF NOT EXISTS metadata_email ON metadata (email);
+			CREATE INDEX IF NOT EXISTS metadata_begin_date ON metadata (begin_date);
+			CREATE INDEX IF NOT EXISTS metadata_end_date ON metadata (end_date);
+			`,
+			// CREATE TABLE policy_published
+			`
+			CREATE TABLE IF NOT EXISTS policy_published (
+			id {id},
+			domain {key},
+			adkim {key},
+			aspf {key},
+			policy {key},
+			spolicy {key},
+			percentage {int},
+			report_id {key},
+			FOREIGN KEY (report_id)	REFERENCES metadata (report_id) 
+			   ON UPDATE CASCADE
+			   ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS policy_published_domain ON policy_published (domain);
+			CREATE INDEX IF NOT EXISTS policy_published_adkim ON policy_published (adkim);
+			CREATE INDEX IF NOT EXISTS policy_published_aspf ON policy_published (aspf);
+			CREATE INDEX IF NOT EXISTS policy_published_policy ON policy_published (policy);
+			CREATE INDEX IF NOT EXISTS policy_published_spolicy ON policy_published (spolicy);
+			CREATE INDEX IF NOT EXISTS policy_published_percentage ON policy_published (percentage);
+			CREATE INDEX IF NOT EXISTS policy_published_report_id ON policy_published (report_id);
+			`,
+			// CREATE TABLE record
+			`
+			CREATE TABLE IF NOT EXISTS record (
+			id {id},
+			source_ip {key},
+			count {int},
+			disposition {key},
+			dkim {key},
+			spf {key},
+			header_from {key},
+			dkim_auth_result_domain {key},
+			dkim_auth_result_result {key},
+			dkim_auth_result_selector {key},	
+			spf_auth_result_domain {key},
+			spf_auth_result_result {key},
+			spf_auth_result_scope {key},
+			report_id {key},
+			FOREIGN KEY (report_id)	REFERENCES metadata (report_id) 
+		   		ON UPDATE CASCADE
+		   		ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS record_source_ip ON record (source_ip);
+			CREATE INDEX IF NOT EXISTS record_count ON record (count);
+			CREATE INDEX IF NOT EXISTS record_disposition ON record (disposition);
+			CREATE INDEX IF NOT EXISTS record_dkim ON record (dkim);
+			CREATE INDEX IF NOT EXISTS record_spf ON record (spf);
+			CREATE INDEX IF NOT EXISTS record_header_from ON record (header_from);
+			CREATE INDEX IF NOT EXISTS record_dkim_auth_result_domain ON record (dkim_auth_result_domain);
+			CREATE INDEX IF NOT EXISTS record_dkim_auth_result_result ON record (dkim_auth_result_result);
+			CREATE INDEX IF NOT EXISTS record_dkim_auth_result_selector ON record (dkim_auth_result_selector);
+			CREATE INDEX IF NOT EXISTS record_spf_auth_result_domain ON record (spf_auth_result_domain);
+			CREATE INDEX IF NOT EXISTS record_spf_auth_result_result ON record (spf_auth_result_result);
+			CREATE INDEX IF NOT EXISTS record_spf_auth_result_scope ON record (spf_auth_result_scope);
+			CREATE INDEX IF NOT EXISTS record_report_id ON record (report_id);
+			`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "mailbox state, failure and TLS reports, archive and auth results",
+		Up: []string{
+			// ALTER TABLE metadata, where the report came from and what it held besides records
+			`
+			ALTER TABLE metadata ADD COLUMN account {key};
+			ALTER TABLE metadata ADD COLUMN folder {key};
+			ALTER TABLE metadata ADD COLUMN raw_sha256 {key};
+			ALTER TABLE metadata ADD COLUMN version {text};
+			ALTER TABLE metadata ADD COLUMN errors {text};
+			ALTER TABLE metadata ADD COLUMN dkim_result {text};
+			ALTER TABLE metadata ADD COLUMN dkim_domain {text};
+			CREATE INDEX IF NOT EXISTS metadata_account ON metadata (account);
+			CREATE INDEX IF NOT EXISTS metadata_folder ON metadata (folder);
+			CREATE INDEX IF NOT EXISTS metadata_raw_sha256 ON metadata (raw_sha256);
+			`,
+			// ALTER TABLE policy_published, the failure options and the DMARCbis fields
+			`
+			ALTER TABLE policy_published ADD COLUMN fo {text};
+			ALTER TABLE policy_published ADD COLUMN np {text};
+			ALTER TABLE policy_published ADD COLUMN psd {text};
+			ALTER TABLE policy_published ADD COLUMN testing {text};
+			`,
+			// ALTER TABLE record, the position links the auth results and override reasons to the record
+			`
+			ALTER TABLE record ADD COLUMN position {int};
+			ALTER TABLE record ADD COLUMN envelope_to {text};
+			ALTER TABLE record ADD COLUMN envelope_from {key};
+			CREATE INDEX IF NOT EXISTS record_envelope_from ON record (envelope_from);
+			`,
+			// DROP TABLE system, the last run is kept per folder in mailbox_state
+			`
+			DROP TABLE IF EXISTS system;
+			`,
+			// CREATE TABLE mailbox_state
+			`
+			CREATE TABLE IF NOT EXISTS mailbox_state (
+			id {id},
+			account {key} NOT NULL,
+			folder {key} NOT NULL,
+			uid_validity {int},
+			last_uid {int},
+			highest_modseq {int}
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS mailbox_state_account_folder ON mailbox_state (account, folder);
+			`,
+			// CREATE TABLE imported_files
+			`
+			CREATE TABLE IF NOT EXISTS imported_files (
+			id {id},
+			source {key} NOT NULL,
+			path {key} NOT NULL,
+			size {int},
+			modified {int},
+			imported {int}
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS imported_files_source_path ON imported_files (source, path);
+			`,
+			// CREATE TABLE pop3_uidl
+			`
+			CREATE TABLE IF NOT EXISTS pop3_uidl (
+			id {id},
+			account {key} NOT NULL,
+			uidl {key} NOT NULL,
+			created {int}
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS pop3_uidl_account_uidl ON pop3_uidl (account, uidl);
+			`,
+			// CREATE TABLE forensic_report
+			`
+			CREATE TABLE IF NOT EXISTS forensic_report (
+			id {id},
+			report_hash {key} UNIQUE NOT NULL,
+			reporter {key},
+			feedback_type {text},
+			user_agent {text},
+			version {text},
+			arrival_date {int},
+			reporting_mta {text},
+			source_ip {key},
+			incidents {int},
+			reported_domain {key},
+			reported_uri {text},
+			auth_failure {key},
+			delivery_result {text},
+			authentication_results {text},
+			original_envelope_id {text},
+			original_mail_from {text},
+			original_rcpt_to {text},
+			dkim_domain {text},
+			dkim_identity {text},
+			dkim_selector {text},
+			spf_dns {text},
+			identity_alignment {text},
+			account {text},
+			folder {text}
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS forensic_report_report_hash ON forensic_report (report_hash);
+			CREATE INDEX IF NOT EXISTS forensic_report_reported_domain ON forensic_report (reported_domain);
+			CREATE INDEX IF NOT EXISTS forensic_report_arrival_date ON forensic_report (arrival_date);
+			CREATE INDEX IF NOT EXISTS forensic_report_source_ip ON forensic_report (source_ip);
+			CREATE INDEX IF NOT EXISTS forensic_report_auth_failure ON forensic_report (auth_failure);
+			CREATE INDEX IF NOT EXISTS forensic_report_reporter ON forensic_report (reporter);
+			`,
+			// CREATE TABLE forensic_header
+			`
+			CREATE TABLE IF NOT EXISTS forensic_header (
+			id {id},
+			report_hash {key},
+			position {int},
+			name {key},
+			value {text},
+			FOREIGN KEY (report_hash) REFERENCES forensic_report (report_hash)
+				ON UPDATE CASCADE
+				ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS forensic_header_report_hash ON forensic_header (report_hash);
+			CREATE INDEX IF NOT EXISTS forensic_header_name ON forensic_header (name);
+			`,
+			// CREATE TABLE tlsrpt_report
+			`
+			CREATE TABLE IF NOT EXISTS tlsrpt_report (
+			id {id},
+			organization {key},
+			contact_info {text},
+			report_id {key} UNIQUE NOT NULL,
+			begin_date {int},
+			end_date {int},
+			account {text},
+			folder {text},
+			raw_sha256 {text}
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS tlsrpt_report_report_id ON tlsrpt_report (report_id);
+			CREATE INDEX IF NOT EXISTS tlsrpt_report_organization ON tlsrpt_report (organization);
+			CREATE INDEX IF NOT EXISTS tlsrpt_report_begin_date ON tlsrpt_report (begin_date);
+			`,
+			// CREATE TABLE tlsrpt_policy
+			`
+			CREATE TABLE IF NOT EXISTS tlsrpt_policy (
+			id {id},
+			report_id {key},
+			position {int},
+			policy_type {key},
+			policy_domain {key},
+			policy_string {text},
+			mx_host {text},
+			successful_session_count {int},
+			failure_session_count {int},
+			FOREIGN KEY (report_id) REFERENCES tlsrpt_report (report_id)
+				ON UPDATE CASCADE
+				ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS tlsrpt_policy_report_id ON tlsrpt_policy (report_id);
+			CREATE INDEX IF NOT EXISTS tlsrpt_policy_policy_type ON tlsrpt_policy (policy_type);
+			CREATE INDEX IF NOT EXISTS tlsrpt_policy_policy_domain ON tlsrpt_policy (policy_domain);
+			`,
+			// CREATE TABLE tlsrpt_failure, policy_position is the position of the policy in the report
+			`
+			CREATE TABLE IF NOT EXISTS tlsrpt_failure (
+			id {id},
+			report_id {key},
+			policy_position {int},
+			result_type {key},
+			sending_mta_ip {text},
+			receiving_mx_hostname {key},
+			receiving_mx_helo {text},
+			receiving_ip {text},
+			failed_session_count {int},
+			additional_information {text},
+			failure_reason_code {text},
+			FOREIGN KEY (report_id) REFERENCES tlsrpt_report (report_id)
+				ON UPDATE CASCADE
+				ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS tlsrpt_failure_report_id ON tlsrpt_failure (report_id);
+			CREATE INDEX IF NOT EXISTS tlsrpt_failure_result_type ON tlsrpt_failure (result_type);
+			CREATE INDEX IF NOT EXISTS tlsrpt_failure_receiving_mx_hostname ON tlsrpt_failure (receiving_mx_hostname);
+			`,
+			// CREATE TABLE report_archive, the decompressed reports as they were received
+			`
+			CREATE TABLE IF NOT EXISTS report_archive (
+			id {id},
+			sha256 {key} UNIQUE NOT NULL,
+			kind {text},
+			content {longtext},
+			headers {longtext},
+			account {text},
+			folder {text},
+			created {int},
+			dkim_result {text},
+			dkim_domain {text}
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS report_archive_sha256 ON report_archive (sha256);
+			`,
+			// CREATE TABLE ingest_errors
+			`
+			CREATE TABLE IF NOT EXISTS ingest_errors (
+			id {id},
+			account {text},
+			folder {text},
+			uid {int},
+			message_id {key},
+			subject {text},
+			reporter {key},
+			error {text},
+			raw_ref {text},
+			raw_sha256 {text},
+			raw_size {int},
+			created {int}
+			);
+			CREATE INDEX IF NOT EXISTS ingest_errors_message_id ON ingest_errors (message_id);
+			CREATE INDEX IF NOT EXISTS ingest_errors_reporter ON ingest_errors (reporter);
+			CREATE INDEX IF NOT EXISTS ingest_errors_created ON ingest_errors (created);
+			`,
+			// CREATE TABLE policy_override_reason, the reasons for the policy that was applied to a record
+			`
+			CREATE TABLE IF NOT EXISTS policy_override_reason (
+			id {id},
+			report_id {key},
+			record_position {int},
+			position {int},
+			type {key},
+			comment {text},
+			FOREIGN KEY (report_id) REFERENCES metadata (report_id)
+				ON UPDATE CASCADE
+				ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS policy_override_reason_report_id ON policy_override_reason (report_id, record_position);
+			CREATE INDEX IF NOT EXISTS policy_override_reason_type ON policy_override_reason (type);
+			`,
+			// CREATE TABLE dkim_auth_result, every DKIM result of a record, record_position is the position of the record in the report
+			`
+			CREATE TABLE IF NOT EXISTS dkim_auth_result (
+			id {id},
+			report_id {key},
+			record_position {int},
+			position {int},
+			domain {key},
+			selector {text},
+			result {key},
+			human_result {text},
+			FOREIGN KEY (report_id) REFERENCES metadata (report_id)
+				ON UPDATE CASCADE
+				ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS dkim_auth_result_report_id ON dkim_auth_result (report_id, record_position);
+			CREATE INDEX IF NOT EXISTS dkim_auth_result_domain ON dkim_auth_result (domain);
+			CREATE INDEX IF NOT EXISTS dkim_auth_result_result ON dkim_auth_result (result);
+			`,
+			// CREATE TABLE spf_auth_result, every SPF result of a record, record_position is the position of the record in the report
+			`
+			CREATE TABLE IF NOT EXISTS spf_auth_result (
+			id {id},
+			report_id {key},
+			record_position {int},
+			position {int},
+			domain {key},
+			scope {text},
+			result {key},
+			FOREIGN KEY (report_id) REFERENCES metadata (report_id)
+				ON UPDATE CASCADE
+				ON DELETE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS spf_auth_result_report_id ON spf_auth_result (report_id, record_position);
+			CREATE INDEX IF NOT EXISTS spf_auth_result_domain ON spf_auth_result (domain);
+			CREATE INDEX IF NOT EXISTS spf_auth_result_result ON spf_auth_result (result);
+			`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "aggregate reports unique per reporter, report ID and begin date",
+		// The report_id of metadata loses its UNIQUE constraint and the other tables refer to the id of
+		// metadata instead. Not every dialect can drop a constraint, so the tables are rebuilt: filled from
+		// the old tables, linked through the report_id that was unique until now, and renamed.
+		Up: []string{
+			// CREATE TABLE metadata_v3
+			`
+			CREATE TABLE metadata_v3 (
+			id {id},
+			organization {key},
+			email {key},
+			extra_contact_info {text},
+			report_id {key} NOT NULL,
+			begin_date {int},
+			end_date {int},
+			account {key},
+			folder {key},
+			raw_sha256 {key},
+			version {text},
+			errors {text},
+			dkim_result {text},
+			dkim_domain {text}
+			);
+			INSERT INTO metadata_v3 (organization, email, extra_contact_info, report_id, begin_date, end_date, account, folder, raw_sha256, version, errors, dkim_result, dkim_domain)
+			SELECT COALESCE(organization, ''), COALESCE(email, ''), extra_contact_info, report_id, COALESCE(begin_date, 0), end_date, account, folder, raw_sha256, version, errors, dkim_result, dkim_domain
+			FROM metadata ORDER BY id;
+			`,
+			// CREATE TABLE policy_published_v3
+			`
+			CREATE TABLE policy_published_v3 (
+			id {id},
+			metadata_id {int} NOT NULL,
+			domain {key},
+			adkim {key},
+			aspf {key},
+			policy {key},
+			spolicy {key},
+			percentage {int},
+			fo {text},
+			np {text},
+			psd {text},
+			testing {text},
+			FOREIGN KEY (metadata_id) REFERENCES metadata_v3 (id)
+				ON DELETE CASCADE
+			);
+			INSERT INTO policy_published_v3 (metadata_id, domain, adkim, aspf, policy, spolicy, percentage, fo, np, psd, testing)
+			SELECT m.id, p.domain, p.adkim, p.aspf, p.policy, p.spolicy, p.percentage, p.fo, p.np, p.psd, p.testing
+			FROM policy_published p JOIN metadata_v3 m ON m.report_id = p.report_id ORDER BY p.id;
+			`,
+			// CREATE TABLE record_v3
+			`
+			CREATE TABLE record_v3 (
+			id {id},
+			metadata_id {int} NOT NULL,
+			position {int},
+			source_ip {key},
+			count {int},
+			disposition {key},
+			dkim {key},
+			spf {key},
+			header_from {key},
+			dkim_auth_result_domain {key},
+			dkim_auth_result_result {key},
+			dkim_auth_result_selector {key},
+			spf_auth_result_domain {key},
+			spf_auth_result_result {key},
+			spf_auth_result_scope {key},
+			envelope_to {text},
+			envelope_from {key},
+			FOREIGN KEY (metadata_id) REFERENCES metadata_v3 (id)
+				ON DELETE CASCADE
+			);
+			INSERT INTO record_v3 (metadata_id, position, source_ip, count, disposition, dkim, spf, header_from, dkim_auth_result_domain, dkim_auth_result_result, dkim_auth_result_selector, spf_auth_result_domain, spf_auth_result_result, spf_auth_result_scope, envelope_to, envelope_from)
+			SELECT m.id, r.position, r.source_ip, r.count, r.disposition, r.dkim, r.spf, r.header_from, r.dkim_auth_result_domain, r.dkim_auth_result_result, r.dkim_auth_result_selector, r.spf_auth_result_domain, r.spf_auth_result_result, r.spf_auth_result_scope, r.envelope_to, r.envelope_from
+			FROM record r JOIN metadata_v3 m ON m.report_id = r.report_id ORDER BY r.id;
+			`,
+			// CREATE TABLE policy_override_reason_v3
+			`
+			CREATE TABLE policy_override_reason_v3 (
+			id {id},
+			metadata_id {int} NOT NULL,
+			record_position {int},
+			position {int},
+			type {key},
+			comment {text},
+			FOREIGN KEY (metadata_id) REFERENCES metadata_v3 (id)
+				ON DELETE CASCADE
+			);
+			INSERT INTO policy_override_reason_v3 (metadata_id, record_position, position, type, comment)
+			SELECT m.id, o.record_position, o.position, o.type, o.comment
+			FROM policy_override_reason o JOIN metadata_v3 m ON m.report_id = o.report_id ORDER BY o.id;
+			`,
+			// CREATE TABLE dkim_auth_result_v3
+			`
+			CREATE TABLE dkim_auth_result_v3 (
+			id {id},
+			metadata_id {int} NOT NULL,
+			record_position {int},
+			position {int},
+			domain {key},
+			selector {text},
+			result {key},
+			human_result {text},
+			FOREIGN KEY (metadata_id) REFERENCES metadata_v3 (id)
+				ON DELETE CASCADE
+			);
+			INSERT INTO dkim_auth_result_v3 (metadata_id, record_position, position, domain, selector, result, human_result)
+			SELECT m.id, a.record_position, a.position, a.domain, a.selector, a.result, a.human_result
+			FROM dkim_auth_result a JOIN metadata_v3 m ON m.report_id = a.report_id ORDER BY a.id;
+			`,
+			// CREATE TABLE spf_auth_result_v3
+			`
+			CREATE TABLE spf_auth_result_v3 (
+			id {id},
+			metadata_id {int} NOT NULL,
+			record_position {int},
+			position {int},
+			domain {key},
+			scope {text},
+			result {key},
+			FOREIGN KEY (metadata_id) REFERENCES metadata_v3 (id)
+				ON DELETE CASCADE
+			);
+			INSERT INTO spf_auth_result_v3 (metadata_id, record_position, position, domain, scope, result)
+			SELECT m.id, a.record_position, a.position, a.domain, a.scope, a.result
+			FROM spf_auth_result a JOIN metadata_v3 m ON m.report_id = a.report_id ORDER BY a.id;
+			`,
+			// DROP TABLE the old tables, those that refer to metadata first
+			`
+			DROP TABLE spf_auth_result;
+			DROP TABLE dkim_auth_result;
+			DROP TABLE policy_override_reason;
+			DROP TABLE record;
+			DROP TABLE policy_published;
+			DROP TABLE metadata;
+			`,
+			// ALTER TABLE RENAME the new tables, metadata first so the references follow it
+			`
+			ALTER TABLE metadata_v3 RENAME TO metadata;
+			ALTER TABLE policy_published_v3 RENAME TO policy_published;
+			ALTER TABLE record_v3 RENAME TO record;
+			ALTER TABLE policy_override_reason_v3 RENAME TO policy_override_reason;
+			ALTER TABLE dkim_auth_result_v3 RENAME TO dkim_auth_result;
+			ALTER TABLE spf_auth_result_v3 RENAME TO spf_auth_result;
+			`,
+			// CREATE INDEX metadata, a report is identified by its reporter, report ID and begin date
+			`
+			CREATE UNIQUE INDEX IF NOT EXISTS metadata_report ON metadata (organization, email, report_id, begin_date);
+			CREATE INDEX IF NOT EXISTS metadata_report_id ON metadata (report_id);
+			CREATE INDEX IF NOT EXISTS metadata_organization ON metadata (organization);
+			CREATE INDEX IF NOT EXISTS metadata_email ON metadata (email);
+			CREATE INDEX IF NOT EXISTS metadata_begin_date ON metadata (begin_date);
+			CREATE INDEX IF NOT EXISTS metadata_end_date ON metadata (end_date);
+			CREATE INDEX IF NOT EXISTS metadata_account ON metadata (account);
+			CREATE INDEX IF NOT EXISTS metadata_folder ON metadata (folder);
+			CREATE INDEX IF NOT EXISTS metadata_raw_sha256 ON metadata (raw_sha256);
+			`,
+			// CREATE INDEX policy_published
+			`
+			CREATE INDEX IF NOT EXISTS policy_published_metadata_id ON policy_published (metadata_id);
+			CREATE INDEX IF NOT EXISTS policy_published_domain ON policy_published (domain);
+			CREATE INDEX IF NOT EXISTS policy_published_adkim ON policy_published (adkim);
+			CREATE INDEX IF NOT EXISTS policy_published_aspf ON policy_published (aspf);
+			CREATE INDEX IF NOT EXISTS policy_published_policy ON policy_published (policy);
+			CREATE INDEX IF NOT EXISTS policy_published_spolicy ON policy_published (spolicy);
+			CREATE INDEX IF NOT EXISTS policy_published_percentage ON policy_published (percentage);
+			`,
+			// CREATE INDEX record
+			`
+			CREATE INDEX IF NOT EXISTS record_metadata_id ON record (metadata_id, position);
+			CREATE INDEX IF NOT EXISTS record_source_ip ON record (source_ip);
+			CREATE INDEX IF NOT EXISTS record_count ON record (count);
+			CREATE INDEX IF NOT EXISTS record_disposition ON record (disposition);
+			CREATE INDEX IF NOT EXISTS record_dkim ON record (dkim);
+			CREATE INDEX IF NOT EXISTS record_spf ON record (spf);
+			CREATE INDEX IF NOT EXISTS record_header_from ON record (header_from);
+			CREATE INDEX IF NOT EXISTS record_dkim_auth_result_domain ON record (dkim_auth_result_domain);
+			CREATE INDEX IF NOT EXISTS record_dkim_auth_result_result ON record (dkim_auth_result_result);
+			CREATE INDEX IF NOT EXISTS record_dkim_auth_result_selector ON record (dkim_auth_result_selector);
+			CREATE INDEX IF NOT EXISTS record_spf_auth_result_domain ON record (spf_auth_result_domain);
+			CREATE INDEX IF NOT EXISTS record_spf_auth_result_result ON record (spf_auth_result_result);
+			CREATE INDEX IF NOT EXISTS record_spf_auth_result_scope ON record (spf_auth_result_scope);
+			CREATE INDEX IF NOT EXISTS record_envelope_from ON record (envelope_from);
+			`,
+			// CREATE INDEX policy_override_reason, dkim_auth_result and spf_auth_result
+			`
+			CREATE INDEX IF NOT EXISTS policy_override_reason_metadata_id ON policy_override_reason (metadata_id, record_position);
+			CREATE INDEX IF NOT EXISTS policy_override_reason_type ON policy_override_reason (type);
+			CREATE INDEX IF NOT EXISTS dkim_auth_result_metadata_id ON dkim_auth_result (metadata_id, record_position);
+			CREATE INDEX IF NOT EXISTS dkim_auth_result_domain ON dkim_auth_result (domain);
+			CREATE INDEX IF NOT EXISTS dkim_auth_result_result ON dkim_auth_result (result);
+			CREATE INDEX IF NOT EXISTS spf_auth_result_metadata_id ON spf_auth_result (metadata_id, record_position);
+			CREATE INDEX IF NOT EXISTS spf_auth_result_domain ON spf_auth_result (domain);
+			CREATE INDEX IF NOT EXISTS spf_auth_result_result ON spf_auth_result (result);
+			`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "IMAP messages kept for retention",
+		Up: []string{
+			// CREATE TABLE imap_stored, the messages whose report is stored and that retention may delete
+			`
+			CREATE TABLE IF NOT EXISTS imap_stored (
+			id {id},
+			account {key} NOT NULL,
+			folder {key} NOT NULL,
+			uid_validity {int} NOT NULL,
+			uid {int} NOT NULL,
+			created {int}
+			);
+			CREATE UNIQUE INDEX IF NOT EXISTS imap_stored_message ON imap_stored (account, folder, uid_validity, uid);
+			`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "TLS reports unique per organization, report ID and begin date",
+		// Like the aggregate reports in version 3: TLS report IDs are only unique per reporter, so the
+		// report_id of tlsrpt_report loses its UNIQUE constraint and the other tables refer to its id.
+		Up: []string{
+			// CREATE TABLE tlsrpt_report_v5
+			`
+			CREATE TABLE tlsrpt_report_v5 (
+			id {id},
+			organization {key},
+			contact_info {text},
+			report_id {key} NOT NULL,
+			begin_date {int},
+			end_date {int},
+			account {text},
+			folder {text},
+			raw_sha256 {text}
+			);
+			INSERT INTO tlsrpt_report_v5 (organization, contact_info, report_id, begin_date, end_date, account, folder, raw_sha256)
+			SELECT COALESCE(organization, ''), contact_info, report_id, COALESCE(begin_date, 0), end_date, account, folder, raw_sha256
+			FROM tlsrpt_report ORDER BY id;
+			`,
+			// CREATE TABLE tlsrpt_policy_v5
+			`
+			CREATE TABLE tlsrpt_policy_v5 (
+			id {id},
+			tlsrpt_report_id {int} NOT NULL,
+			position {int},
+			policy_type {key},
+			policy_domain {key},
+			policy_string {text},
+			mx_host {text},
+			successful_session_count {int},
+			failure_session_count {int},
+			FOREIGN KEY (tlsrpt_report_id) REFERENCES tlsrpt_report_v5 (id)
+				ON DELETE CASCADE
+			);
+			INSERT INTO tlsrpt_policy_v5 (tlsrpt_report_id, position, policy_type, policy_domain, policy_string, mx_host, successful_session_count, failure_session_count)
+			SELECT r.id, p.position, p.policy_type, p.policy_domain, p.policy_string, p.mx_host, p.successful_session_count, p.failure_session_count
+			FROM tlsrpt_policy p JOIN tlsrpt_report_v5 r ON r.report_id = p.report_id ORDER BY p.id;
+			`,
+			// CREATE TABLE tlsrpt_failure_v5
+			`
+			CREATE TABLE tlsrpt_failure_v5 (
+			id {id},
+			tlsrpt_report_id {int} NOT NULL,
+			policy_position {int},
+			result_type {key},
+			sending_mta_ip {text},
+			receiving_mx_hostname {key},
+			receiving_mx_helo {text},
+			receiving_ip {text},
+			failed_session_count {int},
+			additional_information {text},
+			failure_reason_code {text},
+			FOREIGN KEY (tlsrpt_report_id) REFERENCES tlsrpt_report_v5 (id)
+				ON DELETE CASCADE
+			);
+			INSERT INTO tlsrpt_failure_v5 (tlsrpt_report_id, policy_position, result_type, sending_mta_ip, receiving_mx_hostname, receiving_mx_helo, receiving_ip, failed_session_count, additional_information, failure_reason_code)
+			SELECT r.id, f.policy_position, f.result_type, f.sending_mta_ip, f.receiving_mx_hostname, f.receiving_mx_helo, f.receiving_ip, f.failed_session_count, f.additional_information, f.failure_reason_code
+			FROM tlsrpt_failure f JOIN tlsrpt_report_v5 r ON r.report_id = f.report_id ORDER BY f.id;
+			`,
+			// DROP TABLE the old tables, those that refer to tlsrpt_report first
+			`
+			DROP TABLE tlsrpt_failure;
+			DROP TABLE tlsrpt_policy;
+			DROP TABLE tlsrpt_report;
+			`,
+			// ALTER TABLE RENAME the new tables, tlsrpt_report first so the references follow it
+			`
+			ALTER TABLE tlsrpt_report_v5 RENAME TO tlsrpt_report;
+			ALTER TABLE tlsrpt_policy_v5 RENAME TO tlsrpt_policy;
+			ALTER TABLE tlsrpt_failure_v5 RENAME TO tlsrpt_failure;
+			`,
+			// CREATE INDEX tlsrpt_report, a report is identified by its organization, report ID and begin date
+			`
+			CREATE UNIQUE INDEX IF NOT EXISTS tlsrpt_report_report ON tlsrpt_report (organization, report_id, begin_date);
+			CREATE INDEX IF NOT EXISTS tlsrpt_report_report_id ON tlsrpt_report (report_id);
+			CREATE INDEX IF NOT EXISTS tlsrpt_report_organization ON tlsrpt_report (organization);
+			CREATE INDEX IF NOT EXISTS tlsrpt_report_begin_date ON tlsrpt_report (begin_date);
+			`,
+			// CREATE INDEX tlsrpt_policy and tlsrpt_failure
+			`
+			CREATE INDEX IF NOT EXISTS tlsrpt_policy_tlsrpt_report_id ON tlsrpt_policy (tlsrpt_report_id, position);
+			CREATE INDEX IF NOT EXISTS tlsrpt_policy_policy_type ON tlsrpt_policy (policy_type);
+			CREATE INDEX IF NOT EXISTS tlsrpt_policy_policy_domain ON tlsrpt_policy (policy_domain);
+			CREATE INDEX IF NOT EXISTS tlsrpt_failure_tlsrpt_report_id ON tlsrpt_failure (tlsrpt_report_id, policy_position);
+			CREATE INDEX IF NOT EXISTS tlsrpt_failure_result_type ON tlsrpt_failure (result_type);
+			CREATE INDEX IF NOT EXISTS tlsrpt_failure_receiving_mx_hostname ON tlsrpt_failure (receiving_mx_hostname);
+			`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "Archived reports kept as bytes",
+		// Reports and headers are archived exactly as received, which need not be valid UTF-8.
+		// SQLite cannot change the type of a column, the table is copied instead.
+		Up: []string{
+			// CREATE TABLE report_archive_v6
+			`
+			CREATE TABLE report_archive_v6 (
+			id {id},
+			sha256 {key} UNIQUE NOT NULL,
+			kind {text},
+			content {blob},
+			headers {blob},
+			account {text},
+			folder {text},
+			created {int},
+			dkim_result {text},
+			dkim_domain {text}
+			);
+			INSERT INTO report_archive_v6 (id, sha256, kind, content, headers, account, folder, created, dkim_result, dkim_domain)
+			SELECT id, sha256, kind, CAST(content AS BLOB), CAST(headers AS BLOB), account, folder, created, dkim_result, dkim_domain
+			FROM report_archive ORDER BY id;
+			`,
+			// DROP TABLE report_archive and ALTER TABLE RENAME report_archive_v6
+			`
+			DROP TABLE report_archive;
+			ALTER TABLE report_archive_v6 RENAME TO report_archive;
+			CREATE UNIQUE INDEX IF NOT EXISTS report_archive_sha256 ON report_archive (sha256);
+			`,
+		},
+		Dialects: map[string][]string{
+			// ALTER TABLE report_archive, MySQL keeps the stored bytes
+			"mysql": {
+				`
+				ALTER TABLE report_archive MODIFY content {blob}, MODIFY headers {blob};
+				`,
+			},
+			// ALTER TABLE report_archive, the text so far was valid UTF-8
+			"postgres": {
+				`
+				ALTER TABLE report_archive
+				ALTER COLUMN content TYPE {blob} USING convert_to(content, 'UTF8'),
+				ALTER COLUMN headers TYPE {blob} USING convert_to(headers, 'UTF8');
+				`,
+			},
+		},
+	},
+	{
+		Version:     7,
+		Description: "POP3 messages that failed are retried",
+		Up: []string{
+			// ALTER TABLE pop3_uidl, messages that could not be stored are kept apart to be retrieved again
+			`
+			ALTER TABLE pop3_uidl ADD COLUMN failed {int};
+			`,
+		},
+	},
+}
+
+// How the schema of the database is migrated
+const (
+	migrateAuto   = "auto"   // At startup
+	migrateManual = "manual" // With the migrate command only
+)
+
+// schemaVersion is the version of the schema this binary works with
+func schemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+const (
+	createSchemaVersion = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+	version {int} PRIMARY KEY,
+	description {text},
+	applied {int}
+	);
+	`
+	// A scalar subquery, go-mysql-server returns no row at all for MAX over an empty primary key
+	selectSchemaVersion = `SELECT COALESCE((SELECT MAX(version) FROM schema_version), 0)`
+	insertSchemaVersion = `INSERT INTO schema_version (version, description, applied) VALUES ($1, $2, $3)`
+)
+
+// prepareSchema checks the schema of the database at startup and migrates it when allowed
+// It refuses a database that is newer than this binary, and one that is older unless migrate is set.
+func prepareSchema(migrate bool) error {
+	db := database{}
+	err := retryConnect(func() error {
+		err := db.connect(Configuration.Database.Driver, Configuration.Database.ConnectionString)
+		if err != nil && db.backendDB != nil {
+			db.backendDB.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	version, err := db.currentSchemaVersion()
+	if err != nil {
+		return err
+	}
+	switch {
+	case version > schemaVersion():
+		return fmt.Errorf("database schema version %d is newer than version %d of this dmarcfetch, upgrade dmarcfetch", version, schemaVersion())
+	case version == schemaVersion():
+		return nil
+	case !migrate:
+		return fmt.Errorf("database schema version %d is older than version %d of this dmarcfetch, run dmarcfetch migrate", version, schemaVersion())
+	}
+	return db.migrate(version)
+}
+
+// currentSchemaVersion returns the version of the schema of the database, 0 for an empty database
+// A database created before schema versions were kept holds the tables of the first migration, it is
+// recorded as such.
+func (db *database) currentSchemaVersion() (int, error) {
+	for _, statement := range db.dialect.ddl(createSchemaVersion) {
+		if _, err := db.backendDB.Exec(statement); err != nil {
+			slog.Error("error creating table", "table", "schema_version", "error", err)
+			return 0, err
+		}
+	}
+	version := 0
+	if err := db.backendDB.QueryRow(selectSchemaVersion).Scan(&version); err != nil {
+		slog.Error("error querying schema_version", "error", err)
+		return 0, err
+	}
+	if version > 0 {
+		return version, nil
+	}
+	// Any error means the table is not there
+	rows, err := db.backendDB.Query("SELECT id FROM metadata WHERE 1 = 0")
+	if err != nil {
+		return 0, nil
+	}
+	rows.Close()
+	slog.Info("database without schema version, taking it to be version 1")
+	if err := db.recordMigration(db.backendDB, migrations[0]); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// migrate applies the migrations after version, each in a transaction of its own
+// MySQL commits every DDL statement on its own, there a failed migration may leave part of it behind.
+func (db *database) migrate(version int) error {
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		slog.Info("migrating database", "version", m.Version, "description", m.Description)
+		groups := m.Up
+		if dialectGroups, ok := m.Dialects[db.dialect.Name]; ok {
+			groups = dialectGroups
+		}
+		err := db.inTransaction(func(tx *sql.Tx) error {
+			for _, group := range groups {
+				for _, statement := range db.dialect.ddl(group) {
+					if _, err := tx.Exec(statement); err != nil && !isDuplicateIndex(err) {
+						slog.Error("error migrating database", "version", m.Version, "statement", statement, "error", err)
+						return err
+					}
+				}
+			}
+			return db.recordMigration(tx, m)
+		})
+		if err != nil {
+			if db.dialect.Name == "mysql" {
+				slog.Error("MySQL does not roll back a failed migration, restore the database from a backup before trying again", "version", m.Version)
+			}
+			return fmt.Errorf("migration to version %d failed: %w", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// execer runs statements, either a database or a transaction
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// recordMigration notes in schema_version that a migration has been applied
+func (db *database) recordMigration(execer execer, m migration) error {
+	query, err := db.dialect.rebind(insertSchemaVersion)
+	if err != nil {
+		return err
+	}
+	if _, err := execer.Exec(query, m.Version, m.Description, time.Now().Unix()); err != nil {
+		slog.Error("error inserting schema_version", "error", err)
+		return err
+	}
+	return nil
+}
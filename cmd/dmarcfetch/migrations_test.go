@@ -0,0 +1,218 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// useMigrations replaces the migrations until the test ends
+func useMigrations(t *testing.T, ms []migration) {
+	t.Helper()
+	previous := migrations
+	migrations = ms
+	t.Cleanup(func() { migrations = previous })
+}
+
+// testTableExists returns true if the SQLite database holds table
+func testTableExists(t *testing.T, table string) bool {
+	t.Helper()
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err := db.backendDB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestMigrateUsesTheGroupsOfTheDialect(t *testing.T) {
+	useMigrations(t, append(slices.Clone(migrations), migration{
+		Version:     len(migrations) + 1,
+		Description: "test",
+		Up:          []string{`CREATE TABLE every_dialect (id {id});`},
+		Dialects: map[string][]string{
+			"sqlite": {`CREATE TABLE for_sqlite (id {id});`},
+		},
+	}))
+	useTestDatabase(t)
+	if testTableExists(t, "every_dialect") || !testTableExists(t, "for_sqlite") {
+		t.Errorf("migration ran Up instead of the statement groups for SQLite")
+	}
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	useTestDatabase(t)
+	useMigrations(t, append(slices.Clone(migrations), migration{
+		Version:     len(migrations) + 1,
+		Description: "test",
+		Up: []string{
+			`CREATE TABLE applied_first (id {id});`,
+			`INSERT INTO missing_table (id) VALUES (1);`,
+		},
+	}))
+	if err := prepareSchema(true); err == nil {
+		t.Fatal("prepareSchema succeeded, want the migration to fail")
+	}
+	if testTableExists(t, "applied_first") {
+		t.Errorf("the statement before the failure was kept")
+	}
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := 0
+	if err := db.backendDB.QueryRow(selectSchemaVersion).Scan(&version); err != nil || version != len(migrations)-1 {
+		t.Errorf("schema version %d (%v), want %d", version, err, len(migrations)-1)
+	}
+}
+
+// version2Reports seeds aggregate reports in the schema of version 2, where the other tables refer to
+// the report_id of metadata. Two reporters, the first with two records.
+var version2Reports = []string{
+	`INSERT INTO metadata (organization, email, report_id, begin_date, end_date, account, folder) VALUES
+		('google.com', 'noreply-dmarc-support@google.com', 'r-google', 1700000000, 1700086399, 'test', 'INBOX'),
+		('microsoft.com', 'dmarcreport@microsoft.com', 'r-microsoft', 1700000000, 1700086399, 'test', 'INBOX')`,
+	`INSERT INTO policy_published (report_id, domain, policy) VALUES
+		('r-google', 'google.example', 'none'),
+		('r-microsoft', 'microsoft.example', 'reject')`,
+	`INSERT INTO record (report_id, position, source_ip, count) VALUES
+		('r-google', 0, '192.0.2.1', 1),
+		('r-google', 1, '192.0.2.2', 2),
+		('r-microsoft', 0, '198.51.100.1', 3)`,
+	`INSERT INTO dkim_auth_result (report_id, record_position, position, domain, result) VALUES
+		('r-google', 0, 0, 'google-0.example', 'pass'),
+		('r-google', 1, 0, 'google-1.example', 'fail'),
+		('r-microsoft', 0, 0, 'microsoft-0.example', 'pass')`,
+	`INSERT INTO spf_auth_result (report_id, record_position, position, domain, result) VALUES
+		('r-google', 0, 0, 'google-0.example', 'pass'),
+		('r-google', 1, 0, 'google-1.example', 'softfail'),
+		('r-microsoft', 0, 0, 'microsoft-0.example', 'fail')`,
+	`INSERT INTO policy_override_reason (report_id, record_position, position, type) VALUES
+		('r-microsoft', 0, 0, 'forwarded')`,
+}
+
+func TestMigrateToMetadataIDOnSQLite(t *testing.T) {
+	testMigrateToMetadataID(t, "sqlite", filepath.Join(t.TempDir(), "dmarc.db"))
+}
+
+func TestMigrateToMetadataIDOnMySQL(t *testing.T) {
+	testMigrateToMetadataID(t, "mysql", emptyServerDatabase(t, "mysql"))
+}
+
+func TestMigrateToMetadataIDOnPostgres(t *testing.T) {
+	testMigrateToMetadataID(t, "postgres", emptyServerDatabase(t, "postgres"))
+}
+
+// testMigrateToMetadataID seeds a database of version 2 and migrates it to the current version
+// Migration 3 rebuilds the aggregate tables, every row must end up under the id of its own report and
+// the foreign keys must follow the renamed tables.
+func testMigrateToMetadataID(t *testing.T, driver, connectionString string) {
+	all := migrations
+	useMigrations(t, all[:2])
+	useDatabase(t, driver, connectionString)
+	migrations = all
+	seed := database{}
+	if err := seed.connect(driver, connectionString); err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range version2Reports {
+		if _, err := seed.backendDB.Exec(statement); err != nil {
+			seed.Close()
+			t.Fatalf("seeding version 2: %v", err)
+		}
+	}
+	seed.Close()
+
+	if err := prepareSchema(true); err != nil {
+		t.Fatalf("migrating version 2: %v", err)
+	}
+	for table, want := range map[string]int{"metadata": 2, "policy_published": 2, "record": 3, "dkim_auth_result": 3, "spf_auth_result": 3, "policy_override_reason": 1} {
+		if count := testCount(t, table); count != want {
+			t.Errorf("%s holds %d rows after migrating, want %d", table, count, want)
+		}
+	}
+	links := map[string][]string{
+		`SELECT m.report_id, p.domain FROM policy_published p JOIN metadata m ON m.id = p.metadata_id ORDER BY m.report_id`: {
+			"r-google google.example", "r-microsoft microsoft.example",
+		},
+		`SELECT m.report_id, r.source_ip FROM record r JOIN metadata m ON m.id = r.metadata_id ORDER BY m.report_id, r.position`: {
+			"r-google 192.0.2.1", "r-google 192.0.2.2", "r-microsoft 198.51.100.1",
+		},
+		`SELECT m.report_id, a.domain FROM dkim_auth_result a JOIN metadata m ON m.id = a.metadata_id ORDER BY m.report_id, a.record_position`: {
+			"r-google google-0.example", "r-google google-1.example", "r-microsoft microsoft-0.example",
+		},
+		`SELECT m.report_id, a.result FROM spf_auth_result a JOIN metadata m ON m.id = a.metadata_id ORDER BY m.report_id, a.record_position`: {
+			"r-google pass", "r-google softfail", "r-microsoft fail",
+		},
+		`SELECT m.report_id, o.type FROM policy_override_reason o JOIN metadata m ON m.id = o.metadata_id ORDER BY m.report_id`: {
+			"r-microsoft forwarded",
+		},
+	}
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for query, want := range links {
+		rows, err := db.backendDB.Query(query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		got := make([]string, 0)
+		for rows.Next() {
+			var reportID, value string
+			if err := rows.Scan(&reportID, &value); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, reportID+" "+value)
+		}
+		rows.Close()
+		if !slices.Equal(got, want) {
+			t.Errorf("%s\nlinks %q, want %q", query, got, want)
+		}
+	}
+
+	// A report ID is no longer unique by itself, another reporter may use it
+	rep, err := decodeReportFile("google.com!example.com!1700000000!1700086399.xml", []byte(testAggregateXML("r-microsoft")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, failed, err := storeReports([]*fetchedReport{rep})
+	if err != nil || len(stored) != 1 || len(failed) != 0 {
+		t.Fatalf("storeReports stored %d and refused %d (%v), want the report stored", len(stored), len(failed), err)
+	}
+	reporters := 0
+	if err := db.backendDB.QueryRow(`SELECT COUNT(*) FROM metadata WHERE report_id = 'r-microsoft'`).Scan(&reporters); err != nil {
+		t.Fatal(err)
+	}
+	if reporters != 2 {
+		t.Errorf("%d reports with the ID r-microsoft, want 2", reporters)
+	}
+
+	// The foreign keys refer to metadata now that metadata_v3 has been renamed
+	if driver == "sqlite" {
+		for _, table := range []string{"policy_published", "record", "policy_override_reason", "dkim_auth_result", "spf_auth_result"} {
+			parent := ""
+			if err := db.backendDB.QueryRow(`SELECT "table" FROM pragma_foreign_key_list('` + table + `')`).Scan(&parent); err != nil || parent != "metadata" {
+				t.Errorf("foreign key of %s refers to %q (%v), want metadata", table, parent, err)
+			}
+		}
+	} else {
+		if driver == "mysql" {
+			dropRenamedForeignKeyIndexes(t)
+		}
+		if _, err := db.backendDB.Exec(`INSERT INTO record (metadata_id, source_ip) VALUES (999999, '203.0.113.1')`); err == nil {
+			t.Errorf("a record of a report that does not exist was stored")
+		}
+		if _, err := db.backendDB.Exec(`DELETE FROM metadata WHERE organization = 'microsoft.com'`); err != nil {
+			t.Fatalf("deleting a report: %v", err)
+		}
+		for table, want := range map[string]int{"metadata": 2, "policy_published": 2, "record": 3, "dkim_auth_result": 3, "spf_auth_result": 3, "policy_override_reason": 0} {
+			if count := testCount(t, table); count != want {
+				t.Errorf("%s holds %d rows after deleting a report, want %d", table, count, want)
+			}
+		}
+	}
+}
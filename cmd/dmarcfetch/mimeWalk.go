@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maxMIMEDepth limits how deep multipart and forwarded messages are followed
+const maxMIMEDepth = 16
+
+// mimePart is a leaf part of a message, with its transfer encoding removed
+type mimePart struct {
+	ContentType string // Media type in lower case, without parameters
+	Filename    string
+	Data        []byte
+}
+
+// walkMessage calls visit for every leaf part of a message
+// If the header cannot be parsed the body is visited as a single part of unknown type.
+func walkMessage(headers, body []byte, visit func(mimePart)) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(append(append([]byte{}, headers...), body...)))
+	if err != nil {
+		slog.Debug("parse failed, using the body as is", "error", err)
+		visit(mimePart{Data: body})
+		return nil
+	}
+	return walkMIME(textproto.MIMEHeader(msg.Header), msg.Body, 0, visit)
+}
+
+// walkMIME visits the leaves of an entity, descending into multipart/* and message/rfc822 parts
+// Every part is read completely before moving on. A broken part ends the walk with an error,
+// the parts visited until then stay valid.
+func walkMIME(header textproto.MIMEHeader, body io.Reader, depth int, visit func(mimePart)) error {
+	if depth > maxMIMEDepth {
+		return fmt.Errorf("MIME structure nested deeper than %d levels", maxMIMEDepth)
+	}
+	contentType, params := parseContentType(header.Get("Content-Type"))
+
+	if strings.HasPrefix(contentType, "multipart/") && params["boundary"] != "" {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("reading %s part failed: %w", contentType, err)
+			}
+			// multipart has already removed a quoted-printable transfer encoding
+			if err := walkMIME(part.Header, part, depth+1, visit); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return fmt.Errorf("decoding %s part failed: %w", contentType, err)
+	}
+	if contentType == "message/rfc822" || contentType == "message/global" {
+		// A forwarded message, typically a report that was redirected by hand
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err == nil {
+			return walkMIME(textproto.MIMEHeader(msg.Header), msg.Body, depth+1, visit)
+		}
+		slog.Debug("forwarded message could not be parsed", "error", err)
+	}
+	visit(mimePart{
+		ContentType: contentType,
+		Filename:    partFilename(header, params),
+		Data:        data,
+	})
+	return nil
+}
+
+// parseContentType returns the media type and parameters of a Content-Type header
+// Broken parameters are common, the media type is still used then. A missing header means text/plain.
+func parseContentType(value string) (string, map[string]string) {
+	if strings.TrimSpace(value) == "" {
+		return "text/plain", map[string]string{}
+	}
+	contentType, params, err := mime.ParseMediaType(value)
+	if err != nil && contentType == "" {
+		contentType, _, _ = strings.Cut(value, ";")
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+	return contentType, params
+}
+
+// partFilename returns the filename of a part from Content-Disposition, or the name parameter of Content-Type
+func partFilename(header textproto.MIMEHeader, contentTypeParams map[string]string) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = contentTypeParams["name"]
+	}
+	return decodeMimeSentence(name)
+}
+
+// decodeTransferEncoding reads a body and removes its Content-Transfer-Encoding
+// Unknown encodings are passed through, perhaps the content is usable anyway.
+func decodeTransferEncoding(encoding string, body io.Reader) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		encoded, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		encoded = bytes.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, encoded)
+		// Some senders leave out the padding
+		decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+		if err != nil {
+			decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(string(encoded), "="))
+		}
+		return decoded, err
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(body))
+	case "", "7bit", "8bit", "binary":
+		return io.ReadAll(body)
+	default:
+		slog.Debug("unknown transfer encoding", "encoding", encoding)
+		return io.ReadAll(body)
+	}
+}
+
+// charsetReader converts text in the named character set to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset '%s': %w", charset, err)
+	}
+	return encoding.NewDecoder().Reader(input), nil
+}
+
+// decodeMimeSentence decodes the RFC 2047 encoded words in a header value
+// Words in an unknown charset are left as they are.
+func decodeMimeSentence(s string) string {
+	decoder := mime.WordDecoder{CharsetReader: charsetReader}
+	decoded, err := decoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
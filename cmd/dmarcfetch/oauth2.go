@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+const (
+	authMethodPassword    = "password"
+	authMethodXOAuth2     = "xoauth2"
+	authMethodOAuthBearer = "oauthbearer"
+
+	tokenSourceClientCredentials = "clientcredentials"
+	tokenSourceRefreshToken      = "refreshtoken"
+	tokenSourceCommand           = "command"
+
+	tokenExpiryMargin = time.Minute // Fetch a new token this long before the old one expires
+	// defaultTokenLifetime is assumed when the token endpoint does not say when a token expires
+	// Providers hand out tokens for an hour or more, so this errs on the safe side.
+	defaultTokenLifetime = 10 * time.Minute
+)
+
+// tokenSource provides OAuth2 access tokens
+type tokenSource interface {
+	Token() (string, error)
+	// Forget drops a cached token, so the next Token call gets a new one
+	Forget()
+}
+
+var (
+	tokenSourcesMutex sync.Mutex
+	tokenSources      = map[string]tokenSource{} // account name -> token source, so tokens are reused between runs
+)
+
+// getTokenSource returns the (cached) token source of an account
+func getTokenSource(account ConfigIMAPAccount) (tokenSource, error) {
+	tokenSourcesMutex.Lock()
+	defer tokenSourcesMutex.Unlock()
+	if ts, ok := tokenSources[account.Name]; ok {
+		return ts, nil
+	}
+
+	settings := account.Auth.OAuth2
+	var ts tokenSource
+	switch settings.Source {
+	case tokenSourceClientCredentials, tokenSourceRefreshToken:
+		if err := checkTokenURL(settings.TokenURL); err != nil {
+			return nil, err
+		}
+		ts = &endpointTokenSource{settings: settings}
+	case tokenSourceCommand:
+		if strings.TrimSpace(settings.Command) == "" {
+			return nil, fmt.Errorf("no token command configured")
+		}
+		ts = &commandTokenSource{command: settings.Command}
+	default:
+		return nil, fmt.Errorf("unknown token source '%s'", settings.Source)
+	}
+	tokenSources[account.Name] = ts
+	return ts, nil
+}
+
+// forgetToken drops the cached token of an account, after the server refused it
+func forgetToken(account ConfigIMAPAccount) {
+	tokenSourcesMutex.Lock()
+	ts, ok := tokenSources[account.Name]
+	tokenSourcesMutex.Unlock()
+	if ok {
+		ts.Forget()
+	}
+}
+
+// checkTokenURL makes sure client secrets are only sent over https, except to a local (test) server
+func checkTokenURL(tokenURL string) error {
+	u, err := url.Parse(tokenURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid token URL '%s'", tokenURL)
+	}
+	if u.Scheme == "https" || (u.Scheme == "http" && isLoopback(u.Hostname())) {
+		return nil
+	}
+	return fmt.Errorf("token URL must use https (http is only allowed for localhost)")
+}
+
+// endpointTokenSource gets access tokens from an OAuth2 token endpoint with either
+// the client credentials grant or the refresh token grant
+type endpointTokenSource struct {
+	settings ConfigOAuth2
+
+	mutex  sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type tokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	TokenType        string      `json:"token_type"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	RefreshToken     string      `json:"refresh_token"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+func (ts *endpointTokenSource) Token() (string, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.token != "" && time.Now().Add(tokenExpiryMargin).Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("client_id", ts.settings.ClientID)
+	if ts.settings.ClientSecret != "" {
+		form.Set("client_secret", ts.settings.ClientSecret)
+	}
+	if ts.settings.Scope != "" {
+		form.Set("scope", ts.settings.Scope)
+	}
+	switch ts.settings.Source {
+	case tokenSourceClientCredentials:
+		form.Set("grant_type", "client_credentials")
+	case tokenSourceRefreshToken:
+		refreshToken, err := os.ReadFile(ts.settings.RefreshTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("reading refresh token failed: %w", err)
+		}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", strings.TrimSpace(string(refreshToken)))
+	}
+
+	slog.Debug("requesting access token", "url", ts.settings.TokenURL, "grant", form.Get("grant_type"))
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.PostForm(ts.settings.TokenURL, form)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	tr := tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", fmt.Errorf("decoding token response failed (status %s): %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return "", fmt.Errorf("token request failed (status %s): %s %s", resp.Status, tr.Error, tr.ErrorDescription)
+	}
+	if tr.AccessToken == "" {
+		return "", fmt.Errorf("token response did not contain an access token")
+	}
+
+	ts.token = tr.AccessToken
+	ts.expiry = time.Now().Add(defaultTokenLifetime)
+	if seconds, err := strconv.ParseInt(tr.ExpiresIn.String(), 10, 64); err == nil && seconds > 0 {
+		ts.expiry = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	// Some providers rotate the refresh token on every use, so keep the new one
+	if ts.settings.Source == tokenSourceRefreshToken && tr.RefreshToken != "" {
+		if err := os.WriteFile(ts.settings.RefreshTokenFile, []byte(tr.RefreshToken+"\n"), 0600); err != nil {
+			slog.Error("error saving rotated refresh token", "file", ts.settings.RefreshTokenFile, "error", err)
+		}
+	}
+	return ts.token, nil
+}
+
+func (ts *endpointTokenSource) Forget() {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.token = ""
+}
+
+// commandTokenSource runs an external command that prints an access token on stdout
+// The command is run every time a token is needed, caching is up to the command. The command line is
+// split on whitespace without any quoting, so arguments with spaces need a wrapper script.
+type commandTokenSource struct {
+	command string
+}
+
+func (ts *commandTokenSource) Token() (string, error) {
+	args := strings.Fields(ts.command)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("token command failed: %w", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", fmt.Errorf("token command did not print a token")
+	}
+	return token, nil
+}
+
+// Forget does nothing, the command is run for every token anyway
+func (ts *commandTokenSource) Forget() {}
+
+// xoauth2Client implements the XOAUTH2 SASL mechanism as used by Google and Microsoft
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return "XOAUTH2", []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"), nil
+}
+
+// Next is only called when authentication failed, the challenge holds a JSON error.
+// An empty response makes the server finish with a tagged NO.
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	slog.Debug("XOAUTH2 authentication failed", "challenge", string(challenge))
+	return []byte{}, nil
+}
+
+// newSASLClient returns the SASL client for the OAuth2 authentication method of an account
+func newSASLClient(account ConfigIMAPAccount) (sasl.Client, error) {
+	ts, err := getTokenSource(account)
+	if err != nil {
+		return nil, err
+	}
+	token, err := ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch account.Auth.Method {
+	case authMethodXOAuth2:
+		return &xoauth2Client{username: account.Username, token: token}, nil
+	case authMethodOAuthBearer:
+		port, _ := strconv.Atoi(account.Port)
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: account.Username,
+			Token:    token,
+			Host:     account.Address,
+			Port:     port,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown authentication method '%s'", account.Auth.Method)
+	}
+}
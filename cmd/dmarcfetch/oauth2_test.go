@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTokenServer is a token endpoint that answers every request with response and status
+// The forms it received are kept in requests.
+type fakeTokenServer struct {
+	*httptest.Server
+	status   int
+	response string
+	requests []map[string]string
+}
+
+func newFakeTokenServer(t *testing.T, status int, response string) *fakeTokenServer {
+	fake := &fakeTokenServer{status: status, response: response}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parsing token request: %v", err)
+		}
+		form := map[string]string{}
+		for key := range r.PostForm {
+			form[key] = r.PostForm.Get(key)
+		}
+		fake.requests = append(fake.requests, form)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(fake.status)
+		w.Write([]byte(fake.response))
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func TestEndpointTokenSourceClientCredentials(t *testing.T) {
+	fake := newFakeTokenServer(t, http.StatusOK, `{"access_token":"token-1","token_type":"Bearer","expires_in":3600}`)
+	ts := &endpointTokenSource{settings: ConfigOAuth2{
+		Source:       tokenSourceClientCredentials,
+		TokenURL:     fake.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scope:        "https://outlook.office365.com/.default",
+	}}
+
+	for i := 0; i < 2; i++ {
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatalf("Token() error: %v", err)
+		}
+		if token != "token-1" {
+			t.Fatalf("Token() = %q, want token-1", token)
+		}
+	}
+	if len(fake.requests) != 1 {
+		t.Fatalf("token endpoint called %d times, want 1", len(fake.requests))
+	}
+	want := map[string]string{
+		"grant_type":    "client_credentials",
+		"client_id":     "client",
+		"client_secret": "secret",
+		"scope":         "https://outlook.office365.com/.default",
+	}
+	for key, value := range want {
+		if got := fake.requests[0][key]; got != value {
+			t.Errorf("form %s = %q, want %q", key, got, value)
+		}
+	}
+
+	ts.Forget()
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("Token() after Forget error: %v", err)
+	}
+	if len(fake.requests) != 2 {
+		t.Fatalf("token endpoint called %d times after Forget, want 2", len(fake.requests))
+	}
+}
+
+func TestEndpointTokenSourceWithoutExpiry(t *testing.T) {
+	fake := newFakeTokenServer(t, http.StatusOK, `{"access_token":"token-1","token_type":"Bearer"}`)
+	ts := &endpointTokenSource{settings: ConfigOAuth2{Source: tokenSourceClientCredentials, TokenURL: fake.URL}}
+
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("Token() error: %v", err)
+	}
+	if lifetime := time.Until(ts.expiry); lifetime <= 0 || lifetime > defaultTokenLifetime {
+		t.Fatalf("token expires in %s, want at most %s", lifetime, defaultTokenLifetime)
+	}
+
+	// Once the assumed lifetime is over, a new token is requested
+	ts.expiry = time.Now()
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("Token() error: %v", err)
+	}
+	if len(fake.requests) != 2 {
+		t.Fatalf("token endpoint called %d times, want 2", len(fake.requests))
+	}
+}
+
+func TestEndpointTokenSourceRefreshTokenRotation(t *testing.T) {
+	fake := newFakeTokenServer(t, http.StatusOK, `{"access_token":"token-1","expires_in":"3600","refresh_token":"refresh-2"}`)
+	file := filepath.Join(t.TempDir(), "refresh")
+	if err := os.WriteFile(file, []byte("refresh-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts := &endpointTokenSource{settings: ConfigOAuth2{
+		Source:           tokenSourceRefreshToken,
+		TokenURL:         fake.URL,
+		ClientID:         "client",
+		RefreshTokenFile: file,
+	}}
+
+	if _, err := ts.Token(); err != nil {
+		t.Fatalf("Token() error: %v", err)
+	}
+	if got := fake.requests[0]["grant_type"]; got != "refresh_token" {
+		t.Errorf("grant_type = %q, want refresh_token", got)
+	}
+	if got := fake.requests[0]["refresh_token"]; got != "refresh-1" {
+		t.Errorf("refresh_token = %q, want refresh-1", got)
+	}
+	saved, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(saved)) != "refresh-2" {
+		t.Errorf("refresh token file holds %q, want the rotated refresh-2", saved)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("refresh token file mode %o, want 600", info.Mode().Perm())
+	}
+}
+
+func TestEndpointTokenSourceError(t *testing.T) {
+	fake := newFakeTokenServer(t, http.StatusBadRequest, `{"error":"invalid_client","error_description":"Client authentication failed"}`)
+	ts := &endpointTokenSource{settings: ConfigOAuth2{Source: tokenSourceClientCredentials, TokenURL: fake.URL}}
+
+	token, err := ts.Token()
+	if err == nil {
+		t.Fatalf("Token() = %q, want an error", token)
+	}
+	if !strings.Contains(err.Error(), "invalid_client") || !strings.Contains(err.Error(), "Client authentication failed") {
+		t.Errorf("error %q does not hold the error of the endpoint", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// pop3Client is a minimal POP3 client (RFC 1939), with STLS (RFC 2595)
+// Only what is needed to retrieve and delete messages is implemented.
+type pop3Client struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// pop3Message is a message in the maildrop: its number in this session, its unique id and its size
+type pop3Message struct {
+	Number int
+	UIDL   string
+	Size   int64
+}
+
+// dialPOP3 connects to the POP3 server of an account using the configured TLS mode
+func dialPOP3(account ConfigPOP3Account) (*pop3Client, error) {
+	server := net.JoinHostPort(account.Address, account.Port)
+	if account.TLS.Mode == tlsModeNone && !isLoopback(account.Address) {
+		// Credentials would go over the wire in plain text, so this is only for local servers
+		return nil, fmt.Errorf("plaintext connections are only allowed to localhost, not %s", account.Address)
+	}
+	var tlsConfig *tls.Config
+	if account.TLS.Mode != tlsModeNone {
+		var err error
+		tlsConfig, err = newTLSConfig(account.Address, account.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	switch account.TLS.Mode {
+	case tlsModeImplicit:
+		conn, err = tls.Dial("tcp", server, tlsConfig)
+	case tlsModeStartTLS, tlsModeNone:
+		conn, err = net.Dial("tcp", server)
+	default:
+		return nil, fmt.Errorf("unknown TLS mode '%s'", account.TLS.Mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client := &pop3Client{conn: conn, text: textproto.NewConn(conn)}
+	if _, err := client.readResponse(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("greeting failed: %w", err)
+	}
+	if account.TLS.Mode == tlsModeStartTLS {
+		if _, err := client.cmd("STLS"); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("STLS failed: %w", err)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		client.conn = tlsConn
+		client.text = textproto.NewConn(tlsConn)
+	}
+	return client, nil
+}
+
+// readResponse reads a status line and returns the text after +OK
+func (c *pop3Client) readResponse() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	status, rest, _ := strings.Cut(line, " ")
+	switch status {
+	case "+OK":
+		return rest, nil
+	case "-ERR":
+		return "", fmt.Errorf("server error: %s", rest)
+	default:
+		return "", fmt.Errorf("unexpected response: %s", line)
+	}
+}
+
+// cmd sends a command and reads its status line
+func (c *pop3Client) cmd(format string, args ...any) (string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.readResponse()
+}
+
+// Login authenticates with USER and PASS
+func (c *pop3Client) Login(username, password string) error {
+	if _, err := c.cmd("USER %s", username); err != nil {
+		return err
+	}
+	_, err := c.cmd("PASS %s", password)
+	return err
+}
+
+// UIDL lists the messages in the maildrop with their unique ids
+func (c *pop3Client) UIDL() ([]pop3Message, error) {
+	if _, err := c.cmd("UIDL"); err != nil {
+		return nil, err
+	}
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]pop3Message, 0, len(lines))
+	for _, line := range lines {
+		number, uidl, ok := strings.Cut(line, " ")
+		n, err := strconv.Atoi(number)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid UIDL line: %s", line)
+		}
+		messages = append(messages, pop3Message{Number: n, UIDL: uidl})
+	}
+	return messages, nil
+}
+
+// List returns the size in octets of every message in the maildrop, by message number
+func (c *pop3Client) List() (map[int]int64, error) {
+	if _, err := c.cmd("LIST"); err != nil {
+		return nil, err
+	}
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[int]int64, len(lines))
+	for _, line := range lines {
+		number, size, _ := strings.Cut(line, " ")
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LIST line: %s", line)
+		}
+		octets, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LIST line: %s", line)
+		}
+		sizes[n] = octets
+	}
+	return sizes, nil
+}
+
+// Top retrieves the headers of a message without its body
+// TOP is optional in RFC 1939, but few servers leave it out.
+func (c *pop3Client) Top(number int) ([]byte, error) {
+	if _, err := c.cmd("TOP %d 0", number); err != nil {
+		return nil, err
+	}
+	return c.text.ReadDotBytes()
+}
+
+// Retr retrieves a complete message
+func (c *pop3Client) Retr(number int) ([]byte, error) {
+	if _, err := c.cmd("RETR %d", number); err != nil {
+		return nil, err
+	}
+	return c.text.ReadDotBytes()
+}
+
+// Dele marks a message as deleted, it is removed when the session ends with Quit
+func (c *pop3Client) Dele(number int) error {
+	_, err := c.cmd("DELE %d", number)
+	return err
+}
+
+// Quit ends the session, which makes the server remove the deleted messages
+func (c *pop3Client) Quit() error {
+	_, err := c.cmd("QUIT")
+	return err
+}
+
+// Close closes the connection without ending the session, deleted messages are kept
+func (c *pop3Client) Close() error {
+	return c.conn.Close()
+}
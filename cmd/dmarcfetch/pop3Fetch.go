@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// pop3Folder is what reports from POP3 are tagged with as folder, POP3 only has the one maildrop
+const pop3Folder = "INBOX"
+
+// syncPOP3Account retrieves the messages of a POP3 account that were not processed before, stores
+// the reports in them and records their UIDL. Messages that failed are recorded as such and retrieved
+// again on the next run, their ingest error is only stored the first time. If configured, the messages
+// whose report is stored are deleted from the server afterwards.
+func syncPOP3Account(account ConfigPOP3Account) (syncStats, error) {
+	stats := syncStats{}
+	storeMutex.Lock()
+	processed, err := getPOP3UIDLs(account.Name)
+	storeMutex.Unlock()
+	if err != nil {
+		return stats, fmt.Errorf("error getting processed messages: %w", err)
+	}
+
+	slog.Debug("Connecting to POP3 server:", "account", account.Name, "server", account.Address, "port", account.Port, "tls", account.TLS.Mode)
+	client, err := dialPOP3(account)
+	if err != nil {
+		slog.Error("connect failed", "account", account.Name, "error", err)
+		return stats, fmt.Errorf("connect failed: %w", err)
+	}
+	defer client.Close()
+	slog.Debug("Logging in to POP3 server:", "account", account.Name, "user", account.Username)
+	if err := client.Login(account.Username, account.Password); err != nil {
+		slog.Error("login failed", "account", account.Name, "error", err)
+		return stats, fmt.Errorf("login failed: %w", err)
+	}
+
+	messages, err := client.UIDL()
+	if err != nil {
+		return stats, fmt.Errorf("UIDL failed: %w", err)
+	}
+	sizes, err := client.List()
+	if err != nil {
+		return stats, fmt.Errorf("LIST failed: %w", err)
+	}
+	numbers := make(map[string]int)
+	todo := make([]pop3Message, 0)
+	for _, msg := range messages {
+		numbers[msg.UIDL] = msg.Number
+		if failed, ok := processed[msg.UIDL]; !ok || failed {
+			msg.Size = sizes[msg.Number]
+			todo = append(todo, msg)
+		}
+	}
+	if len(todo) == 0 {
+		slog.Debug("no new messages", "account", account.Name)
+		return stats, client.Quit()
+	}
+
+	timer := time.Now()
+	maxBytes := Configuration.limits().maxMessageBytes()
+	fetch := func(ctx context.Context, out chan<- rawMessage) error {
+		for _, msg := range todo {
+			raw := rawMessage{ID: msg.UIDL}
+			if msg.Size > maxBytes {
+				// Only the headers, to know what was skipped
+				raw.Oversized = msg.Size
+				headers, err := client.Top(msg.Number)
+				if err != nil {
+					slog.Debug("TOP failed", "account", account.Name, "uidl", msg.UIDL, "error", err)
+				}
+				raw.Headers = headers
+			} else {
+				data, err := client.Retr(msg.Number)
+				if err != nil {
+					return err
+				}
+				raw.Body = data
+			}
+			select {
+			case out <- raw:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+	decode := func(raw rawMessage) decodedMessage {
+		return decodePOP3Message(account, raw)
+	}
+	stored := make([]string, 0)
+	store := func(msgs []decodedMessage) error {
+		reports := make([]*fetchedReport, 0, len(msgs))
+		failed := make([]*ingestError, 0)
+		for _, msg := range msgs {
+			switch {
+			case msg.Report != nil:
+				reports = append(reports, msg.Report)
+			case !processed[msg.ID]:
+				failed = append(failed, msg.Failed)
+			default:
+				slog.Debug("message failed again", "account", account.Name, "uidl", msg.ID, "error", msg.Failed.Err)
+			}
+		}
+		storeMutex.Lock()
+		defer storeMutex.Unlock()
+		reports, failed, err := storeDecoded(reports, failed)
+		if err != nil {
+			return err
+		}
+		done := make([]string, 0, len(msgs))
+		retry := make([]string, 0)
+		for _, msg := range msgs {
+			if msg.Report != nil && slices.Contains(reports, msg.Report) {
+				done = append(done, msg.ID)
+			} else {
+				retry = append(retry, msg.ID)
+			}
+		}
+		if err := addPOP3UIDLs(account.Name, done, false); err != nil {
+			return fmt.Errorf("error saving processed messages: %w", err)
+		}
+		if err := addPOP3UIDLs(account.Name, retry, true); err != nil {
+			return fmt.Errorf("error saving failed messages: %w", err)
+		}
+		stored = append(stored, done...)
+		stats.Reports += len(reports)
+		stats.Errors += len(failed)
+		return nil
+	}
+	err = runPipeline(account.Name, pop3Folder, len(todo), fetch, decode, store)
+	if stats.Reports > 0 || stats.Errors > 0 {
+		slog.Info("finished", "account", account.Name, "reports", stats.Reports, "errors", stats.Errors, "duration", time.Since(timer))
+	}
+
+	// Only messages whose report is safely stored are deleted, the others stay for inspection
+	if account.Delete && len(stored) > 0 {
+		slog.Info("deleting messages", "account", account.Name, "count", len(stored))
+		for _, uidl := range stored {
+			if deleteErr := client.Dele(numbers[uidl]); deleteErr != nil {
+				// Without QUIT nothing is deleted, so rather keep everything than half
+				return stats, errors.Join(err, fmt.Errorf("DELE failed: %w", deleteErr))
+			}
+		}
+	}
+	if quitErr := client.Quit(); quitErr != nil {
+		err = errors.Join(err, fmt.Errorf("QUIT failed: %w", quitErr))
+	}
+	return stats, err
+}
+
+// decodePOP3Message decodes a message retrieved from a POP3 account
+func decodePOP3Message(account ConfigPOP3Account, raw rawMessage) decodedMessage {
+	msg := decodedMessage{ID: raw.ID}
+	if raw.Oversized > 0 {
+		maxBytes := Configuration.limits().maxMessageBytes()
+		slog.Warn("message quarantined", "account", account.Name, "uidl", raw.ID, "size", raw.Oversized, "max", maxBytes)
+		msg.Failed = newOversizedError(account.Name, pop3Folder, 0, pop3Ref(account.Name, raw.ID), raw.Headers, raw.Oversized, maxBytes)
+		return msg
+	}
+	rep, err := decodeReportFile("", raw.Body)
+	if err != nil {
+		slog.Warn("message quarantined", "account", account.Name, "uidl", raw.ID, "error", err)
+		msg.Failed = newIngestError(account.Name, pop3Folder, 0, pop3Ref(account.Name, raw.ID), raw.Body, err)
+		return msg
+	}
+	rep.Account = account.Name
+	rep.Folder = pop3Folder
+	rep.Ref = pop3Ref(account.Name, raw.ID)
+	msg.Report = rep
+	return msg
+}
+
+// pop3Ref refers to a message of a POP3 account by its UIDL
+func pop3Ref(account, uidl string) string {
+	return fmt.Sprintf("pop3://%s/;UIDL=%s", url.PathEscape(account), url.PathEscape(uidl))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePOP3Server is a POP3 server with a fixed maildrop, it keeps the commands it received
+type fakePOP3Server struct {
+	messages []string
+	failDele bool // Refuse DELE
+	mutex    sync.Mutex
+	commands []string
+}
+
+// startFakePOP3Server serves messages on localhost and returns an account for it
+func startFakePOP3Server(t *testing.T, messages ...string) (ConfigPOP3Account, *fakePOP3Server) {
+	t.Helper()
+	fake := &fakePOP3Server{messages: messages}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	config := ConfigDatabase{POP3: []ConfigPOP3Account{{
+		Name:     "pop3",
+		Address:  host,
+		Port:     port,
+		Username: "user",
+		Password: "password",
+		TLS:      ConfigTLS{Mode: tlsModeNone},
+	}}}
+	return config.pop3Accounts()[0], fake
+}
+
+func (f *fakePOP3Server) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "+OK ready\r\n")
+	// dotted sends a multi-line response
+	dotted := func(text string) {
+		fmt.Fprintf(conn, "+OK\r\n")
+		for _, line := range strings.SplitAfter(text, "\r\n") {
+			if strings.HasPrefix(line, ".") {
+				line = "." + line
+			}
+			fmt.Fprint(conn, line)
+		}
+		if !strings.HasSuffix(text, "\r\n") {
+			fmt.Fprint(conn, "\r\n")
+		}
+		fmt.Fprintf(conn, ".\r\n")
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.Fields(line)
+		if len(command) == 0 {
+			continue
+		}
+		f.mutex.Lock()
+		f.commands = append(f.commands, strings.Join(command, " "))
+		f.mutex.Unlock()
+		number := 0
+		if len(command) > 1 {
+			number, _ = strconv.Atoi(command[1])
+		}
+		switch strings.ToUpper(command[0]) {
+		case "DELE":
+			f.mutex.Lock()
+			failDele := f.failDele
+			f.mutex.Unlock()
+			if failDele {
+				fmt.Fprintf(conn, "-ERR message locked\r\n")
+			} else {
+				fmt.Fprintf(conn, "+OK\r\n")
+			}
+		case "USER", "PASS":
+			fmt.Fprintf(conn, "+OK\r\n")
+		case "UIDL", "LIST":
+			listing := ""
+			for i, msg := range f.messages {
+				if strings.ToUpper(command[0]) == "UIDL" {
+					listing += fmt.Sprintf("%d uidl-%d\r\n", i+1, i+1)
+				} else {
+					listing += fmt.Sprintf("%d %d\r\n", i+1, len(msg))
+				}
+			}
+			dotted(listing)
+		case "RETR":
+			dotted(f.messages[number-1])
+		case "TOP":
+			headers, _ := splitMessage([]byte(f.messages[number-1]))
+			dotted(string(headers))
+		case "QUIT":
+			fmt.Fprintf(conn, "+OK bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+// received returns the commands the server received
+func (f *fakePOP3Server) received() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return slices.Clone(f.commands)
+}
+
+// reset forgets the commands received so far
+func (f *fakePOP3Server) reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.commands = nil
+}
+
+// retrieved returns the numbers of the messages the server sent with RETR
+func (f *fakePOP3Server) retrieved() []string {
+	numbers := make([]string, 0)
+	for _, command := range f.received() {
+		if number, ok := strings.CutPrefix(command, "RETR "); ok {
+			numbers = append(numbers, number)
+		}
+	}
+	return numbers
+}
+
+func TestOversizedPOP3MessageIsNotRetrieved(t *testing.T) {
+	useTestDatabase(t)
+	useLimits(t, ConfigLimits{MaxCompressedBytes: 4096})
+	useQuarantine(t)
+	account, fake := startFakePOP3Server(t,
+		testReportMessage("Report Domain: example.com small", "small"),
+		testLargeMessage("Report Domain: example.com large", 100000),
+	)
+
+	stats, err := syncPOP3Account(account)
+	if err != nil {
+		t.Fatalf("syncPOP3Account error: %v", err)
+	}
+	if stats.Reports != 1 || stats.Errors != 1 {
+		t.Fatalf("syncPOP3Account stored %d reports and %d errors, want 1 and 1", stats.Reports, stats.Errors)
+	}
+	commands := fake.received()
+	if slices.Contains(commands, "RETR 2") || !slices.Contains(commands, "TOP 2 0") {
+		t.Errorf("server received %q, want only the headers of message 2 retrieved", commands)
+	}
+	checkOversizedError(t, "Report Domain: example.com large", 100000)
+}
+
+func TestPOP3MessagesAreOnlyRetrievedOnce(t *testing.T) {
+	useTestDatabase(t)
+	account, fake := startFakePOP3Server(t,
+		testReportMessage("Report Domain: example.com first", "first"),
+		testReportMessage("Report Domain: example.com second", "second"),
+	)
+
+	stats, err := syncPOP3Account(account)
+	if err != nil || stats.Reports != 2 {
+		t.Fatalf("syncPOP3Account stored %d reports (%v), want 2", stats.Reports, err)
+	}
+	if got := fake.retrieved(); !slices.Equal(got, []string{"1", "2"}) {
+		t.Errorf("first run retrieved messages %q, want 1 and 2", got)
+	}
+	fake.reset()
+	stats, err = syncPOP3Account(account)
+	if err != nil || stats.Reports != 0 {
+		t.Fatalf("second run stored %d reports (%v), want none", stats.Reports, err)
+	}
+	if got := fake.retrieved(); len(got) != 0 {
+		t.Errorf("second run retrieved messages %q, want none", got)
+	}
+	if count := testCount(t, "pop3_uidl"); count != 2 {
+		t.Errorf("pop3_uidl holds %d rows, want 2", count)
+	}
+}
+
+func TestFailedPOP3MessageIsRetried(t *testing.T) {
+	useTestDatabase(t)
+	useQuarantine(t)
+	account, fake := startFakePOP3Server(t,
+		testReportMessage("Report Domain: example.com report", "report"),
+		testTextMessage("Not a report"),
+	)
+
+	stats, err := syncPOP3Account(account)
+	if err != nil || stats.Reports != 1 || stats.Errors != 1 {
+		t.Fatalf("syncPOP3Account stored %d reports and %d errors (%v), want 1 and 1", stats.Reports, stats.Errors, err)
+	}
+	fake.reset()
+	stats, err = syncPOP3Account(account)
+	if err != nil || stats.Reports != 0 || stats.Errors != 0 {
+		t.Fatalf("second run stored %d reports and %d errors (%v), want none", stats.Reports, stats.Errors, err)
+	}
+	if got := fake.retrieved(); !slices.Equal(got, []string{"2"}) {
+		t.Errorf("second run retrieved messages %q, want only the failed message 2", got)
+	}
+	if count := testCount(t, "ingest_errors"); count != 1 {
+		t.Errorf("ingest_errors holds %d rows after the retry, want the first failure only", count)
+	}
+	failed, err := getPOP3UIDLs(account.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed["uidl-1"] || !failed["uidl-2"] {
+		t.Errorf("pop3_uidl marks %v as failed, want only uidl-2", failed)
+	}
+}
+
+func TestPOP3DeletesOnlyStoredMessages(t *testing.T) {
+	useTestDatabase(t)
+	useQuarantine(t)
+	account, fake := startFakePOP3Server(t,
+		testReportMessage("Report Domain: example.com first", "first"),
+		testTextMessage("Not a report"),
+		testReportMessage("Report Domain: example.com third", "third"),
+	)
+	account.Delete = true
+
+	if _, err := syncPOP3Account(account); err != nil {
+		t.Fatalf("syncPOP3Account error: %v", err)
+	}
+	commands := fake.received()
+	deleted := make([]string, 0)
+	for _, command := range commands {
+		if number, ok := strings.CutPrefix(command, "DELE "); ok {
+			deleted = append(deleted, number)
+		}
+	}
+	if !slices.Equal(deleted, []string{"1", "3"}) {
+		t.Errorf("deleted messages %q, want 1 and 3", deleted)
+	}
+	if commands[len(commands)-1] != "QUIT" {
+		t.Errorf("last command %q, want QUIT to commit the deletions", commands[len(commands)-1])
+	}
+}
+
+func TestFailedPOP3DeleteAbortsBeforeQuit(t *testing.T) {
+	useTestDatabase(t)
+	account, fake := startFakePOP3Server(t,
+		testReportMessage("Report Domain: example.com first", "first"),
+		testReportMessage("Report Domain: example.com second", "second"),
+	)
+	account.Delete = true
+	fake.failDele = true
+
+	stats, err := syncPOP3Account(account)
+	if err == nil {
+		t.Fatal("syncPOP3Account succeeded, want the failed DELE reported")
+	}
+	if stats.Reports != 2 {
+		t.Errorf("syncPOP3Account stored %d reports, want 2", stats.Reports)
+	}
+	commands := fake.received()
+	if slices.Contains(commands, "QUIT") {
+		t.Errorf("server received %q, want no QUIT so none of the messages is deleted", commands)
+	}
+	if slices.Contains(commands, "DELE 2") {
+		t.Errorf("server received %q, want no DELE after the first one failed", commands)
+	}
+	// The reports are stored, the messages are not retrieved again
+	fake.reset()
+	fake.mutex.Lock()
+	fake.failDele = false
+	fake.mutex.Unlock()
+	if _, err := syncPOP3Account(account); err != nil {
+		t.Fatalf("second run error: %v", err)
+	}
+	if got := fake.retrieved(); len(got) != 0 {
+		t.Errorf("second run retrieved messages %q, want none", got)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	receiverProtocolSMTP = "smtp"
+	receiverProtocolLMTP = "lmtp"
+
+	defaultReceiverName            = "receiver"
+	defaultReceiverMaxMessageBytes = 10 * 1024 * 1024
+	defaultReceiverMaxRecipients   = 10
+	receiverTimeout                = 5 * time.Minute
+)
+
+// receiverEnabled returns true if the SMTP/LMTP receiver is configured
+func receiverEnabled() bool {
+	return Configuration.Receiver.Listen != ""
+}
+
+// runReceiver accepts report mail over SMTP or LMTP and stores the reports as soon as a message
+// is received. It only returns if the listener fails.
+func runReceiver() error {
+	settings, err := Configuration.receiver()
+	if err != nil {
+		return err
+	}
+	server, err := newReceiverServer(settings)
+	if err != nil {
+		return err
+	}
+
+	network, address := "tcp", settings.Listen
+	if strings.HasPrefix(address, "unix:") || strings.HasPrefix(address, "/") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("listen failed: %w", err)
+	}
+	slog.Info("receiving reports", "protocol", settings.Protocol, "network", network, "address", address, "starttls", server.TLSConfig != nil)
+	return server.Serve(listener)
+}
+
+// newReceiverServer returns an SMTP or LMTP server for the receiver settings
+func newReceiverServer(settings ConfigReceiver) (*smtp.Server, error) {
+	server := smtp.NewServer(&receiverBackend{settings: settings})
+	server.LMTP = settings.Protocol == receiverProtocolLMTP
+	server.Domain = settings.Domain
+	server.MaxMessageBytes = settings.MaxMessageBytes
+	server.MaxRecipients = settings.MaxRecipients
+	server.ReadTimeout = receiverTimeout
+	server.WriteTimeout = receiverTimeout
+	server.AuthDisabled = true
+	if settings.TLS.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(settings.TLS.Cert, settings.TLS.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading receiver certificate failed: %w", err)
+		}
+		// Setting a TLS config makes the server announce STARTTLS
+		server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	return server, nil
+}
+
+// receiverBackend creates a session for every connection, authentication is not supported
+type receiverBackend struct {
+	settings ConfigReceiver
+}
+
+func (b *receiverBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+func (b *receiverBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if b.settings.TLS.Require && !state.TLS.HandshakeComplete {
+		return nil, &smtp.SMTPError{
+			Code:         530,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+			Message:      "Must issue a STARTTLS command first",
+		}
+	}
+	return &receiverSession{settings: b.settings, remote: state.RemoteAddr.String()}, nil
+}
+
+// receiverSession receives the messages of one connection
+type receiverSession struct {
+	settings ConfigReceiver
+	remote   string
+	from     string
+	to       []string
+}
+
+func (s *receiverSession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *receiverSession) Logout() error {
+	return nil
+}
+
+func (s *receiverSession) Mail(from string, opts smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+// Rcpt only accepts the recipients on the allow-list
+func (s *receiverSession) Rcpt(to string) error {
+	if !recipientAllowed(s.settings.Recipients, to) {
+		slog.Warn("recipient rejected", "remote", s.remote, "from", s.from, "to", to)
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Recipient not accepted",
+		}
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+// Data decodes and stores the report. A message that cannot be decoded is accepted and recorded
+// as an ingest error, so it does not bounce. If storing fails the sender is asked to try again later.
+func (s *receiverSession) Data(r io.Reader) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	name := s.settings.Name
+	reports := []*fetchedReport{}
+	failed := []*ingestError{}
+	rep, err := decodeReportFile("", raw)
+	if err != nil {
+		slog.Warn("message quarantined", "remote", s.remote, "from", s.from, "error", err)
+		failed = append(failed, newIngestError(name, strings.Join(s.to, ","), 0, "", raw, err))
+	} else {
+		rep.Account = name
+		rep.Folder = strings.Join(s.to, ",")
+		reports = append(reports, rep)
+	}
+
+	storeMutex.Lock()
+	reports, _, err = storeDecoded(reports, failed)
+	storeMutex.Unlock()
+	if err != nil {
+		slog.Error("error storing received message", "remote", s.remote, "from", s.from, "error", err)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Report could not be stored, try again later",
+		}
+	}
+	if len(reports) > 0 {
+		slog.Info("received report", "remote", s.remote, "from", s.from, "report", rep.id())
+	}
+	return nil
+}
+
+// recipientAllowed checks an address against the allow-list of the receiver
+// Entries are complete addresses or domains starting with '@'. An empty list allows nothing.
+func recipientAllowed(allowed []string, to string) bool {
+	to = strings.ToLower(strings.Trim(to, "<> "))
+	_, domain, _ := strings.Cut(to, "@")
+	for _, entry := range allowed {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == to || (strings.HasPrefix(entry, "@") && entry[1:] == domain) {
+			return true
+		}
+	}
+	return false
+}
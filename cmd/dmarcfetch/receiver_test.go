@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and localhost and its key
+// to a temporary directory
+func writeTestCertificate(t *testing.T) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dmarcfetch test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+// startTestReceiver serves the receiver settings on a local port until the test ends
+func startTestReceiver(t *testing.T, receiver ConfigReceiver) string {
+	t.Helper()
+	config := ConfigDatabase{Receiver: receiver}
+	settings, err := config.receiver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newReceiverServer(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+// dialTestReceiver connects to the receiver at address and greets it
+func dialTestReceiver(t *testing.T, address string, lmtp bool) *smtp.Client {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c *smtp.Client
+	if lmtp {
+		c, err = smtp.NewClientLMTP(conn, "localhost")
+	} else {
+		c, err = smtp.NewClient(conn, "localhost")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Hello("sender.example"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// smtpCode returns the reply code of an error of the SMTP client, 0 if there is none
+func smtpCode(err error) int {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code
+	}
+	return 0
+}
+
+// sendTestMessage sends message over c and returns the error of the DATA command
+func sendTestMessage(t *testing.T, c *smtp.Client, to []string, message string) error {
+	t.Helper()
+	if err := c.Mail("noreply-dmarc-support@google.com", nil); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			t.Fatalf("RCPT %s: %v", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	if _, err := w.Write([]byte(message)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// refuseIngestErrors makes every insert into ingest_errors fail until the test ends
+func refuseIngestErrors(t *testing.T) {
+	t.Helper()
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.backendDB.Exec(`CREATE TRIGGER refuse_ingest_errors BEFORE INSERT ON ingest_errors BEGIN SELECT RAISE(ABORT, 'disk full'); END`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiverNeedsRecipients(t *testing.T) {
+	config := ConfigDatabase{Receiver: ConfigReceiver{Listen: "127.0.0.1:2525"}}
+	if _, err := config.receiver(); err == nil {
+		t.Errorf("receiver settings without recipients accepted, want an error")
+	}
+}
+
+func TestRecipientAllowed(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		to      string
+		want    bool
+	}{
+		{[]string{"dmarc@example.com"}, "dmarc@example.com", true},
+		{[]string{"dmarc@example.com"}, "<DMARC@Example.com>", true},
+		{[]string{"dmarc@example.com"}, "postmaster@example.com", false},
+		{[]string{"@example.com"}, "anything@example.com", true},
+		{[]string{"@example.com"}, "dmarc@sub.example.com", false},
+		{[]string{"@example.com"}, "dmarc@notexample.com", false},
+		{[]string{" Dmarc@Example.com "}, "dmarc@example.com", true},
+		{nil, "dmarc@example.com", false},
+		{[]string{}, "dmarc@example.com", false},
+	}
+	for _, tt := range tests {
+		if got := recipientAllowed(tt.allowed, tt.to); got != tt.want {
+			t.Errorf("recipientAllowed(%q, %q) = %t, want %t", tt.allowed, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestReceiverStoresReport(t *testing.T) {
+	useTestDatabase(t)
+	address := startTestReceiver(t, ConfigReceiver{Recipients: []string{"dmarc@example.com", "@reports.example.com"}})
+	c := dialTestReceiver(t, address, false)
+
+	if err := c.Mail("noreply-dmarc-support@google.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("someone@example.com"); smtpCode(err) != 550 {
+		t.Errorf("RCPT of a recipient not on the allow-list: %v, want 550", err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendTestMessage(t, c, []string{"dmarc@example.com", "any@reports.example.com"}, testReportMessage("Report Domain: example.com", "received")); err != nil {
+		t.Fatalf("sending a report: %v", err)
+	}
+	if count := testCount(t, "metadata"); count != 1 {
+		t.Fatalf("metadata holds %d rows, want the received report", count)
+	}
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, folder := "", ""
+	if err := db.backendDB.QueryRow("SELECT account, folder FROM metadata").Scan(&account, &folder); err != nil {
+		t.Fatal(err)
+	}
+	if account != defaultReceiverName || folder != "dmarc@example.com,any@reports.example.com" {
+		t.Errorf("report stored for account %q folder %q, want the receiver and its recipients", account, folder)
+	}
+}
+
+func TestReceiverRequiresTLS(t *testing.T) {
+	useTestDatabase(t)
+	certFile, keyFile, cert := writeTestCertificate(t)
+	receiver := ConfigReceiver{Recipients: []string{"dmarc@example.com"}}
+	receiver.TLS.Cert, receiver.TLS.Key, receiver.TLS.Require = certFile, keyFile, true
+	address := startTestReceiver(t, receiver)
+
+	plain := dialTestReceiver(t, address, false)
+	if err := plain.Mail("noreply-dmarc-support@google.com", nil); smtpCode(err) != 530 {
+		t.Errorf("MAIL before STARTTLS: %v, want 530", err)
+	}
+
+	secure := dialTestReceiver(t, address, false)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	if err := secure.StartTLS(&tls.Config{ServerName: "localhost", RootCAs: roots}); err != nil {
+		t.Fatalf("STARTTLS: %v", err)
+	}
+	if err := sendTestMessage(t, secure, []string{"dmarc@example.com"}, testReportMessage("Report Domain: example.com", "over-tls")); err != nil {
+		t.Fatalf("sending a report after STARTTLS: %v", err)
+	}
+	if count := testCount(t, "metadata"); count != 1 {
+		t.Errorf("metadata holds %d rows, want the report sent over TLS", count)
+	}
+}
+
+func TestReceiverMaxMessageBytes(t *testing.T) {
+	useTestDatabase(t)
+	address := startTestReceiver(t, ConfigReceiver{Recipients: []string{"dmarc@example.com"}, MaxMessageBytes: 1024})
+	c := dialTestReceiver(t, address, false)
+	message := testTextMessage("Report Domain: example.com") + strings.Repeat("padding\r\n", 512)
+	if err := sendTestMessage(t, c, []string{"dmarc@example.com"}, message); smtpCode(err) != 552 {
+		t.Errorf("sending a message over the limit: %v, want 552", err)
+	}
+	if count := testCount(t, "ingest_errors"); count != 0 {
+		t.Errorf("ingest_errors holds %d rows, want the oversized message refused before storing", count)
+	}
+}
+
+func TestReceiverStoreErrorIsTemporary(t *testing.T) {
+	useTestDatabase(t)
+	useQuarantine(t)
+	refuseIngestErrors(t)
+	address := startTestReceiver(t, ConfigReceiver{Recipients: []string{"dmarc@example.com"}})
+	c := dialTestReceiver(t, address, false)
+	if err := sendTestMessage(t, c, []string{"dmarc@example.com"}, testTextMessage("Report Domain: example.com")); smtpCode(err) != 451 {
+		t.Errorf("sending while storing fails: %v, want 451", err)
+	}
+}
+
+// sendTestLMTP sends message to every recipient over LMTP and returns the reply code for each of them
+func sendTestLMTP(t *testing.T, address string, to []string, message string) map[string]int {
+	t.Helper()
+	c := dialTestReceiver(t, address, true)
+	if err := c.Mail("noreply-dmarc-support@google.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			t.Fatalf("RCPT %s: %v", rcpt, err)
+		}
+	}
+	replies := map[string]int{}
+	w, err := c.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		replies[rcpt] = 250
+		if status != nil {
+			replies[rcpt] = status.Code
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return replies
+}
+
+func TestReceiverLMTPRepliesPerRecipient(t *testing.T) {
+	useTestDatabase(t)
+	useQuarantine(t)
+	address := startTestReceiver(t, ConfigReceiver{Protocol: receiverProtocolLMTP, Recipients: []string{"@example.com"}})
+	to := []string{"dmarc@example.com", "reports@example.com"}
+
+	replies := sendTestLMTP(t, address, to, testReportMessage("Report Domain: example.com", "lmtp"))
+	if len(replies) != 2 || replies[to[0]] != 250 || replies[to[1]] != 250 {
+		t.Errorf("replies %v, want 250 for each recipient", replies)
+	}
+	if count := testCount(t, "metadata"); count != 1 {
+		t.Errorf("metadata holds %d rows, want the report stored once", count)
+	}
+
+	refuseIngestErrors(t)
+	replies = sendTestLMTP(t, address, to, testTextMessage("Report Domain: example.com"))
+	if len(replies) != 2 || replies[to[0]] != 451 || replies[to[1]] != 451 {
+		t.Errorf("replies %v while storing fails, want 451 for each recipient", replies)
+	}
+}
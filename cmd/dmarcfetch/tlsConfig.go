@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// newTLSConfig builds the client TLS configuration for a mail server connection
+// Certificates are verified against the system roots, or against the CA bundle if one is configured.
+// If a fingerprint is pinned, the chain is not verified and only the SHA-256 of the server certificate is compared.
+func newTLSConfig(host string, settings ConfigTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if settings.ServerName != "" {
+		tlsConfig.ServerName = settings.ServerName
+	}
+
+	if settings.CAFile != "" {
+		pem, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file failed: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", settings.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if settings.ClientCert != "" || settings.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(settings.ClientCert, settings.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate failed: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if settings.Fingerprint != "" {
+		pinned, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(settings.Fingerprint), ":", ""))
+		if err != nil || len(pinned) != sha256.Size {
+			return nil, fmt.Errorf("fingerprint must be a hex encoded SHA-256 hash")
+		}
+		// Chain verification is replaced by the pin, so self-signed certificates can be used
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("server did not present a certificate")
+			}
+			fingerprint := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(fingerprint[:], pinned) {
+				return fmt.Errorf("server certificate fingerprint %x does not match pinned fingerprint", fingerprint)
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// isLoopback returns true if host is localhost or a loopback address
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+)
+
+// startTLSTestServer serves the certificate on a local port and writes "ok" after every handshake
+// that succeeded. With clientCAs set the server requires a client certificate signed by them.
+func startTLSTestServer(t *testing.T, certFile, keyFile string, clientCAs *x509.CertPool) string {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAs != nil {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = clientCAs
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// testTLSConnect connects to address with the TLS settings and reads the reply of the server
+// A client certificate is only checked by the server after the handshake, the read reports its verdict.
+func testTLSConnect(address string, settings ConfigTLS) error {
+	host, _, _ := net.SplitHostPort(address)
+	config, err := newTLSConfig(host, settings)
+	if err != nil {
+		return err
+	}
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	return nil
+}
+
+// testFingerprint formats the SHA-256 of a certificate the way it is written in the configuration
+func testFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertificate(t)
+	otherCertFile, _, otherCert := writeTestCertificate(t)
+	address := startTLSTestServer(t, certFile, keyFile, nil)
+
+	tests := []struct {
+		name     string
+		settings ConfigTLS
+		connects bool
+	}{
+		{"unknown CA", ConfigTLS{}, false},
+		{"CA file", ConfigTLS{CAFile: certFile}, true},
+		{"other CA file", ConfigTLS{CAFile: otherCertFile}, false},
+		{"CA file with another server name", ConfigTLS{CAFile: certFile, ServerName: "mail.example.com"}, false},
+		{"CA file with a server name of the certificate", ConfigTLS{CAFile: certFile, ServerName: "localhost"}, true},
+		{"matching pin", ConfigTLS{Fingerprint: testFingerprint(cert)}, true},
+		{"matching pin without colons", ConfigTLS{Fingerprint: strings.ToLower(strings.ReplaceAll(testFingerprint(cert), ":", ""))}, true},
+		{"wrong pin", ConfigTLS{Fingerprint: testFingerprint(otherCert)}, false},
+		// The pin replaces chain verification, a CA file that would accept the server does not
+		{"wrong pin with CA file", ConfigTLS{Fingerprint: testFingerprint(otherCert), CAFile: certFile}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testTLSConnect(address, tt.settings)
+			if tt.connects && err != nil {
+				t.Errorf("connecting failed: %v", err)
+			}
+			if !tt.connects && err == nil {
+				t.Errorf("connected, want the server certificate refused")
+			}
+		})
+	}
+}
+
+func TestNewTLSConfigRefusesBadSettings(t *testing.T) {
+	certFile, keyFile, _ := writeTestCertificate(t)
+	tests := []struct {
+		name     string
+		settings ConfigTLS
+	}{
+		{"fingerprint not hex", ConfigTLS{Fingerprint: "not a fingerprint"}},
+		{"fingerprint too short", ConfigTLS{Fingerprint: "AB:CD:EF"}},
+		{"fingerprint of SHA-1", ConfigTLS{Fingerprint: strings.Repeat("AB:", 19) + "AB"}},
+		{"missing CA file", ConfigTLS{CAFile: certFile + ".missing"}},
+		{"CA file without certificates", ConfigTLS{CAFile: keyFile}},
+		{"client certificate without key", ConfigTLS{ClientCert: certFile}},
+		{"client key without certificate", ConfigTLS{ClientKey: keyFile}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTLSConfig("127.0.0.1", tt.settings); err == nil {
+				t.Errorf("newTLSConfig accepted the settings, want an error")
+			}
+		})
+	}
+}
+
+func TestNewTLSConfigClientCertificate(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertificate(t)
+	clientCertFile, clientKeyFile, clientCert := writeTestCertificate(t)
+	otherCertFile, otherKeyFile, _ := writeTestCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	address := startTLSTestServer(t, certFile, keyFile, clientCAs)
+
+	pin := testFingerprint(cert)
+	if err := testTLSConnect(address, ConfigTLS{Fingerprint: pin, ClientCert: clientCertFile, ClientKey: clientKeyFile}); err != nil {
+		t.Errorf("connecting with the client certificate failed: %v", err)
+	}
+	if err := testTLSConnect(address, ConfigTLS{Fingerprint: pin}); err == nil {
+		t.Errorf("connected without a client certificate, want the server to refuse")
+	}
+	if err := testTLSConnect(address, ConfigTLS{Fingerprint: pin, ClientCert: otherCertFile, ClientKey: otherKeyFile}); err == nil {
+		t.Errorf("connected with a client certificate the server does not trust, want the server to refuse")
+	}
+}
+
+func TestDialIMAPPlaintextOnlyToLoopback(t *testing.T) {
+	account, _ := startTestIMAPServer(t)
+	client, err := dialIMAP(account, nil)
+	if err != nil {
+		t.Fatalf("plaintext connection to %s refused: %v", account.Address, err)
+	}
+	client.Close()
+
+	for _, address := range []string{"192.0.2.1", "mail.example.com", "::ffff:192.0.2.1"} {
+		remote := account
+		remote.Address = address
+		if client, err := dialIMAP(remote, nil); err == nil {
+			client.Close()
+			t.Errorf("plaintext connection to %s allowed, want it refused", address)
+		}
+	}
+}
+
+func TestDialIMAPImplicitTLS(t *testing.T) {
+	certFile, keyFile, cert := writeTestCertificate(t)
+	serverCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	memServer := imapmemserver.New()
+	memServer.AddUser(imapmemserver.NewUser("user", "password"))
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		},
+		Caps:      imap.CapSet{imap.CapIMAP4rev1: {}, imap.CapIMAP4rev2: {}},
+		TLSConfig: serverTLS,
+	})
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	for _, tt := range []struct {
+		name     string
+		settings ConfigTLS
+		connects bool
+	}{
+		{"pinned", ConfigTLS{Mode: tlsModeImplicit, Fingerprint: testFingerprint(cert)}, true},
+		{"CA file", ConfigTLS{Mode: tlsModeImplicit, CAFile: certFile}, true},
+		{"unknown CA", ConfigTLS{Mode: tlsModeImplicit}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			account := ConfigIMAPAccount{Address: host, Port: port, TLS: tt.settings}
+			client, err := dialIMAP(account, nil)
+			if err == nil {
+				// A refused handshake may only surface on the first command
+				err = client.Noop().Wait()
+				client.Close()
+			}
+			if tt.connects && err != nil {
+				t.Errorf("connecting failed: %v", err)
+			}
+			if !tt.connects && err == nil {
+				t.Errorf("connected, want the server certificate refused")
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// tlsReport is an SMTP TLS report (RFC 8460), sent as JSON by the receivers of our mail
+type tlsReport struct {
+	OrganizationName string `json:"organization-name"`
+	DateRange        struct {
+		Start time.Time `json:"start-datetime"`
+		End   time.Time `json:"end-datetime"`
+	} `json:"date-range"`
+	ContactInfo string            `json:"contact-info"`
+	ReportID    string            `json:"report-id"`
+	Policies    []tlsPolicyResult `json:"policies"`
+}
+
+// tlsPolicyResult holds the sessions for one policy of a domain
+type tlsPolicyResult struct {
+	Policy struct {
+		Type   string   `json:"policy-type"` // sts, tlsa or no-policy-found
+		String []string `json:"policy-string"`
+		Domain string   `json:"policy-domain"`
+		MXHost []string `json:"mx-host"`
+	} `json:"policy"`
+	Summary struct {
+		Successful int64 `json:"total-successful-session-count"`
+		Failed     int64 `json:"total-failure-session-count"`
+	} `json:"summary"`
+	FailureDetails []tlsFailureDetails `json:"failure-details"`
+}
+
+// tlsFailureDetails counts the failed sessions for one result type and MX
+type tlsFailureDetails struct {
+	ResultType            string `json:"result-type"`
+	SendingMTAIP          string `json:"sending-mta-ip"`
+	ReceivingMXHostname   string `json:"receiving-mx-hostname"`
+	ReceivingMXHelo       string `json:"receiving-mx-helo"`
+	ReceivingIP           string `json:"receiving-ip"`
+	FailedSessionCount    int64  `json:"failed-session-count"`
+	AdditionalInformation string `json:"additional-information"`
+	FailureReasonCode     string `json:"failure-reason-code"`
+}
+
+const (
+	contentTypeTLSReportGzip = "application/tlsrpt+gzip"
+	contentTypeTLSReportJSON = "application/tlsrpt+json"
+)
+
+// decodeTLSReport decodes the JSON of a TLS report
+func decodeTLSReport(data []byte) (*tlsReport, error) {
+	tls := &tlsReport{}
+	if err := json.Unmarshal(data, tls); err != nil {
+		return nil, fmt.Errorf("decode failed: %w", err)
+	}
+	if tls.ReportID == "" {
+		return nil, fmt.Errorf("decode failed: TLS report without report-id")
+	}
+	return tls, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// formatDKIMAuthResults lists every DKIM result of a record in one cell, like "example.com (s1): pass, esp.net (k1): fail"
+func formatDKIMAuthResults(results []*DKIMAuthResult) string {
+	parts := make([]string, 0, len(results))
+	for _, a := range results {
+		parts = append(parts, formatAuthResult(a.Domain, a.Selector, a.Result))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatSPFAuthResults lists every SPF result of a record in one cell, like "example.com (mfrom): pass"
+func formatSPFAuthResults(results []*SPFAuthResult) string {
+	parts := make([]string, 0, len(results))
+	for _, a := range results {
+		parts = append(parts, formatAuthResult(a.Domain, a.Scope, a.Result))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatAuthResult formats one result, the selector or scope is left out if the reporter did not include it
+func formatAuthResult(domain, detail, result string) string {
+	if detail == "" {
+		return fmt.Sprintf("%s: %s", domain, result)
+	}
+	return fmt.Sprintf("%s (%s): %s", domain, detail, result)
+}
+
+// alignedDKIMDomains returns the domains of the passing DKIM signatures that align with the header from
+// Strict alignment (adkim=s) needs the same domain, relaxed alignment the same organizational domain.
+func alignedDKIMDomains(results []*DKIMAuthResult, headerFrom string, adkim string) string {
+	headerFrom = normalizeDomain(headerFrom)
+	aligned := make([]string, 0)
+	for _, a := range results {
+		if a.Result != "pass" {
+			continue
+		}
+		domain := normalizeDomain(a.Domain)
+		if domain == "" {
+			continue
+		}
+		if domain == headerFrom || (adkim != "s" && organizationalDomain(domain) == organizationalDomain(headerFrom)) {
+			aligned = append(aligned, a.Domain)
+		}
+	}
+	return strings.Join(aligned, ", ")
+}
+
+// normalizeDomain lowercases a domain and removes the trailing dot of a fully qualified name
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
+
+// organizationalDomain returns the registered domain of RFC 7489 section 3.2: the public suffix of the
+// domain with one label in front, like example.co.uk for mail.example.co.uk
+// A public suffix itself is returned as it is, so it only aligns with itself.
+func organizationalDomain(domain string) string {
+	organizational, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return organizational
+}
+
+// formatOverrideReasons lists the reasons a different policy was applied, like "forwarded, local_policy: arc=pass"
+func formatOverrideReasons(reasons []*OverrideReason) string {
+	parts := make([]string, 0, len(reasons))
+	for _, o := range reasons {
+		if o.Comment == "" {
+			parts = append(parts, o.Type)
+		} else {
+			parts = append(parts, fmt.Sprintf("%s: %s", o.Type, o.Comment))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestAlignedDKIMDomains(t *testing.T) {
+	tests := []struct {
+		name       string
+		headerFrom string
+		adkim      string
+		domain     string
+		result     string
+		aligned    bool
+	}{
+		{"strict same domain", "example.com", "s", "example.com", "pass", true},
+		{"strict subdomain", "example.com", "s", "mail.example.com", "pass", false},
+		{"strict case and trailing dot", "Example.COM.", "s", "example.com", "pass", true},
+		{"relaxed subdomain of header from", "example.com", "r", "mail.example.com", "pass", true},
+		{"relaxed header from is a subdomain", "news.example.com", "r", "example.com", "pass", true},
+		{"relaxed sibling subdomains", "news.example.com", "r", "mail.example.com", "pass", true},
+		{"relaxed is the default", "news.example.com", "", "mail.example.com", "pass", true},
+		{"relaxed other organization", "example.com", "r", "example.net", "pass", false},
+		{"relaxed lookalike suffix", "example.com", "r", "badexample.com", "pass", false},
+		{"relaxed below a public suffix", "shop.example.co.uk", "r", "mail.example.co.uk", "pass", true},
+		{"relaxed siblings under a public suffix", "example.co.uk", "r", "other.co.uk", "pass", false},
+		{"relaxed signed by the public suffix", "example.co.uk", "r", "co.uk", "pass", false},
+		{"relaxed private public suffix", "alice.github.io", "r", "bob.github.io", "pass", false},
+		{"failed signature", "example.com", "r", "example.com", "fail", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := []*DKIMAuthResult{{Domain: tt.domain, Result: tt.result}}
+			want := ""
+			if tt.aligned {
+				want = tt.domain
+			}
+			if got := alignedDKIMDomains(results, tt.headerFrom, tt.adkim); got != want {
+				t.Errorf("alignedDKIMDomains(%s, %s, %q) = %q, want %q", tt.domain, tt.headerFrom, tt.adkim, got, want)
+			}
+		})
+	}
+}
+
+func TestAlignedDKIMDomainsListsEveryAlignedSignature(t *testing.T) {
+	results := []*DKIMAuthResult{
+		{Domain: "example.com", Result: "pass"},
+		{Domain: "esp.net", Result: "pass"},
+		{Domain: "mail.example.com", Result: "pass"},
+	}
+	if got, want := alignedDKIMDomains(results, "news.example.com", "r"), "example.com, mail.example.com"; got != want {
+		t.Errorf("alignedDKIMDomains = %q, want %q", got, want)
+	}
+}
@@ -4,17 +4,11 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
-	"strings"
-
-	// Database drivers
-	_ "github.com/go-sql-driver/mysql" // mysql
-	_ "github.com/jackc/pgx/v5"        // postgres
-	_ "modernc.org/sqlite"             // sqlite3
 )
 
 type database struct {
 	backendDB *sql.DB
-	driver    string
+	dialect   *dialect
 
 	preparedStatements map[string]*sql.Stmt
 }
@@ -27,22 +21,47 @@ var (
 	preparedStatements = map[string]string{
 		// Fetch metadata
 		"fetch metadata": `
-		SELECT * FROM metadata;
+		SELECT id, organization, email, extra_contact_info, report_id, begin_date, end_date, COALESCE(version, ''), COALESCE(errors, ''), COALESCE(dkim_result, ''), COALESCE(dkim_domain, '') FROM metadata;
 		`,
 		// Fetch policy published
 		"fetch policy published": `
-		SELECT * FROM policy_published;
+		SELECT id, domain, adkim, aspf, policy, spolicy, COALESCE(percentage, 100), metadata_id, COALESCE(fo, ''), COALESCE(np, ''), COALESCE(psd, ''), COALESCE(testing, '') FROM policy_published;
 		`,
 		// Fetch record
 		"fetch record": `
-		SELECT * FROM record;
+		SELECT source_ip, count, disposition, dkim, spf, header_from, dkim_auth_result_domain, dkim_auth_result_result, dkim_auth_result_selector, spf_auth_result_domain, spf_auth_result_result, spf_auth_result_scope, metadata_id, COALESCE(position, 0), COALESCE(envelope_to, ''), COALESCE(envelope_from, '') FROM record;
+		`,
+		// Fetch policy override reasons
+		"fetch policy override reason": `
+		SELECT metadata_id, record_position, position, type, comment FROM policy_override_reason ORDER BY metadata_id, record_position, position;
+		`,
+		// Fetch DKIM auth results
+		"fetch dkim auth result": `
+		SELECT metadata_id, record_position, position, domain, selector, result, human_result FROM dkim_auth_result ORDER BY metadata_id, record_position, position;
+		`,
+		// Fetch SPF auth results
+		"fetch spf auth result": `
+		SELECT metadata_id, record_position, position, domain, scope, result FROM spf_auth_result ORDER BY metadata_id, record_position, position;
+		`,
+		// Fetch TLS reports
+		"fetch tlsrpt report": `
+		SELECT id, organization, contact_info, report_id, begin_date, end_date FROM tlsrpt_report;
+		`,
+		// Fetch TLS report policies
+		"fetch tlsrpt policy": `
+		SELECT tlsrpt_report_id, position, policy_type, policy_domain, mx_host, successful_session_count, failure_session_count FROM tlsrpt_policy;
+		`,
+		// Fetch TLS report failure details
+		"fetch tlsrpt failure": `
+		SELECT tlsrpt_report_id, policy_position, result_type, sending_mta_ip, receiving_mx_hostname, receiving_mx_helo, receiving_ip, failed_session_count, additional_information, failure_reason_code FROM tlsrpt_failure;
 		`,
 	}
 )
 
-const (
-	maxParams = 14 // Maximum number of parameters in a prepared statement, used to replace $1, $2, etc. with ? (for sqlite and mysql)
-)
+// schemaVersion is the version of the database schema, as kept by dmarcfetch, that the queries are written for
+// A newer schema is read as well: a migration that only adds tables or columns does not change what the
+// queries read, and one that renames or drops what they read makes them fail instead of reading the wrong data.
+const schemaVersion = 6
 
 func initDB() error {
 	err := db.Open(Configuration.Database.Driver, Configuration.Database.ConnectionString)
@@ -52,12 +71,34 @@ func initDB() error {
 	return nil
 }
 
+// checkSchemaVersion refuses a database that dmarcfetch has not migrated to the schema this tool reads
+// The scalar subquery also returns a row when schema_version is empty, not every database does for MAX alone.
+func (db *database) checkSchemaVersion() error {
+	version := 0
+	err := db.backendDB.QueryRow("SELECT COALESCE((SELECT MAX(version) FROM schema_version), 0)").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("no schema version found, run dmarcfetch migrate: %w", err)
+	}
+	if version < schemaVersion {
+		return fmt.Errorf("database schema version %d is older than version %d of this dmarcsqltoxls, run dmarcfetch migrate", version, schemaVersion)
+	}
+	if version > schemaVersion {
+		slog.Warn("database schema is newer than this dmarcsqltoxls, upgrade dmarcsqltoxls if reading it fails", "version", version, "supported", schemaVersion)
+	}
+	return nil
+}
+
 /*
 insert full record variables ) as transaction
 */
 func (db *database) Open(driver, connectionstring string) error {
 	var err error
-	db.backendDB, err = sql.Open(driver, connectionstring)
+	db.dialect, err = dialectFor(driver)
+	if err != nil {
+		slog.Error("error opening database", "error", err)
+		return err
+	}
+	db.backendDB, err = sql.Open(db.dialect.Driver, connectionstring)
 	if err != nil {
 		slog.Error("error opening database", "error", err)
 		return err
@@ -67,7 +108,11 @@ func (db *database) Open(driver, connectionstring string) error {
 		slog.Error("error connecting to database", "error", err)
 		return err
 	}
-	db.driver = driver
+	err = db.checkSchemaVersion()
+	if err != nil {
+		slog.Error("error checking database schema", "error", err)
+		return err
+	}
 
 	db.preparedStatements = make(map[string]*sql.Stmt)
 	err = db.initStatements()
@@ -80,18 +125,11 @@ func (db *database) Open(driver, connectionstring string) error {
 
 func (db *database) initStatements() error {
 	for name, query := range preparedStatements {
-		// Need to modify query placeholders
-		switch db.driver {
-		case "sqlite", "mysql":
-			for cnt := 0; cnt <= maxParams; cnt++ {
-				query = strings.ReplaceAll(query, fmt.Sprintf("$%dd", cnt), "?")
-			}
-		case "postgres": //do nothing
-		default:
-			slog.Error("prepared statements not implemented for driver", "driver", db.driver)
-			return fmt.Errorf("prepared statements not implemented for driver %s", db.driver)
+		query, err := db.dialect.rebind(query)
+		if err != nil {
+			slog.Error("error preparing statement", "statement", name, "error", err)
+			return err
 		}
-
 		stmt, err := db.backendDB.Prepare(query)
 		if err != nil {
 			slog.Error("error preparing statement", "error", err)
@@ -107,12 +145,17 @@ func (db *database) Close() error {
 }
 
 type Metadata struct {
+	ID               int64
 	OrgName          string
 	Email            string
 	ExtraContactInfo string
 	ReportID         string
 	Begin            int64
 	End              int64
+	Version          string
+	Errors           string
+	DKIMResult       string // The DKIM result of the report message, empty if not verified
+	DKIMDomain       string
 }
 
 func (db *database) FetchMetadata() ([]*Metadata, error) {
@@ -123,10 +166,9 @@ func (db *database) FetchMetadata() ([]*Metadata, error) {
 	}
 	defer rows.Close()
 	metadata := make([]*Metadata, 0)
-	id := 0
 	for rows.Next() {
 		m := Metadata{}
-		if err := rows.Scan(&id, &m.OrgName, &m.Email, &m.ExtraContactInfo, &m.ReportID, &m.Begin, &m.End); err != nil {
+		if err := rows.Scan(&m.ID, &m.OrgName, &m.Email, &m.ExtraContactInfo, &m.ReportID, &m.Begin, &m.End, &m.Version, &m.Errors, &m.DKIMResult, &m.DKIMDomain); err != nil {
 			slog.Error("error scanning metadata", "error", err)
 			return nil, err
 		}
@@ -147,7 +189,11 @@ type PolicyPublished struct {
 	Policy     string `xml:"p"`
 	SPolicy    string `xml:"sp"`
 	Percentage int    `xml:"pct"`
-	ReportID   string
+	MetadataID int64
+	FO         string `xml:"fo"`
+	NP         string `xml:"np"`
+	PSD        string `xml:"psd"`
+	Testing    string `xml:"testing"`
 }
 
 func (db *database) FetchPolicyPublished() ([]*PolicyPublished, error) {
@@ -161,7 +207,7 @@ func (db *database) FetchPolicyPublished() ([]*PolicyPublished, error) {
 	id := 0
 	for rows.Next() {
 		p := PolicyPublished{}
-		if err := rows.Scan(&id, &p.Domain, &p.ADKIM, &p.ASPF, &p.Policy, &p.SPolicy, &p.Percentage, &p.ReportID); err != nil {
+		if err := rows.Scan(&id, &p.Domain, &p.ADKIM, &p.ASPF, &p.Policy, &p.SPolicy, &p.Percentage, &p.MetadataID, &p.FO, &p.NP, &p.PSD, &p.Testing); err != nil {
 			slog.Error("error scanning policy published", "error", err)
 			return nil, err
 		}
@@ -187,7 +233,14 @@ type Record struct {
 	SPFAuthResultDomain    string
 	SPFAuthResultResult    string
 	SPFAuthResultScope     string
-	ReportID               string
+	MetadataID             int64
+	Position               int
+	EnvelopeTo             string
+	EnvelopeFrom           string
+
+	DKIMAuthResults []*DKIMAuthResult // Every DKIM result, the DKIMAuthResult fields only hold the first
+	SPFAuthResults  []*SPFAuthResult  // Every SPF result, the SPFAuthResult fields only hold the first
+	OverrideReasons []*OverrideReason
 }
 
 func (db *database) FetchRecords() ([]*Record, error) {
@@ -198,10 +251,9 @@ func (db *database) FetchRecords() ([]*Record, error) {
 	}
 	defer rows.Close()
 	records := make([]*Record, 0)
-	id := 0
 	for rows.Next() {
 		r := Record{}
-		if err := rows.Scan(&id, &r.SourceIP, &r.Count, &r.Disposition, &r.DKIM, &r.SPF, &r.HeaderFrom, &r.DKIMAuthResultDomain, &r.DKIMAuthResultResult, &r.DKIMAuthResultSelector, &r.SPFAuthResultDomain, &r.SPFAuthResultResult, &r.SPFAuthResultScope, &r.ReportID); err != nil {
+		if err := rows.Scan(&r.SourceIP, &r.Count, &r.Disposition, &r.DKIM, &r.SPF, &r.HeaderFrom, &r.DKIMAuthResultDomain, &r.DKIMAuthResultResult, &r.DKIMAuthResultSelector, &r.SPFAuthResultDomain, &r.SPFAuthResultResult, &r.SPFAuthResultScope, &r.MetadataID, &r.Position, &r.EnvelopeTo, &r.EnvelopeFrom); err != nil {
 			slog.Error("error scanning record", "error", err)
 			return nil, err
 		}
@@ -213,3 +265,206 @@ func (db *database) FetchRecords() ([]*Record, error) {
 	}
 	return records, nil
 }
+
+// TLSReport represents an SMTP TLS report
+type TLSReport struct {
+	ID          int64
+	OrgName     string
+	ContactInfo string
+	ReportID    string
+	Begin       int64
+	End         int64
+}
+
+func (db *database) FetchTLSReports() ([]*TLSReport, error) {
+	rows, err := db.preparedStatements["fetch tlsrpt report"].Query()
+	if err != nil {
+		slog.Error("error querying tlsrpt report", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	reports := make([]*TLSReport, 0)
+	for rows.Next() {
+		r := TLSReport{}
+		if err := rows.Scan(&r.ID, &r.OrgName, &r.ContactInfo, &r.ReportID, &r.Begin, &r.End); err != nil {
+			slog.Error("error scanning tlsrpt report", "error", err)
+			return nil, err
+		}
+		reports = append(reports, &r)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("error scanning tlsrpt report", "error", err)
+		return nil, err
+	}
+	return reports, nil
+}
+
+// TLSPolicy represents the session counts of one policy in a TLS report
+type TLSPolicy struct {
+	TLSReportID        int64
+	Position           int
+	Type               string
+	Domain             string
+	MXHost             string
+	SuccessfulSessions int64
+	FailedSessions     int64
+}
+
+func (db *database) FetchTLSPolicies() ([]*TLSPolicy, error) {
+	rows, err := db.preparedStatements["fetch tlsrpt policy"].Query()
+	if err != nil {
+		slog.Error("error querying tlsrpt policy", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	policies := make([]*TLSPolicy, 0)
+	for rows.Next() {
+		p := TLSPolicy{}
+		if err := rows.Scan(&p.TLSReportID, &p.Position, &p.Type, &p.Domain, &p.MXHost, &p.SuccessfulSessions, &p.FailedSessions); err != nil {
+			slog.Error("error scanning tlsrpt policy", "error", err)
+			return nil, err
+		}
+		policies = append(policies, &p)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("error scanning tlsrpt policy", "error", err)
+		return nil, err
+	}
+	return policies, nil
+}
+
+// TLSFailure represents the failed sessions of one result type and MX in a TLS report
+type TLSFailure struct {
+	TLSReportID           int64
+	PolicyPosition        int
+	ResultType            string
+	SendingMTAIP          string
+	ReceivingMXHostname   string
+	ReceivingMXHelo       string
+	ReceivingIP           string
+	FailedSessions        int64
+	AdditionalInformation string
+	FailureReasonCode     string
+}
+
+func (db *database) FetchTLSFailures() ([]*TLSFailure, error) {
+	rows, err := db.preparedStatements["fetch tlsrpt failure"].Query()
+	if err != nil {
+		slog.Error("error querying tlsrpt failure", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	failures := make([]*TLSFailure, 0)
+	for rows.Next() {
+		f := TLSFailure{}
+		if err := rows.Scan(&f.TLSReportID, &f.PolicyPosition, &f.ResultType, &f.SendingMTAIP, &f.ReceivingMXHostname, &f.ReceivingMXHelo, &f.ReceivingIP, &f.FailedSessions, &f.AdditionalInformation, &f.FailureReasonCode); err != nil {
+			slog.Error("error scanning tlsrpt failure", "error", err)
+			return nil, err
+		}
+		failures = append(failures, &f)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("error scanning tlsrpt failure", "error", err)
+		return nil, err
+	}
+	return failures, nil
+}
+
+// DKIMAuthResult represents one feedback>record>auth_results>dkim section
+type DKIMAuthResult struct {
+	MetadataID     int64
+	RecordPosition int
+	Position       int
+	Domain         string
+	Selector       string
+	Result         string
+	HumanResult    string
+}
+
+func (db *database) FetchDKIMAuthResults() ([]*DKIMAuthResult, error) {
+	rows, err := db.preparedStatements["fetch dkim auth result"].Query()
+	if err != nil {
+		slog.Error("error querying dkim auth result", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	results := make([]*DKIMAuthResult, 0)
+	for rows.Next() {
+		a := DKIMAuthResult{}
+		if err := rows.Scan(&a.MetadataID, &a.RecordPosition, &a.Position, &a.Domain, &a.Selector, &a.Result, &a.HumanResult); err != nil {
+			slog.Error("error scanning dkim auth result", "error", err)
+			return nil, err
+		}
+		results = append(results, &a)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("error scanning dkim auth result", "error", err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// SPFAuthResult represents one feedback>record>auth_results>spf section
+type SPFAuthResult struct {
+	MetadataID     int64
+	RecordPosition int
+	Position       int
+	Domain         string
+	Scope          string
+	Result         string
+}
+
+func (db *database) FetchSPFAuthResults() ([]*SPFAuthResult, error) {
+	rows, err := db.preparedStatements["fetch spf auth result"].Query()
+	if err != nil {
+		slog.Error("error querying spf auth result", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	results := make([]*SPFAuthResult, 0)
+	for rows.Next() {
+		a := SPFAuthResult{}
+		if err := rows.Scan(&a.MetadataID, &a.RecordPosition, &a.Position, &a.Domain, &a.Scope, &a.Result); err != nil {
+			slog.Error("error scanning spf auth result", "error", err)
+			return nil, err
+		}
+		results = append(results, &a)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("error scanning spf auth result", "error", err)
+		return nil, err
+	}
+	return results, nil
+}
+
+// OverrideReason represents one feedback>record>row>policy_evaluated>reason section
+type OverrideReason struct {
+	MetadataID     int64
+	RecordPosition int
+	Position       int
+	Type           string
+	Comment        string
+}
+
+func (db *database) FetchOverrideReasons() ([]*OverrideReason, error) {
+	rows, err := db.preparedStatements["fetch policy override reason"].Query()
+	if err != nil {
+		slog.Error("error querying policy override reason", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	reasons := make([]*OverrideReason, 0)
+	for rows.Next() {
+		o := OverrideReason{}
+		if err := rows.Scan(&o.MetadataID, &o.RecordPosition, &o.Position, &o.Type, &o.Comment); err != nil {
+			slog.Error("error scanning policy override reason", "error", err)
+			return nil, err
+		}
+		reasons = append(reasons, &o)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("error scanning policy override reason", "error", err)
+		return nil, err
+	}
+	return reasons, nil
+}
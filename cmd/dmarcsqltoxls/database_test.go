@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSchemaVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []int // nil for no schema_version table
+		err      string
+	}{
+		{"no schema_version table", nil, "no schema version found"},
+		{"empty schema_version", []int{}, "older than version"},
+		{"older", []int{1, 2, 3, 4, 5}, "older than version"},
+		{"current", []int{1, 2, 3, 4, 5, 6}, ""},
+		// Tables and columns added by a newer dmarcfetch do not change what is read
+		{"newer", []int{1, 2, 3, 4, 5, 6, 7}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backendDB, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "dmarc.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer backendDB.Close()
+			if tt.versions != nil {
+				if _, err := backendDB.Exec("CREATE TABLE schema_version (version INTEGER PRIMARY KEY, description TEXT, applied INTEGER)"); err != nil {
+					t.Fatal(err)
+				}
+				for _, version := range tt.versions {
+					if _, err := backendDB.Exec(fmt.Sprintf("INSERT INTO schema_version (version) VALUES (%d)", version)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			check := &database{backendDB: backendDB, dialect: dialects["sqlite"]}
+			err = check.checkSchemaVersion()
+			if tt.err == "" && err != nil {
+				t.Errorf("checkSchemaVersion error: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("checkSchemaVersion error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	// Database drivers
+	_ "github.com/go-sql-driver/mysql" // mysql
+	_ "github.com/jackc/pgx/v5/stdlib" // postgres, registered as pgx
+	_ "modernc.org/sqlite"             // sqlite
+)
+
+// dialect holds what differs between the supported databases
+// Statements are written with Postgres placeholders ($1, $2, ...), see rebind.
+type dialect struct {
+	Name   string // Driver in the configuration
+	Driver string // Name of the database/sql driver
+}
+
+// dialects are the supported databases, by the driver in the configuration
+var dialects = map[string]*dialect{
+	"sqlite":   {Name: "sqlite", Driver: "sqlite"},
+	"mysql":    {Name: "mysql", Driver: "mysql"},
+	"postgres": {Name: "postgres", Driver: "pgx"},
+}
+
+// dialectFor returns the dialect of a configured driver
+func dialectFor(driver string) (*dialect, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("database driver %s not supported, use sqlite, mysql or postgres", driver)
+	}
+	return d, nil
+}
+
+var placeholderRegexp = regexp.MustCompile(`\$(\d+)`)
+
+// rebind rewrites the $1, $2, ... placeholders of a query for the dialect
+// SQLite takes ?1, ?2, ... MySQL only knows ?, so there the placeholders must be numbered in the
+// order they appear in the query, each used once.
+func (d *dialect) rebind(query string) (string, error) {
+	switch d.Name {
+	case "sqlite":
+		return placeholderRegexp.ReplaceAllString(query, "?$1"), nil
+	case "mysql":
+		next := 1
+		var err error
+		query = placeholderRegexp.ReplaceAllStringFunc(query, func(placeholder string) string {
+			if n, _ := strconv.Atoi(placeholder[1:]); n != next && err == nil {
+				err = fmt.Errorf("placeholder %s found where $%d was expected", placeholder, next)
+			}
+			next++
+			return "?"
+		})
+		return query, err
+	}
+	return query, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dialect string
+		query   string
+		want    string
+		err     string
+	}{
+		{"sqlite", "SELECT a FROM t WHERE b >= $1 AND b <= $2", "SELECT a FROM t WHERE b >= ?1 AND b <= ?2", ""},
+		{"sqlite", "SELECT a FROM t WHERE b = $2 OR c = $1", "SELECT a FROM t WHERE b = ?2 OR c = ?1", ""},
+		{"postgres", "SELECT a FROM t WHERE b >= $1 AND b <= $2", "SELECT a FROM t WHERE b >= $1 AND b <= $2", ""},
+		{"mysql", "SELECT a FROM t WHERE b >= $1 AND b <= $2", "SELECT a FROM t WHERE b >= ? AND b <= ?", ""},
+		{"mysql", "SELECT a FROM t WHERE b = $2 OR c = $1", "", "placeholder $2 found where $1 was expected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dialect+" "+tt.query, func(t *testing.T) {
+			query, err := dialects[tt.dialect].rebind(tt.query)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("rebind error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || query != tt.want {
+				t.Errorf("rebind = %q (%v), want %q", query, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatementsRebindForEveryDialect(t *testing.T) {
+	for name, d := range dialects {
+		for statement, query := range preparedStatements {
+			if _, err := d.rebind(query); err != nil {
+				t.Errorf("%s: statement %q: %v", name, statement, err)
+			}
+		}
+	}
+}
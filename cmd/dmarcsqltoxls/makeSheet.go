@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
 	"time"
 	"unicode/utf8"
 
@@ -37,6 +38,20 @@ var (
 		"SPF Auth Result Domain",
 		"SPF Auth Result Result",
 		"SPF Auth Result Scope",
+		"DKIM Auth Results",
+		"SPF Auth Results",
+		"DKIM Aligned Domains",
+		"Envelope To",
+		"Envelope From",
+		"Override Reasons",
+		"Policy Published Failure Options",
+		"Policy Published Non-existent Subdomain Policy",
+		"Policy Published PSD",
+		"Policy Published Testing",
+		"Report Version",
+		"Report Errors",
+		"Report DKIM Result",
+		"Report DKIM Signing Domain",
 	}
 )
 
@@ -53,10 +68,10 @@ type SheetSummary struct {
 
 func makeSheet(f *excelize.File,
 	year int, month int,
-	TimeBasedIndex map[int]map[int][]string,
-	MetaDataIndex map[string]*Metadata,
-	PolicyPublishedIndex map[string]*PolicyPublished,
-	RecordIndex map[string][]*Record) SheetSummary {
+	TimeBasedIndex map[int]map[int][]int64,
+	MetaDataIndex map[int64]*Metadata,
+	PolicyPublishedIndex map[int64]*PolicyPublished,
+	RecordIndex map[int64][]*Record) SheetSummary {
 
 	Summary := SheetSummary{
 		Year:  year,
@@ -65,11 +80,11 @@ func makeSheet(f *excelize.File,
 	}
 
 	// Create raw data for Raw Data sheet
-	// Group by ReportID
+	// Group by report
 	rawSheet := make([][]interface{}, 0)
 	sheetName := fmt.Sprintf("%d-%02d", year, month)
-	for _, reportID := range TimeBasedIndex[year][month] {
-		m := MetaDataIndex[reportID]
+	for _, metadataID := range TimeBasedIndex[year][month] {
+		m := MetaDataIndex[metadataID]
 
 		rowMetaData := make([]interface{}, 0)
 		rowMetaData = append(rowMetaData, m.ReportID)
@@ -78,7 +93,7 @@ func makeSheet(f *excelize.File,
 		rowMetaData = append(rowMetaData, m.ExtraContactInfo)
 		rowMetaData = append(rowMetaData, time.Unix(m.Begin, 0))
 		rowMetaData = append(rowMetaData, time.Unix(m.End, 0))
-		p := PolicyPublishedIndex[m.ReportID]
+		p := PolicyPublishedIndex[m.ID]
 		rowMetaData = append(rowMetaData, p.Domain)
 		rowMetaData = append(rowMetaData, p.ADKIM)
 		rowMetaData = append(rowMetaData, p.ASPF)
@@ -87,8 +102,8 @@ func makeSheet(f *excelize.File,
 		rowMetaData = append(rowMetaData, p.SPolicy)
 
 		// Now copy that base row for each record and add the record data
-		for _, r := range RecordIndex[m.ReportID] {
-			row := rowMetaData[:] // Clone the base
+		for _, r := range RecordIndex[m.ID] {
+			row := slices.Clone(rowMetaData) // Clone the base, appending to it directly would overwrite the previous record
 			row = append(row, r.SourceIP)
 			row = append(row, r.Count)
 			row = append(row, r.Disposition)
@@ -101,6 +116,20 @@ func makeSheet(f *excelize.File,
 			row = append(row, r.SPFAuthResultDomain)
 			row = append(row, r.SPFAuthResultResult)
 			row = append(row, r.SPFAuthResultScope)
+			row = append(row, formatDKIMAuthResults(r.DKIMAuthResults))
+			row = append(row, formatSPFAuthResults(r.SPFAuthResults))
+			row = append(row, alignedDKIMDomains(r.DKIMAuthResults, r.HeaderFrom, p.ADKIM))
+			row = append(row, r.EnvelopeTo)
+			row = append(row, r.EnvelopeFrom)
+			row = append(row, formatOverrideReasons(r.OverrideReasons))
+			row = append(row, p.FO)
+			row = append(row, p.NP)
+			row = append(row, p.PSD)
+			row = append(row, p.Testing)
+			row = append(row, m.Version)
+			row = append(row, m.Errors)
+			row = append(row, m.DKIMResult)
+			row = append(row, m.DKIMDomain)
 
 			rawSheet = append(rawSheet, row)
 
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const tlsSheetName = "tls-reports"
+
+var (
+	tlsHeader = []string{
+		"Report ID",
+		"Org Name",
+		"Contact Info",
+		"Begin Date/Time",
+		"End Date/Time",
+		"Policy Type",
+		"Policy Domain",
+		"MX Host",
+		"Successful Sessions",
+		"Failed Sessions",
+		"Result Type",
+		"Sending MTA IP",
+		"Receiving MX Hostname",
+		"Receiving MX HELO",
+		"Receiving IP",
+		"Failed Session Count",
+		"Additional Information",
+		"Failure Reason Code",
+	}
+)
+
+func makeTLSSheet(f *excelize.File,
+	TLSReports []*TLSReport,
+	TLSPolicies []*TLSPolicy,
+	TLSFailures []*TLSFailure) {
+
+	// Index policies and failures by report, in the order of the report
+	PolicyIndex := make(map[int64][]*TLSPolicy)
+	for _, p := range TLSPolicies {
+		PolicyIndex[p.TLSReportID] = append(PolicyIndex[p.TLSReportID], p)
+	}
+	FailureIndex := make(map[string][]*TLSFailure)
+	for _, fd := range TLSFailures {
+		key := fmt.Sprintf("%d/%d", fd.TLSReportID, fd.PolicyPosition)
+		FailureIndex[key] = append(FailureIndex[key], fd)
+	}
+	// Newest reports first, like the data sheets
+	slices.SortFunc(TLSReports, func(a, b *TLSReport) int {
+		return cmp.Compare(b.Begin, a.Begin)
+	})
+
+	// One row per failure detail, a policy without failures gets a single row
+	rawSheet := make([][]interface{}, 0)
+	for _, r := range TLSReports {
+		policies := PolicyIndex[r.ID]
+		slices.SortFunc(policies, func(a, b *TLSPolicy) int {
+			return cmp.Compare(a.Position, b.Position)
+		})
+		for _, p := range policies {
+			row := make([]interface{}, 0)
+			row = append(row, r.ReportID)
+			row = append(row, r.OrgName)
+			row = append(row, r.ContactInfo)
+			row = append(row, time.Unix(r.Begin, 0))
+			row = append(row, time.Unix(r.End, 0))
+			row = append(row, p.Type)
+			row = append(row, p.Domain)
+			row = append(row, p.MXHost)
+			row = append(row, p.SuccessfulSessions)
+			row = append(row, p.FailedSessions)
+
+			failures := FailureIndex[fmt.Sprintf("%d/%d", r.ID, p.Position)]
+			if len(failures) == 0 {
+				rawSheet = append(rawSheet, row)
+				continue
+			}
+			for _, fd := range failures {
+				failureRow := slices.Clone(row)
+				failureRow = append(failureRow, fd.ResultType)
+				failureRow = append(failureRow, fd.SendingMTAIP)
+				failureRow = append(failureRow, fd.ReceivingMXHostname)
+				failureRow = append(failureRow, fd.ReceivingMXHelo)
+				failureRow = append(failureRow, fd.ReceivingIP)
+				failureRow = append(failureRow, fd.FailedSessions)
+				failureRow = append(failureRow, fd.AdditionalInformation)
+				failureRow = append(failureRow, fd.FailureReasonCode)
+				rawSheet = append(rawSheet, failureRow)
+			}
+		}
+	}
+
+	f.DeleteSheet(tlsSheetName) // Remove any placeholders for the template
+	_, err := f.NewSheet(tlsSheetName)
+	if err != nil {
+		slog.Error("error creating sheet", "error", err)
+		os.Exit(1)
+	}
+
+	loc, _ := excelize.CoordinatesToCellName(2, 1)
+	f.SetSheetRow(tlsSheetName, loc, &tlsHeader)
+	reportID := ""
+	flipFlopper := true
+
+	cellStyleName := ""
+	cellDateStyleName := ""
+
+	for ridx, row := range rawSheet {
+		loc, _ := excelize.CoordinatesToCellName(2, 2+ridx)
+		locEnd, _ := excelize.CoordinatesToCellName(1+len(tlsHeader), 2+ridx)
+		locDateStart, _ := excelize.CoordinatesToCellName(5, 2+ridx)
+		locDateEnd, _ := excelize.CoordinatesToCellName(6, 2+ridx)
+		if reportID != row[0].(string) {
+			flipFlopper = !flipFlopper
+			reportID = row[0].(string)
+		}
+		if flipFlopper {
+			if ridx%2 == 0 {
+				cellStyleName = "aLight"
+				cellDateStyleName = "aLightDate"
+			} else {
+				cellStyleName = "aDark"
+				cellDateStyleName = "aDarkDate"
+			}
+		} else {
+			if ridx%2 == 0 {
+				cellStyleName = "bLight"
+				cellDateStyleName = "bLightDate"
+			} else {
+				cellStyleName = "bDark"
+				cellDateStyleName = "bDarkDate"
+			}
+		}
+
+		// Any failed session for the policy marks the row
+		if row[9].(int64) > 0 {
+			cellStyleName += "Fail"
+			cellDateStyleName += "Fail"
+		}
+
+		f.SetCellStyle(tlsSheetName, loc, locEnd, cellStyles[cellStyleName])
+		f.SetSheetRow(tlsSheetName, loc, &row)
+		f.SetCellStyle(tlsSheetName, locDateStart, locDateEnd, cellStyles[cellDateStyleName])
+	}
+
+	setAutoWidth(f, tlsSheetName)
+
+	// Make a table out of the raw data
+	loc, _ = excelize.CoordinatesToCellName(2, 1)
+	locend, _ := excelize.CoordinatesToCellName(1+len(tlsHeader), 1+len(rawSheet))
+	f.AutoFilter(tlsSheetName, loc+":"+locend, []excelize.AutoFilterOptions{})
+}
@@ -27,6 +27,36 @@ func buildXLS() {
 		slog.Error("error fetching records", "error", err)
 		os.Exit(1)
 	}
+	DKIMAuthResults, err := db.FetchDKIMAuthResults()
+	if err != nil {
+		slog.Error("error fetching DKIM auth results", "error", err)
+		os.Exit(1)
+	}
+	SPFAuthResults, err := db.FetchSPFAuthResults()
+	if err != nil {
+		slog.Error("error fetching SPF auth results", "error", err)
+		os.Exit(1)
+	}
+	OverrideReasons, err := db.FetchOverrideReasons()
+	if err != nil {
+		slog.Error("error fetching policy override reasons", "error", err)
+		os.Exit(1)
+	}
+	TLSReports, err := db.FetchTLSReports()
+	if err != nil {
+		slog.Error("error fetching TLS reports", "error", err)
+		os.Exit(1)
+	}
+	TLSPolicies, err := db.FetchTLSPolicies()
+	if err != nil {
+		slog.Error("error fetching TLS policies", "error", err)
+		os.Exit(1)
+	}
+	TLSFailures, err := db.FetchTLSFailures()
+	if err != nil {
+		slog.Error("error fetching TLS failures", "error", err)
+		os.Exit(1)
+	}
 	err = db.Close()
 	if err != nil {
 		slog.Error("error closing database", "error", err)
@@ -34,29 +64,49 @@ func buildXLS() {
 	}
 	// Done with DB, first make some indices
 
-	// YYYY -> MM -> ReportID
-	TimeBasedIndex := make(map[int]map[int][]string)
+	// YYYY -> MM -> metadata ID, report IDs are only unique per reporter
+	TimeBasedIndex := make(map[int]map[int][]int64)
 
-	MetaDataIndex := make(map[string]*Metadata)
+	MetaDataIndex := make(map[int64]*Metadata)
 	for _, m := range MetaDatas {
 		year := time.Unix(m.Begin, 0).Year()
 		month := int(time.Unix(m.Begin, 0).Month())
 		if _, ok := TimeBasedIndex[year]; !ok {
-			TimeBasedIndex[year] = make(map[int][]string)
+			TimeBasedIndex[year] = make(map[int][]int64)
 		}
 		if _, ok := TimeBasedIndex[year][month]; !ok {
-			TimeBasedIndex[year][month] = make([]string, 0)
+			TimeBasedIndex[year][month] = make([]int64, 0)
 		}
-		TimeBasedIndex[year][month] = append(TimeBasedIndex[year][month], m.ReportID)
-		MetaDataIndex[m.ReportID] = m
+		TimeBasedIndex[year][month] = append(TimeBasedIndex[year][month], m.ID)
+		MetaDataIndex[m.ID] = m
 	}
-	PolicyPublishedIndex := make(map[string]*PolicyPublished)
+	PolicyPublishedIndex := make(map[int64]*PolicyPublished)
 	for _, p := range PoliciesPublished {
-		PolicyPublishedIndex[p.ReportID] = p
+		PolicyPublishedIndex[p.MetadataID] = p
 	}
-	RecordIndex := make(map[string][]*Record)
+	RecordIndex := make(map[int64][]*Record)
 	for _, r := range Records {
-		RecordIndex[r.ReportID] = append(RecordIndex[r.ReportID], r)
+		RecordIndex[r.MetadataID] = append(RecordIndex[r.MetadataID], r)
+	}
+	// Attach all auth results and override reasons to their record
+	RecordPositionIndex := make(map[string]*Record)
+	for _, r := range Records {
+		RecordPositionIndex[fmt.Sprintf("%d/%d", r.MetadataID, r.Position)] = r
+	}
+	for _, a := range DKIMAuthResults {
+		if r, ok := RecordPositionIndex[fmt.Sprintf("%d/%d", a.MetadataID, a.RecordPosition)]; ok {
+			r.DKIMAuthResults = append(r.DKIMAuthResults, a)
+		}
+	}
+	for _, a := range SPFAuthResults {
+		if r, ok := RecordPositionIndex[fmt.Sprintf("%d/%d", a.MetadataID, a.RecordPosition)]; ok {
+			r.SPFAuthResults = append(r.SPFAuthResults, a)
+		}
+	}
+	for _, o := range OverrideReasons {
+		if r, ok := RecordPositionIndex[fmt.Sprintf("%d/%d", o.MetadataID, o.RecordPosition)]; ok {
+			r.OverrideReasons = append(r.OverrideReasons, o)
+		}
 	}
 
 	// Now we have indices, we can build the XLSX
@@ -129,6 +179,11 @@ func buildXLS() {
 	slog.Info("Building summary")
 	makeSummary(f, Summaries)
 
+	if len(TLSReports) > 0 {
+		slog.Info("Building TLS report sheet")
+		makeTLSSheet(f, TLSReports, TLSPolicies, TLSFailures)
+	}
+
 	f.SetActiveSheet(firstsheet)
 
 	if err := f.SaveAs(Configuration.XLS.Output); err != nil {
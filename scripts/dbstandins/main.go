@@ -0,0 +1,97 @@
+// dbstandins runs a MySQL or Postgres server without a container, for the database tests of dmarcfetch
+// It is a module of its own so the servers and what they pull in stay out of dmarcfetch. It prints the
+// environment variable the tests read and serves until interrupted:
+//
+//	cd scripts/dbstandins && GOWORK=off go run . mysql
+//	DMARCANALYZE_TEST_MYSQL='root:@tcp(127.0.0.1:33060)/dmarc' go test -run Server ./...
+//
+// MySQL is served by go-mysql-server from memory. Postgres is a real server from the binaries of
+// embedded-postgres, they are downloaded from Maven Central on the first run.
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	gmssql "github.com/dolthub/go-mysql-server/sql"
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+)
+
+const (
+	mysqlAddress = "127.0.0.1:33060"
+	postgresPort = 54320
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: dbstandins mysql|postgres")
+		os.Exit(2)
+	}
+	var stop func() error
+	var err error
+	switch os.Args[1] {
+	case "mysql":
+		stop, err = startMySQL()
+	case "postgres":
+		stop, err = startPostgres()
+	default:
+		err = fmt.Errorf("unknown database %s, use mysql or postgres", os.Args[1])
+	}
+	if err != nil {
+		slog.Error("error starting database", "error", err)
+		os.Exit(1)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	if err := stop(); err != nil {
+		slog.Error("error stopping database", "error", err)
+		os.Exit(1)
+	}
+}
+
+// startMySQL serves an empty in-memory database named dmarc over the MySQL protocol
+func startMySQL() (func() error, error) {
+	memoryDB := memory.NewDatabase("dmarc")
+	// Like InnoDB, a foreign key may refer to the primary key without an index of its own
+	memoryDB.EnablePrimaryKeyIndexes()
+	provider := memory.NewDBProvider(memoryDB)
+	mysqlServer, err := server.NewServer(server.Config{Protocol: "tcp", Address: mysqlAddress}, sqle.NewDefault(provider), gmssql.NewContext, memory.NewSessionBuilder(provider), nil)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := mysqlServer.Start(); err != nil {
+			slog.Error("error serving MySQL", "error", err)
+		}
+	}()
+	fmt.Printf("DMARCANALYZE_TEST_MYSQL='root:@tcp(%s)/dmarc'\n", mysqlAddress)
+	return mysqlServer.Close, nil
+}
+
+// startPostgres runs a Postgres server with an empty database named dmarc
+func startPostgres() (func() error, error) {
+	runtime, err := os.MkdirTemp("", "dbstandins")
+	if err != nil {
+		return nil, err
+	}
+	postgres := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+		Port(postgresPort).
+		Database("dmarc").
+		RuntimePath(filepath.Join(runtime, "postgres")))
+	if err := postgres.Start(); err != nil {
+		os.RemoveAll(runtime)
+		return nil, err
+	}
+	fmt.Printf("DMARCANALYZE_TEST_POSTGRES='host=127.0.0.1 port=%d user=postgres password=postgres dbname=dmarc sslmode=disable'\n", postgresPort)
+	return func() error {
+		defer os.RemoveAll(runtime)
+		return postgres.Stop()
+	}, nil
+}